@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidQuery = errors.New("invalid query")
+
+const (
+	defaultAccessLogLimit = 100
+	maxAccessLogLimit     = 1000
+)
+
+// AccessLogQuery filters access logs. Zero values mean no filter. Since is
+// inclusive and Until exclusive, both unix seconds. IP takes a single
+// address or a CIDR and UserAgent is a case-insensitive substring.
+// ExcludeTagIDs skips logs for those tags and Tags keeps only logs of tags
+// with matching metadata. Kind is one of the HitClassifier labels, Country
+// an ISO code and ASN a network number from GeoIP. TenantID is filled in from the context by the
+// Database implementations, see scope.
+type AccessLogQuery struct {
+	TenantID      string
+	TagID         string
+	ExcludeTagIDs []string
+	Tags          TagFilter
+	Severity      string
+	Kind          string
+	Since         int
+	Until         int
+	IP            string
+	UserAgent     string
+	Country       string
+	ASN           uint
+	Cursor        string
+	Limit         int
+	Descending    bool
+}
+
+type AccessLogPage struct {
+	Logs       []*AccessLog `json:"logs"`
+	NextCursor string       `json:"next_cursor,omitempty"`
+}
+
+type accessLogCursor struct {
+	Timestamp int
+	ID        int64
+}
+
+func encodeAccessLogCursor(log *AccessLog) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%d", log.Timestamp, log.ID)))
+}
+
+func decodeAccessLogCursor(cursor string) (*accessLogCursor, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad cursor: %v", ErrInvalidQuery, err)
+	}
+	ts, id, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return nil, fmt.Errorf("%w: bad cursor", ErrInvalidQuery)
+	}
+	c := &accessLogCursor{}
+	if c.Timestamp, err = strconv.Atoi(ts); err != nil {
+		return nil, fmt.Errorf("%w: bad cursor: %v", ErrInvalidQuery, err)
+	}
+	if c.ID, err = strconv.ParseInt(id, 10, 64); err != nil {
+		return nil, fmt.Errorf("%w: bad cursor: %v", ErrInvalidQuery, err)
+	}
+	return c, nil
+}
+
+// normalize validates the query and fills in defaults, returning the
+// decoded cursor and the parsed IP prefix if any.
+func (q *AccessLogQuery) normalize() (*accessLogCursor, *netip.Prefix, error) {
+	if q.Limit <= 0 {
+		q.Limit = defaultAccessLogLimit
+	}
+	if q.Limit > maxAccessLogLimit {
+		q.Limit = maxAccessLogLimit
+	}
+	cursor, err := decodeAccessLogCursor(q.Cursor)
+	if err != nil {
+		return nil, nil, err
+	}
+	if q.IP == "" {
+		return cursor, nil, nil
+	}
+	prefix, err := parseIPFilter(q.IP)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cursor, &prefix, nil
+}
+
+// parseIPFilter accepts either a CIDR or a bare address, which is treated as
+// a single host prefix.
+func parseIPFilter(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("%w: bad ip filter %q: %v", ErrInvalidQuery, s, err)
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("%w: bad ip filter %q: %v", ErrInvalidQuery, s, err)
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// accessLogAddr pulls an address out of a stored ip column, which in older
+// rows may still carry a port or a whole X-Forwarded-For chain. It mirrors
+// the access_log_inet SQL function.
+func accessLogAddr(raw string) (netip.Addr, bool) {
+	host := strings.TrimSpace(strings.Split(raw, ",")[0])
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+// stripPort drops the port from a host:port remote address.
+func stripPort(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// scope limits q to the tenant ctx is scoped to, if any.
+func (q *AccessLogQuery) scope(ctx context.Context) {
+	if tenant, ok := tenantFrom(ctx); ok {
+		q.TenantID = tenant
+	}
+}
+
+// deletable checks q only uses the filters DeleteAccessLogs understands and
+// is bounded by a tag or a time, so a mistake can't empty the table.
+func (q *AccessLogQuery) deletable() error {
+	if q.IP != "" || q.UserAgent != "" || q.Country != "" || q.ASN != 0 || q.Cursor != "" || !q.Tags.empty() {
+		return fmt.Errorf("%w: only tag and time filters can be used to delete", ErrInvalidQuery)
+	}
+	if q.TagID == "" && q.Until == 0 {
+		return fmt.Errorf("%w: refusing to delete access logs without a tag or an upper time bound", ErrInvalidQuery)
+	}
+	return nil
+}
+
+// matches applies every filter except the cursor and Tags, for backends
+// that can't push them all down into a query.
+func (q *AccessLogQuery) matches(log *AccessLog, prefix *netip.Prefix) bool {
+	if q.TenantID != "" && log.TenantID != q.TenantID {
+		return false
+	}
+	if q.TagID != "" && log.TagID != q.TagID {
+		return false
+	}
+	if q.Severity != "" && log.Severity != q.Severity {
+		return false
+	}
+	if q.Kind != "" && log.Kind != q.Kind {
+		return false
+	}
+	for _, id := range q.ExcludeTagIDs {
+		if log.TagID == id {
+			return false
+		}
+	}
+	if q.Since != 0 && log.Timestamp < q.Since {
+		return false
+	}
+	if q.Until != 0 && log.Timestamp >= q.Until {
+		return false
+	}
+	if q.UserAgent != "" && !strings.Contains(strings.ToLower(log.UserAgent), strings.ToLower(q.UserAgent)) {
+		return false
+	}
+	if q.Country != "" && (log.Geo == nil || log.Geo.Country != q.Country) {
+		return false
+	}
+	if q.ASN != 0 && (log.Geo == nil || log.Geo.ASN != q.ASN) {
+		return false
+	}
+	if prefix != nil {
+		addr, ok := accessLogAddr(log.IP)
+		if !ok || !prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// after reports whether log sorts after the cursor in the query's order.
+func (q *AccessLogQuery) after(log *AccessLog, cursor *accessLogCursor) bool {
+	if cursor == nil {
+		return true
+	}
+	if q.Descending {
+		return log.Timestamp < cursor.Timestamp || (log.Timestamp == cursor.Timestamp && log.ID < cursor.ID)
+	}
+	return log.Timestamp > cursor.Timestamp || (log.Timestamp == cursor.Timestamp && log.ID > cursor.ID)
+}
+
+func (q *AccessLogQuery) sort(logs []*AccessLog) {
+	sort.Slice(logs, func(i, j int) bool {
+		a, b := logs[i], logs[j]
+		if a.Timestamp != b.Timestamp {
+			if q.Descending {
+				return a.Timestamp > b.Timestamp
+			}
+			return a.Timestamp < b.Timestamp
+		}
+		if q.Descending {
+			return a.ID > b.ID
+		}
+		return a.ID < b.ID
+	})
+}
+
+// page trims logs, which must hold up to Limit+1 entries in order, to one
+// page and sets the cursor for the next one.
+func (q *AccessLogQuery) page(logs []*AccessLog) *AccessLogPage {
+	page := &AccessLogPage{Logs: logs}
+	if len(logs) > q.Limit {
+		page.Logs = logs[:q.Limit]
+		page.NextCursor = encodeAccessLogCursor(page.Logs[q.Limit-1])
+	}
+	if page.Logs == nil {
+		page.Logs = []*AccessLog{}
+	}
+	return page
+}
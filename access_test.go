@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestAccessLogCursor(t *testing.T) {
+	cursor := encodeAccessLogCursor(&AccessLog{Timestamp: 1700000000, ID: 42})
+	got, err := decodeAccessLogCursor(cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Timestamp != 1700000000 || got.ID != 42 {
+		t.Errorf("got %+v", got)
+	}
+	if got, err := decodeAccessLogCursor(""); got != nil || err != nil {
+		t.Errorf("empty cursor: got %v %v", got, err)
+	}
+	for _, bad := range []string{"!!", "MTIz", "YTpi", "MTp4"} {
+		if _, err := decodeAccessLogCursor(bad); !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("%q: got %v", bad, err)
+		}
+	}
+}
+
+func TestAccessLogQueryNormalize(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		q         AccessLogQuery
+		wantLimit int
+		wantErr   bool
+	}{
+		{"default limit", AccessLogQuery{}, defaultAccessLogLimit, false},
+		{"negative limit", AccessLogQuery{Limit: -3}, defaultAccessLogLimit, false},
+		{"capped limit", AccessLogQuery{Limit: maxAccessLogLimit + 1}, maxAccessLogLimit, false},
+		{"host", AccessLogQuery{Limit: 5, IP: "203.0.113.9"}, 5, false},
+		{"cidr", AccessLogQuery{IP: "2001:db8::/32"}, defaultAccessLogLimit, false},
+		{"bad ip", AccessLogQuery{IP: "nope"}, 0, true},
+		{"bad cidr", AccessLogQuery{IP: "10.0.0.0/33"}, 0, true},
+		{"bad cursor", AccessLogQuery{Cursor: "!!"}, 0, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, err := tc.q.normalize()
+			if tc.wantErr {
+				if !errors.Is(err, ErrInvalidQuery) {
+					t.Errorf("got %v, want ErrInvalidQuery", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.q.Limit != tc.wantLimit {
+				t.Errorf("limit %d, want %d", tc.q.Limit, tc.wantLimit)
+			}
+		})
+	}
+}
+
+func TestAccessLogAddr(t *testing.T) {
+	for raw, want := range map[string]string{
+		"203.0.113.1":            "203.0.113.1",
+		"203.0.113.1:4431":       "203.0.113.1",
+		"[2001:db8::1]:443":      "2001:db8::1",
+		"198.51.100.7, 10.0.0.1": "198.51.100.7",
+		"::ffff:192.0.2.1":       "192.0.2.1",
+		"garbage":                "",
+		"":                       "",
+	} {
+		got := ""
+		if addr, ok := accessLogAddr(raw); ok {
+			got = addr.String()
+		}
+		if got != want {
+			t.Errorf("%q: got %q, want %q", raw, got, want)
+		}
+	}
+}
+
+// TestAccessLogPaging walks a set with equal timestamps one row at a time
+// in both orders, the id has to break the ties.
+func TestAccessLogPaging(t *testing.T) {
+	db := NewMemoryDB()
+	ctx := context.Background()
+	for _, ts := range []int{10, 20, 20, 20, 30} {
+		if err := db.AddAccessLog(ctx, &AccessLog{IP: "203.0.113.1", Timestamp: ts, TagID: testTagID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, desc := range []bool{false, true} {
+		var ids []int64
+		q := AccessLogQuery{Limit: 2, Descending: desc}
+		for pages := 0; ; pages++ {
+			if pages > 5 {
+				t.Fatal("paging doesn't end")
+			}
+			page, err := db.QueryAccessLogs(ctx, q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, log := range page.Logs {
+				ids = append(ids, log.ID)
+			}
+			if page.NextCursor == "" {
+				break
+			}
+			q.Cursor = page.NextCursor
+		}
+		want := []int64{1, 2, 3, 4, 5}
+		if desc {
+			want = []int64{5, 4, 3, 2, 1}
+		}
+		if !slices.Equal(ids, want) {
+			t.Errorf("descending %v: got %v, want %v", desc, ids, want)
+		}
+	}
+}
+
+func TestAccessQueryHandler(t *testing.T) {
+	app := newTestApp(t)
+	ctx := context.Background()
+	for _, ip := range []string{"203.0.113.1", "198.51.100.1"} {
+		if err := app.DB.AddAccessLog(ctx, &AccessLog{IP: ip, Timestamp: 100, TagID: testTagID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range []struct {
+		query string
+		code  int
+		n     int
+	}{
+		{"", http.StatusOK, 2},
+		{"?ip=203.0.113.0/24", http.StatusOK, 1},
+		{"?limit=1&order=desc", http.StatusOK, 1},
+		{"?ip=bogus", http.StatusBadRequest, 0},
+		{"?order=sideways", http.StatusBadRequest, 0},
+		{"?limit=x", http.StatusBadRequest, 0},
+		{"?cursor=!!", http.StatusBadRequest, 0},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			w := serve(app, httptest.NewRequest(http.MethodGet, "/access"+tc.query, nil))
+			if w.Code != tc.code {
+				t.Fatalf("got %d %s, want %d", w.Code, w.Body, tc.code)
+			}
+			if tc.code != http.StatusOK {
+				return
+			}
+			var page AccessLogPage
+			if err := json.NewDecoder(w.Body).Decode(&page); err != nil {
+				t.Fatal(err)
+			}
+			if len(page.Logs) != tc.n {
+				t.Errorf("got %d logs, want %d", len(page.Logs), tc.n)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var (
+	accessQueueDepth  = expvar.NewInt("access_queue_depth")
+	accessDropped     = expvar.NewInt("access_logs_dropped")
+	accessFlushed     = expvar.NewInt("access_logs_flushed")
+	accessFlushErrors = expvar.NewInt("access_flush_errors")
+)
+
+// AccessWriter buffers hits in a bounded queue and writes them to the
+// database in batches, either every FlushEvery or once BatchSize records are
+// waiting, whichever comes first. Hits that arrive while the queue is full
+// are dropped and counted rather than stalling the beacon handler.
+type AccessWriter struct {
+	DB         Database
+	Logger     *zap.Logger
+	BatchSize  int
+	FlushEvery time.Duration
+	Timeout    time.Duration
+	queue      chan *AccessLog
+	stop       chan struct{}
+	done       chan struct{}
+	// memory is held while a batch is written, dropped lists tags whose
+	// hits are thrown away instead
+	memory  sync.Mutex
+	dropped map[string]bool
+}
+
+func NewAccessWriter(db Database, queueSize, batchSize int, flushEvery time.Duration) *AccessWriter {
+	return &AccessWriter{
+		DB:         db,
+		Logger:     zap.NewNop(),
+		BatchSize:  batchSize,
+		FlushEvery: flushEvery,
+		queue:      make(chan *AccessLog, queueSize),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+		dropped:    map[string]bool{},
+	}
+}
+
+// Drop discards every hit for tagIDs that is queued or still to come. A
+// batch being written when it is called finishes first, so once Drop
+// returns nothing more for those tags reaches the database.
+func (w *AccessWriter) Drop(tagIDs ...string) {
+	w.memory.Lock()
+	defer w.memory.Unlock()
+	for _, id := range tagIDs {
+		w.dropped[id] = true
+	}
+}
+
+// Enqueue hands a hit to the writer without blocking. It reports false when
+// the queue was full and the hit was dropped.
+func (w *AccessWriter) Enqueue(log *AccessLog) bool {
+	select {
+	case w.queue <- log:
+		accessQueueDepth.Add(1)
+		return true
+	default:
+		accessDropped.Add(1)
+		w.Logger.Warn("access log queue full, dropping hit", zap.String("tag_id", log.TagID))
+		return false
+	}
+}
+
+// Run flushes batches until Close is called, then drains whatever is left
+// in the queue.
+func (w *AccessWriter) Run() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.FlushEvery)
+	defer ticker.Stop()
+	batch := make([]*AccessLog, 0, w.BatchSize)
+	for {
+		select {
+		case log := <-w.queue:
+			batch = append(batch, log)
+			if len(batch) >= w.BatchSize {
+				batch = w.flush(batch)
+			}
+		case <-ticker.C:
+			batch = w.flush(batch)
+		case <-w.stop:
+			for {
+				select {
+				case log := <-w.queue:
+					batch = append(batch, log)
+					if len(batch) >= w.BatchSize {
+						batch = w.flush(batch)
+					}
+				default:
+					w.flush(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+// Close stops the writer and waits for the queue to drain.
+func (w *AccessWriter) Close() {
+	close(w.stop)
+	<-w.done
+}
+
+// context bounds one database write by Timeout, if set.
+func (w *AccessWriter) context() (context.Context, context.CancelFunc) {
+	if w.Timeout > 0 {
+		return context.WithTimeout(context.Background(), w.Timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// flush writes batch in one go. If that fails the hits are retried one at
+// a time, so a single bad record only costs itself and not the batch.
+func (w *AccessWriter) flush(batch []*AccessLog) []*AccessLog {
+	if len(batch) == 0 {
+		return batch
+	}
+	accessQueueDepth.Add(-int64(len(batch)))
+	w.memory.Lock()
+	defer w.memory.Unlock()
+	logs := make([]*AccessLog, 0, len(batch))
+	for _, log := range batch {
+		if !w.dropped[log.TagID] {
+			logs = append(logs, log)
+		}
+	}
+	if len(logs) == 0 {
+		return batch[:0]
+	}
+	ctx, cancel := w.context()
+	err := w.DB.AddAccessLogs(ctx, logs)
+	cancel()
+	if err == nil {
+		accessFlushed.Add(int64(len(logs)))
+		return batch[:0]
+	}
+	accessFlushErrors.Add(1)
+	w.Logger.Warn("error flushing access logs, writing them one by one", zap.Int("count", len(logs)), zap.Error(err))
+	for _, log := range logs {
+		ctx, cancel := w.context()
+		err := w.DB.AddAccessLog(ctx, log)
+		cancel()
+		if err != nil {
+			accessDropped.Add(1)
+			w.Logger.Error("error writing access log", zap.String("tag_id", log.TagID), zap.Error(err))
+			continue
+		}
+		accessFlushed.Add(1)
+	}
+	return batch[:0]
+}
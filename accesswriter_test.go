@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// flakyDB fails every batch insert and single inserts of hits from bad.
+type flakyDB struct {
+	*MemoryDB
+	bad string
+}
+
+func (f *flakyDB) AddAccessLogs(ctx context.Context, logs []*AccessLog) error {
+	return errors.New("copy failed")
+}
+
+func (f *flakyDB) AddAccessLog(ctx context.Context, log *AccessLog) error {
+	if log.IP == f.bad {
+		return errors.New("bad record")
+	}
+	return f.MemoryDB.AddAccessLog(ctx, log)
+}
+
+func countAccessLogs(t *testing.T, db Database) int {
+	t.Helper()
+	page, err := db.QueryAccessLogs(context.Background(), AccessLogQuery{Limit: maxAccessLogLimit})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(page.Logs)
+}
+
+func TestAccessWriterFlushesFullBatch(t *testing.T) {
+	db := NewMemoryDB()
+	w := NewAccessWriter(db, 10, 2, time.Hour)
+	go w.Run()
+	defer w.Close()
+	w.Enqueue(&AccessLog{IP: "203.0.113.1", TagID: testTagID})
+	w.Enqueue(&AccessLog{IP: "203.0.113.2", TagID: testTagID})
+	deadline := time.Now().Add(2 * time.Second)
+	for countAccessLogs(t, db) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("full batch wasn't flushed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestAccessWriterFlushesOnTick(t *testing.T) {
+	db := NewMemoryDB()
+	w := NewAccessWriter(db, 10, 100, 10*time.Millisecond)
+	go w.Run()
+	defer w.Close()
+	w.Enqueue(&AccessLog{IP: "203.0.113.1", TagID: testTagID})
+	deadline := time.Now().Add(2 * time.Second)
+	for countAccessLogs(t, db) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("ticker didn't flush")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestAccessWriterDrainsOnClose(t *testing.T) {
+	db := NewMemoryDB()
+	w := NewAccessWriter(db, 10, 3, time.Hour)
+	for i := 0; i < 7; i++ {
+		if !w.Enqueue(&AccessLog{IP: "203.0.113.1", TagID: testTagID}) {
+			t.Fatal("enqueue failed with room in the queue")
+		}
+	}
+	go w.Run()
+	w.Close()
+	if n := countAccessLogs(t, db); n != 7 {
+		t.Errorf("got %d logs after close, want 7", n)
+	}
+}
+
+func TestAccessWriterDropsWhenFull(t *testing.T) {
+	w := NewAccessWriter(NewMemoryDB(), 1, 10, time.Hour)
+	dropped := accessDropped.Value()
+	if !w.Enqueue(&AccessLog{TagID: testTagID}) {
+		t.Fatal("first enqueue failed")
+	}
+	if w.Enqueue(&AccessLog{TagID: testTagID}) {
+		t.Fatal("enqueue into a full queue succeeded")
+	}
+	if got := accessDropped.Value() - dropped; got != 1 {
+		t.Errorf("dropped counter moved by %d, want 1", got)
+	}
+}
+
+func TestAccessWriterFallsBackToSingleRows(t *testing.T) {
+	db := &flakyDB{MemoryDB: NewMemoryDB(), bad: "bad"}
+	w := NewAccessWriter(db, 10, 10, time.Hour)
+	dropped := accessDropped.Value()
+	for _, ip := range []string{"203.0.113.1", "bad", "203.0.113.3"} {
+		w.Enqueue(&AccessLog{IP: ip, TagID: testTagID})
+	}
+	go w.Run()
+	w.Close()
+	if n := countAccessLogs(t, db); n != 2 {
+		t.Errorf("got %d logs, want the 2 good ones", n)
+	}
+	if got := accessDropped.Value() - dropped; got != 1 {
+		t.Errorf("dropped counter moved by %d, want 1", got)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	app := newTestApp(t)
+	w := serve(app, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d %s", w.Code, w.Body)
+	}
+	var vars map[string]json.RawMessage
+	if err := json.NewDecoder(w.Body).Decode(&vars); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := vars["cmdline"]; ok {
+		t.Error("metrics publish the command line")
+	}
+	if _, ok := vars["access_logs_flushed"]; !ok {
+		t.Error("metrics are missing access_logs_flushed")
+	}
+
+	app.AnonymousTenant = ""
+	if w := serve(app, httptest.NewRequest(http.MethodGet, "/metrics", nil)); w.Code != http.StatusUnauthorized {
+		t.Errorf("without a key got %d, want 401", w.Code)
+	}
+}
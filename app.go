@@ -5,22 +5,35 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"os/exec"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/quic-go/quic-go"
 	"go.uber.org/zap"
 )
 
 var (
-	dbLocation = flag.String("db", "user=rxlx password=FOO host=192.168.86.120 dbname=tags", "Database location")
+	dbTimeout       = flag.Duration("db-timeout", 5*time.Second, "deadline for a single database operation")
+	tagCacheMax     = flag.Int("tag-cache-size", 10000, "maximum number of tags kept in memory")
+	tagCacheTTL     = flag.Duration("tag-cache-ttl", 10*time.Minute, "how long a cached tag is trusted before it is reloaded, 0 to never expire")
+	dbLocation      = flag.String("db", "user=rxlx password=FOO host=192.168.86.120 dbname=tags", "Database location (postgres DSN, sqlite://path or memory://)")
+	accessQueueSize = flag.Int("access-queue", 10000, "number of hits buffered before new ones are dropped")
+	accessBatchSize = flag.Int("access-batch", 500, "flush buffered hits once this many are waiting")
+	retentionEvery  = flag.Duration("retention-every", time.Hour, "how often retention policies are applied, 0 to never")
+	outOfWindow     = flag.String("out-of-window", OutOfWindowLow, "what to do with hits outside a tag's armed window: low records them as low severity, ignore drops them")
+	expirySweep     = flag.Duration("expiry-sweep", time.Minute, "how often tags past expires_at are marked expired, 0 to never")
+	removeExpired   = flag.Bool("remove-expired-files", false, "delete a tag's file from ./static once it expires")
+	anonTenant      = flag.String("anonymous-tenant", "", "tenant for API requests without a key, empty to require one, set to default for the old keyless access")
 )
 
 const (
@@ -28,54 +41,94 @@ const (
 )
 
 type Application struct {
-	Logger               *zap.Logger        `json:"-"`
-	TLSConfig            *tls.Config        `json:"-"`
-	UDPListener          *quic.Listener     `json:"-"`
-	Memory               *sync.RWMutex      `json:"-"`
-	Gateway              *http.ServeMux     `json:"-"`
-	FQDN                 string             `json:"fqdn"`
-	AccessFlushFrequency int                `json:"access_flush_frequency"`
-	DB                   Database           `json:"-"`
-	Tags                 map[string]*Tag    `json:"tags"`
-	Clients              map[string]*Client `json:"-"`
-	AccessLogs           []AccessLog        `json:"access_logs"`
-	Broadcast            chan []byte        `json:"-"`
+	Logger               *zap.Logger    `json:"-"`
+	TLSConfig            *tls.Config    `json:"-"`
+	UDPListener          *quic.Listener `json:"-"`
+	Memory               *sync.RWMutex  `json:"-"`
+	Gateway              *http.ServeMux `json:"-"`
+	FQDN                 string         `json:"fqdn"`
+	AccessFlushFrequency int            `json:"access_flush_frequency"`
+	DB                   Database       `json:"-"`
+	AccessWriter         *AccessWriter  `json:"-"`
+	DBTimeout            time.Duration  `json:"-"`
+	PseudonymKey         []byte         `json:"-"`
+	OutOfWindow          string         `json:"out_of_window"`
+	AnonymousTenant      string         `json:"anonymous_tenant"`
+	// ClassificationSeverity maps a tag classification to the severity of
+	// its in-window hits.
+	ClassificationSeverity map[string]string `json:"classification_severity"`
+	// AlertKinds are the hit kinds that alert, see -alert-kinds.
+	AlertKinds map[string]bool `json:"alert_kinds"`
+	Classifier *HitClassifier  `json:"-"`
+	// GeoIP is nil unless -geoip-city or -geoip-asn is set.
+	GeoIP *GeoIP `json:"-"`
+	// TrustedProxies may speak for the client, see clientIP.
+	TrustedProxies []netip.Prefix `json:"-"`
+	stop           context.CancelFunc
+	Tags           *TagCache          `json:"-"`
+	Clients        map[string]*Client `json:"-"`
+	Broadcast      chan []byte        `json:"-"`
 }
 
 type AccessLog struct {
+	ID        int64  `json:"id"`
 	IP        string `json:"ip"`
 	UserAgent string `json:"user_agent"`
 	Timestamp int    `json:"timestamp"`
 	TagID     string `json:"tag_id"`
+	Severity  string `json:"severity"`
+	TenantID  string `json:"tenant_id,omitempty"`
+	// Kind is what HitClassifier made of the hit, human or some machine
+	Kind string   `json:"kind"`
+	Geo  *GeoInfo `json:"geo,omitempty"`
+	// ForwardedFor and Forwarded are the headers as they came in, IP is
+	// what clientIP made of them.
+	ForwardedFor string `json:"forwarded_for,omitempty"`
+	Forwarded    string `json:"forwarded,omitempty"`
+	// Fields holds what a PDF form submission sent along, see readSubmission
+	Fields map[string]string `json:"fields,omitempty"`
 }
 
 func NewApplication(fqdn string, db Database) *Application {
 	app := &Application{
-		Gateway: http.NewServeMux(),
-		FQDN:    fqdn,
-		Tags:    map[string]*Tag{},
-		DB:      db,
-		Memory:  &sync.RWMutex{},
-	}
-	tags, err := db.GetTags()
-	if err != nil {
-		log.Println("error getting tags", err)
-	}
-	for _, tag := range tags {
-		app.Tags[tag.ID] = tag
-		if tag.URL == "" {
-			tag.URL = fmt.Sprintf("%s/%s", app.FQDN, tag.ID)
-		}
-		// fmt.Println(tag.URL, tag.ID)
-		app.Gateway.HandleFunc(fmt.Sprintf("/%s", tag.ID), app.tagHandler(tag))
+		Gateway:              http.NewServeMux(),
+		FQDN:                 fqdn,
+		Tags:                 NewTagCache(*tagCacheMax, *tagCacheTTL),
+		DB:                   db,
+		Memory:               &sync.RWMutex{},
+		AccessFlushFrequency: 5,
+		DBTimeout:            *dbTimeout,
+		OutOfWindow:          *outOfWindow,
+		AnonymousTenant:      *anonTenant,
+		AlertKinds:           map[string]bool{HitHuman: true},
+		TrustedProxies:       []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8"), netip.MustParsePrefix("::1/128")},
 	}
+	// the built-in rules can't fail to load, main swaps in the configured
+	// files
+	app.Classifier, _ = NewHitClassifier("", "")
 	// app.Gateway.HandleFunc("/tag", app.TagHandler)
-	app.Gateway.HandleFunc("/tag-exists", app.TagExistsHandler)
-	app.Gateway.HandleFunc("/get-tag", app.GetTagHandler)
-	app.Gateway.HandleFunc("/tag", app.AddTagHandler)
-	app.Gateway.HandleFunc("/access", app.AccessHandler)
-	app.Gateway.HandleFunc("/upload", app.UploadFileHandler)
-	app.Gateway.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("./static"))))
+	// the API only ever sees the tenant its key belongs to
+	app.Gateway.HandleFunc("/tag-exists", app.requireTenant(app.TagExistsHandler))
+	app.Gateway.HandleFunc("/get-tag", app.requireTenant(app.GetTagHandler))
+	app.Gateway.HandleFunc("/tag", app.requireTenant(app.AddTagHandler))
+	app.Gateway.HandleFunc("/delete-tag", app.requireTenant(app.DeleteTagHandler))
+	app.Gateway.HandleFunc("/tag-history", app.requireTenant(app.TagHistoryHandler))
+	app.Gateway.HandleFunc("/tags-by-user", app.requireTenant(app.TagsByUserHandler))
+	app.Gateway.HandleFunc("/tags", app.requireTenant(app.TagsHandler))
+	app.Gateway.HandleFunc("/tag-schedule", app.requireTenant(app.TagScheduleHandler))
+	app.Gateway.HandleFunc("/tag-state", app.requireTenant(app.TagStateHandler))
+	app.Gateway.HandleFunc("/tag-transitions", app.requireTenant(app.TagTransitionsHandler))
+	app.Gateway.HandleFunc("/campaigns", app.requireTenant(app.CampaignsHandler))
+	app.Gateway.HandleFunc("/campaign-activity", app.requireTenant(app.CampaignActivityHandler))
+	app.Gateway.HandleFunc("/erase-user", app.requireTenant(app.EraseUserHandler))
+	app.Gateway.HandleFunc("/retention", app.requireTenant(app.RetentionHandler))
+	app.Gateway.HandleFunc("/access", app.requireTenant(app.AccessQueryHandler))
+	app.Gateway.HandleFunc("/upload", app.requireTenant(app.UploadFileHandler))
+	app.Gateway.HandleFunc("/static/", app.requireTenant(app.StaticHandler))
+	app.Gateway.HandleFunc("/metrics", app.requireTenant(app.MetricsHandler))
+	// anything not matched above is treated as a beacon hit. Tag IDs are
+	// global, the hit lands in whichever tenant owns the tag
+	app.Gateway.HandleFunc("/", app.tagHandler)
 	return app
 }
 
@@ -194,70 +247,218 @@ func createTLSConfig() *tls.Config {
 	}
 }
 
-func (a *Application) AddTag(tag *Tag) {
+// AddTag creates tag or re-tags an existing one. When tag.Version is set it
+// is the version the caller last saw, and the write fails with a
+// ConflictError if someone else got there first. New tags start armed
+// unless tag.State, or the defaults of their campaign, say draft; a re-tag
+// leaves the state alone and is refused for retired tags. Metadata on a
+// re-tag is merged into what the tag already has.
+func (a *Application) AddTag(ctx context.Context, tag *Tag) error {
+	if err := tag.TagMetadata.validate(); err != nil {
+		return err
+	}
+	if err := validateBeaconResponse(tag.Response, tag.Decoy); err != nil {
+		return err
+	}
+	ctx, cancel := a.dbContext(ctx)
+	defer cancel()
 	a.Logger.Info("Adding tag", zap.String("tag_id", tag.ID), zap.String("tag_hash", tag.Hash))
 	a.Memory.Lock()
 	defer a.Memory.Unlock()
-	myTag, ok := a.Tags[tag.ID]
+	event := TagHistoryItem{ClientID: tag.ClientID, Hash: tag.Hash, Created: tag.Created}
+	myTag, ok := a.Tags.Get(tag.ID)
+	// another tenant's tag is as good as missing, the scoped lookup below
+	// won't find it and InsertTag then refuses the ID
+	ok = ok && inTenant(ctx, myTag.TenantID)
 	// not in memory
 	if !ok {
-		tagFromDB, err := a.DB.GetTag(tag.ID)
-		// not in db, this tag is new and its safe to add a new route
-		if err != nil {
-			a.Logger.Info("tag could not be found, creating new tag", zap.String("tag_id", tag.ID), zap.Error(err))
-			tag.URL = fmt.Sprintf("%s/%s", a.FQDN, tag.ID)
-			a.Gateway.HandleFunc(fmt.Sprintf("/%s", tag.ID), a.tagHandler(tag))
+		tagFromDB, err := a.DB.GetTag(ctx, tag.ID)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
 		}
-		// err is nil, tag is in db
-		if tagFromDB != nil {
-			tag.History = append(tag.History, tagFromDB.History...)
+		myTag = tagFromDB
+	}
+	// not in db, this tag is new
+	if myTag == nil {
+		a.Logger.Info("tag could not be found, creating new tag", zap.String("tag_id", tag.ID))
+		if tag.CampaignID != 0 {
+			campaign, err := a.campaignFor(ctx, tag.CampaignID)
+			if err != nil {
+				return err
+			}
+			campaign.applyDefaults(tag)
+			if err := validateSchedule(tag.ArmAt, tag.ExpiresAt); err != nil {
+				return err
+			}
 		}
+		tag.State = tag.lifecycle()
+		tag.TenantID = tenantFor(ctx, tag.TenantID)
+		if err := validInitialState(tag.State); err != nil {
+			return err
+		}
+		tag.URL = fmt.Sprintf("%s/%s", a.FQDN, tag.ID)
+		// history comes from the store, not the request
+		tag.History = []TagHistoryItem{}
 		tag.AddHistory(tag.ClientID, tag.Hash, tag.Created)
-		// store in memory
-		a.Tags[tag.ID] = tag
-		if err := a.DB.InsertTag(tag); err != nil {
-			fmt.Println("error inserting tag", err)
+		created := TagTransition{To: tag.State, Actor: actorFrom(ctx), Reason: "created", Created: tag.Created}
+		if err := a.DB.InsertTag(ctx, tag, TagChange{History: &event, Transition: &created}); err != nil {
+			return err
 		}
-		return
+		a.Tags.Set(tag)
+		return nil
 	}
-	myTag.AddHistory(tag.ClientID, tag.Hash, tag.Created)
-	myTag.Hash = tag.Hash
-	myTag.Created = tag.Created
-	if myTag.URL == "" {
-		myTag.URL = fmt.Sprintf("%s/%s", a.FQDN, tag.ID)
+	if myTag.lifecycle() == TagRetired {
+		return fmt.Errorf("%w: tag %s is retired", ErrConflict, tag.ID)
+	}
+	updated := myTag.clone()
+	if tag.Version != 0 {
+		updated.Version = tag.Version
+	}
+	updated.AddHistory(tag.ClientID, tag.Hash, tag.Created)
+	updated.ClientID = tag.ClientID
+	updated.Hash = tag.Hash
+	updated.Created = tag.Created
+	if tag.FilePath != "" {
+		updated.FilePath = tag.FilePath
 	}
-	// a.Gateway.HandleFunc(fmt.Sprintf("/%s", myTag.URL), a.tagHandler(myTag)) // this should exist already
-	if err := a.DB.InsertTag(myTag); err != nil {
-		fmt.Println("error inserting tag", err)
+	updated.merge(tag.TagMetadata)
+	if tag.Response != "" {
+		updated.Response, updated.Decoy = tag.Response, tag.Decoy
 	}
+	// moving a tag into a campaign doesn't pull in its defaults, those are
+	// only for new tags
+	if tag.CampaignID != 0 && tag.CampaignID != updated.CampaignID {
+		if _, err := a.campaignFor(ctx, tag.CampaignID); err != nil {
+			return err
+		}
+		updated.CampaignID = tag.CampaignID
+	}
+	// a re-tag only moves the bounds it sets, use /tag-schedule to clear
+	// them
+	if tag.ArmAt != 0 || tag.ExpiresAt != 0 {
+		armAt, expiresAt := updated.ArmAt, updated.ExpiresAt
+		if tag.ArmAt != 0 {
+			armAt = tag.ArmAt
+		}
+		if tag.ExpiresAt != 0 {
+			expiresAt = tag.ExpiresAt
+		}
+		if err := validateSchedule(armAt, expiresAt); err != nil {
+			return err
+		}
+		updated.setSchedule(armAt, expiresAt, time.Now())
+	}
+	if updated.URL == "" {
+		updated.URL = fmt.Sprintf("%s/%s", a.FQDN, tag.ID)
+	}
+	if err := a.DB.UpdateTag(ctx, updated, TagChange{History: &event}); err != nil {
+		// whatever we had cached is stale now
+		a.Tags.Remove(tag.ID)
+		return err
+	}
+	a.Tags.Set(updated)
+	tag.URL, tag.Version = updated.URL, updated.Version
+	return nil
 }
 
-func (a *Application) GetTag(id string) *Tag {
-	a.Memory.RLock()
-	defer a.Memory.RUnlock()
-	myTag, ok := a.Tags[id]
-	if !ok {
-		myTag, err := a.DB.GetTag(id)
-		if err != nil {
-			fmt.Println("error getting tag", err)
-			return nil
-		}
-		if myTag != nil {
-			a.Tags[id] = myTag
+// dbContext bounds a database call by DBTimeout on top of whatever
+// deadline or cancellation parent already carries.
+func (a *Application) dbContext(parent context.Context) (context.Context, context.CancelFunc) {
+	if a.DBTimeout <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, a.DBTimeout)
+}
+
+// GetTag reads through the tag cache, loading from the database on a miss.
+// A missing tag, or one of another tenant than ctx is scoped to, is
+// ErrNotFound, a slow database surfaces as the context error.
+func (a *Application) GetTag(ctx context.Context, id string) (*Tag, error) {
+	if myTag, ok := a.Tags.Get(id); ok {
+		if !inTenant(ctx, myTag.TenantID) {
+			return nil, ErrNotFound
 		}
-		return myTag
+		return myTag, nil
+	}
+	ctx, cancel := a.dbContext(ctx)
+	defer cancel()
+	myTag, err := a.DB.GetTag(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if myTag.URL == "" {
+		myTag.URL = fmt.Sprintf("%s/%s", a.FQDN, myTag.ID)
+	}
+	a.Tags.Set(myTag)
+	return myTag, nil
+}
+
+// DeleteTag removes a tag from memory and the database. The beacon stops
+// answering for it immediately.
+func (a *Application) DeleteTag(ctx context.Context, id string) error {
+	ctx, cancel := a.dbContext(ctx)
+	defer cancel()
+	if err := a.DB.DeleteTag(ctx, id); err != nil {
+		return err
+	}
+	a.Tags.Remove(id)
+	return nil
+}
+
+// Start launches the background workers. Call it once Logger and
+// AccessFlushFrequency are set.
+func (a *Application) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	a.stop = cancel
+	a.AccessWriter = NewAccessWriter(a.DB, *accessQueueSize, *accessBatchSize, time.Duration(a.AccessFlushFrequency)*time.Second)
+	a.AccessWriter.Logger = a.Logger
+	a.AccessWriter.Timeout = a.DBTimeout
+	go a.AccessWriter.Run()
+	if src, ok := a.DB.(TagEventSource); ok {
+		go src.ListenTagEvents(ctx, a.handleTagEvent, a.resyncTags)
+	}
+	if *retentionEvery > 0 {
+		go a.RunRetention(ctx, *retentionEvery)
+	}
+	if *expirySweep > 0 {
+		go a.RunExpirySweeper(ctx, *expirySweep, *removeExpired)
+	}
+}
+
+// handleTagEvent drops our copy of a tag another instance changed, the next
+// lookup reloads it from the database.
+func (a *Application) handleTagEvent(event TagEvent) {
+	a.Logger.Debug("tag changed elsewhere", zap.String("op", event.Op), zap.String("tag_id", event.ID), zap.Int("version", event.Version))
+	a.Tags.Remove(event.ID)
+}
+
+// resyncTags forgets every cached tag after events may have been missed.
+func (a *Application) resyncTags() {
+	a.Logger.Info("resyncing tag cache")
+	a.Tags.Purge()
+}
+
+// Stop ends the background workers and drains buffered hits to the
+// database.
+func (a *Application) Stop() {
+	if a.stop != nil {
+		a.stop()
+	}
+	if a.AccessWriter != nil {
+		a.AccessWriter.Close()
 	}
-	return myTag
 }
 
 func (a *Application) AddAccess(access *AccessLog) {
-	a.Memory.Lock()
-	defer a.Memory.Unlock()
-	a.AccessLogs = append(a.AccessLogs, *access)
-	err := a.DB.AddAccessLog(access)
-	if err != nil {
-		fmt.Println("error adding access log", err)
+	if a.AccessWriter == nil {
+		ctx, cancel := a.dbContext(context.Background())
+		defer cancel()
+		if err := a.DB.AddAccessLog(ctx, access); err != nil {
+			fmt.Println("error adding access log", err)
+		}
+		return
 	}
+	a.AccessWriter.Enqueue(access)
 }
 
 func (a *Application) handleSession(session quic.Connection) {
@@ -0,0 +1,836 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// backupFormatVersion is bumped whenever the archive layout changes in a way
+// older restores can't read. 2 added transitions, 3 campaigns, 4 tenants
+// and 5 retention policies, API keys and sealed values.
+const backupFormatVersion = 5
+
+const (
+	backupManifestName   = "manifest.json"
+	backupTenantsName    = "tenants.jsonl"
+	backupCampaignsName  = "campaigns.jsonl"
+	backupTagsName       = "tags.jsonl"
+	backupHistoryName    = "history.jsonl"
+	backupTransitionName = "transitions.jsonl"
+	backupPoliciesName   = "retention_policies.jsonl"
+	backupAPIKeysName    = "api_keys.jsonl"
+	backupAccessLogsName = "access_logs.jsonl"
+	backupStaticPrefix   = "static/"
+)
+
+// backupRecords are the database entries of an archive, in the order they
+// are written. Older archives lack the entries of whatever their version
+// came before, see backupFormatVersion.
+var backupRecords = []string{backupTenantsName, backupAPIKeysName, backupCampaignsName, backupTagsName, backupHistoryName, backupTransitionName, backupPoliciesName, backupAccessLogsName}
+
+// Snapshotter is implemented by backends that can hand out a consistent,
+// read-only view of themselves. fn must only read through db.
+type Snapshotter interface {
+	Snapshot(ctx context.Context, fn func(db Database) error) error
+}
+
+// BackupManifest is the last entry of a backup archive. It lists the
+// sha256 of every other entry so a restore can refuse a damaged archive.
+// Encrypted archives hold the sealed values EncryptedDB stored, they can
+// only be restored with the same keyring.
+type BackupManifest struct {
+	Format    string            `json:"format"`
+	Version   int               `json:"version"`
+	Created   int64             `json:"created"`
+	Encrypted bool              `json:"encrypted,omitempty"`
+	Counts    map[string]int    `json:"counts"`
+	Checksums map[string]string `json:"checksums"`
+}
+
+type backupHistoryItem struct {
+	TagID string `json:"tag_id"`
+	TagHistoryItem
+}
+
+// backupTag keeps the blind index of a sealed username, which Tag never
+// serializes.
+type backupTag struct {
+	Tag
+	UsernameIndex string `json:"username_index,omitempty"`
+}
+
+// backupAPIKey keeps the hash, the key itself was never stored.
+type backupAPIKey struct {
+	APIKey
+	Hash string `json:"hash"`
+}
+
+type backupWriter struct {
+	tw       *tar.Writer
+	manifest *BackupManifest
+}
+
+// add writes one archive entry. Content is spooled to a temp file first
+// since tar needs the size up front.
+func (b *backupWriter) add(name string, fill func(w io.Writer) (int, error)) error {
+	tmp, err := os.CreateTemp("", "thelp-backup-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	h := sha256.New()
+	bw := bufio.NewWriter(io.MultiWriter(tmp, h))
+	count, err := fill(bw)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %v", name, err)
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := b.tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0o644,
+		Size:    size,
+		ModTime: time.Now(),
+	}); err != nil {
+		return err
+	}
+	if _, err := io.Copy(b.tw, tmp); err != nil {
+		return err
+	}
+	b.manifest.Checksums[name] = hex.EncodeToString(h.Sum(nil))
+	b.manifest.Counts[name] = count
+	return nil
+}
+
+// Backup writes tenants, API keys, campaigns, tags, their full history and
+// state transitions, retention policies, every access log and the
+// instrumented files under staticDir to a gzipped tar at out. Records are
+// read from one snapshot where the backend has them. Behind an EncryptedDB
+// the sealed values are written as stored, never decrypted.
+func Backup(db Database, out, staticDir string, timeout time.Duration) (*BackupManifest, error) {
+	encrypted := false
+	if e, ok := db.(*EncryptedDB); ok {
+		db, encrypted = e.Database, true
+	}
+	f, err := os.Create(out)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	b := &backupWriter{
+		tw: tar.NewWriter(gz),
+		manifest: &BackupManifest{
+			Format:    "thelp-backup",
+			Version:   backupFormatVersion,
+			Created:   time.Now().Unix(),
+			Encrypted: encrypted,
+			Counts:    map[string]int{},
+			Checksums: map[string]string{},
+		},
+	}
+	call := func() (context.Context, context.CancelFunc) {
+		return context.WithTimeout(context.Background(), timeout)
+	}
+	if s, ok := db.(Snapshotter); ok {
+		err = s.Snapshot(context.Background(), func(snap Database) error {
+			return b.addRecords(snap, call)
+		})
+	} else {
+		err = b.addRecords(db, call)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = filepath.WalkDir(staticDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) && p == staticDir {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(staticDir, p)
+		if err != nil {
+			return err
+		}
+		return b.add(backupStaticPrefix+filepath.ToSlash(rel), func(w io.Writer) (int, error) {
+			src, err := os.Open(p)
+			if err != nil {
+				return 0, err
+			}
+			defer src.Close()
+			_, err = io.Copy(w, src)
+			return 1, err
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, err := json.MarshalIndent(b.manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := b.tw.WriteHeader(&tar.Header{
+		Name:    backupManifestName,
+		Mode:    0o644,
+		Size:    int64(len(manifest)),
+		ModTime: time.Now(),
+	}); err != nil {
+		return nil, err
+	}
+	if _, err := b.tw.Write(manifest); err != nil {
+		return nil, err
+	}
+	if err := b.tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return b.manifest, f.Close()
+}
+
+// addRecords writes the database entries of the archive, everything but
+// the static files.
+func (b *backupWriter) addRecords(db Database, call func() (context.Context, context.CancelFunc)) error {
+	ctx, cancel := call()
+	tenants, err := db.GetTenants(ctx)
+	cancel()
+	if err != nil {
+		return err
+	}
+	err = b.add(backupTenantsName, func(w io.Writer) (int, error) {
+		enc := json.NewEncoder(w)
+		for _, t := range tenants {
+			if err := enc.Encode(t); err != nil {
+				return 0, err
+			}
+		}
+		return len(tenants), nil
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel = call()
+	keys, err := db.GetAPIKeys(ctx)
+	cancel()
+	if err != nil {
+		return err
+	}
+	err = b.add(backupAPIKeysName, func(w io.Writer) (int, error) {
+		enc := json.NewEncoder(w)
+		for _, k := range keys {
+			if err := enc.Encode(backupAPIKey{APIKey: *k, Hash: k.Hash}); err != nil {
+				return 0, err
+			}
+		}
+		return len(keys), nil
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel = call()
+	campaigns, err := db.GetCampaigns(ctx)
+	cancel()
+	if err != nil {
+		return err
+	}
+	err = b.add(backupCampaignsName, func(w io.Writer) (int, error) {
+		enc := json.NewEncoder(w)
+		for _, c := range campaigns {
+			if err := enc.Encode(c); err != nil {
+				return 0, err
+			}
+		}
+		return len(campaigns), nil
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel = call()
+	tags, err := db.GetTags(ctx)
+	cancel()
+	if err != nil {
+		return err
+	}
+	err = b.add(backupTagsName, func(w io.Writer) (int, error) {
+		enc := json.NewEncoder(w)
+		for _, tag := range tags {
+			t := tag.clone()
+			t.History, t.Access = nil, nil
+			if err := enc.Encode(backupTag{Tag: *t, UsernameIndex: t.UsernameIndex}); err != nil {
+				return 0, err
+			}
+		}
+		return len(tags), nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = b.add(backupHistoryName, func(w io.Writer) (int, error) {
+		enc := json.NewEncoder(w)
+		n := 0
+		for _, tag := range tags {
+			q := TagHistoryQuery{TagID: tag.ID, Limit: maxAccessLogLimit}
+			for {
+				ctx, cancel := call()
+				page, err := db.GetTagHistory(ctx, q)
+				cancel()
+				if err != nil {
+					return 0, err
+				}
+				for _, item := range page.History {
+					if err := enc.Encode(backupHistoryItem{TagID: tag.ID, TagHistoryItem: item}); err != nil {
+						return 0, err
+					}
+					n++
+				}
+				if page.NextCursor == "" {
+					break
+				}
+				q.Cursor = page.NextCursor
+			}
+		}
+		return n, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = b.add(backupTransitionName, func(w io.Writer) (int, error) {
+		enc := json.NewEncoder(w)
+		n := 0
+		for _, tag := range tags {
+			ctx, cancel := call()
+			transitions, err := db.GetTagTransitions(ctx, tag.ID)
+			cancel()
+			if err != nil {
+				return 0, err
+			}
+			for _, t := range transitions {
+				if err := enc.Encode(t); err != nil {
+					return 0, err
+				}
+				n++
+			}
+		}
+		return n, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel = call()
+	policies, err := db.GetRetentionPolicies(ctx)
+	cancel()
+	if err != nil {
+		return err
+	}
+	err = b.add(backupPoliciesName, func(w io.Writer) (int, error) {
+		enc := json.NewEncoder(w)
+		for _, policy := range policies {
+			if err := enc.Encode(policy); err != nil {
+				return 0, err
+			}
+		}
+		return len(policies), nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return b.add(backupAccessLogsName, func(w io.Writer) (int, error) {
+		enc := json.NewEncoder(w)
+		n := 0
+		q := AccessLogQuery{Limit: maxAccessLogLimit}
+		for {
+			ctx, cancel := call()
+			page, err := db.QueryAccessLogs(ctx, q)
+			cancel()
+			if err != nil {
+				return 0, err
+			}
+			for _, log := range page.Logs {
+				if err := enc.Encode(log); err != nil {
+					return 0, err
+				}
+				n++
+			}
+			if page.NextCursor == "" {
+				break
+			}
+			q.Cursor = page.NextCursor
+		}
+		return n, nil
+	})
+}
+
+// readBackup walks every entry of the archive at p, handing each one to fn,
+// and checks the result against the manifest. fn does not have to consume
+// the whole reader.
+func readBackup(p string, fn func(name string, r io.Reader) error) (*BackupManifest, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(gz)
+	sums := map[string]string{}
+	var manifest *BackupManifest
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Name == backupManifestName {
+			manifest = &BackupManifest{}
+			if err := json.NewDecoder(tr).Decode(manifest); err != nil {
+				return nil, fmt.Errorf("bad manifest: %v", err)
+			}
+			continue
+		}
+		h := sha256.New()
+		r := io.TeeReader(tr, h)
+		if err := fn(hdr.Name, r); err != nil {
+			return nil, fmt.Errorf("%s: %v", hdr.Name, err)
+		}
+		if _, err := io.Copy(io.Discard, r); err != nil {
+			return nil, err
+		}
+		sums[hdr.Name] = hex.EncodeToString(h.Sum(nil))
+	}
+	if manifest == nil {
+		return nil, fmt.Errorf("archive has no %s", backupManifestName)
+	}
+	if manifest.Format != "thelp-backup" {
+		return nil, fmt.Errorf("not a thelp backup: format %q", manifest.Format)
+	}
+	if manifest.Version > backupFormatVersion {
+		return nil, fmt.Errorf("backup format version %d is newer than this build understands (%d)", manifest.Version, backupFormatVersion)
+	}
+	for name, want := range manifest.Checksums {
+		got, ok := sums[name]
+		if !ok {
+			return nil, fmt.Errorf("%s is listed in the manifest but missing from the archive", name)
+		}
+		if got != want {
+			return nil, fmt.Errorf("%s checksum mismatch: manifest has %s, archive has %s", name, want, got)
+		}
+	}
+	for name := range sums {
+		if _, ok := manifest.Checksums[name]; !ok {
+			return nil, fmt.Errorf("%s is in the archive but not in the manifest", name)
+		}
+	}
+	return manifest, nil
+}
+
+// decodeJSONL calls fn with a fresh decoder target for every line of r.
+func decodeJSONL[T any](r io.Reader, fn func(*T) error) (int, error) {
+	dec := json.NewDecoder(r)
+	n := 0
+	for {
+		var v T
+		if err := dec.Decode(&v); err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, fmt.Errorf("record %d: %v", n+1, err)
+		}
+		if err := fn(&v); err != nil {
+			return n, err
+		}
+		n++
+	}
+}
+
+// VerifyBackup reads the whole archive, checking checksums and that every
+// record parses, without touching the database.
+func VerifyBackup(p string) (*BackupManifest, error) {
+	return readBackup(p, func(name string, r io.Reader) error {
+		var err error
+		switch name {
+		case backupTenantsName:
+			_, err = decodeJSONL(r, func(*Tenant) error { return nil })
+		case backupAPIKeysName:
+			_, err = decodeJSONL(r, func(*backupAPIKey) error { return nil })
+		case backupCampaignsName:
+			_, err = decodeJSONL(r, func(*Campaign) error { return nil })
+		case backupTagsName:
+			_, err = decodeJSONL(r, func(*backupTag) error { return nil })
+		case backupHistoryName:
+			_, err = decodeJSONL(r, func(*backupHistoryItem) error { return nil })
+		case backupTransitionName:
+			_, err = decodeJSONL(r, func(*TagTransition) error { return nil })
+		case backupPoliciesName:
+			_, err = decodeJSONL(r, func(*RetentionPolicy) error { return nil })
+		case backupAccessLogsName:
+			_, err = decodeJSONL(r, func(*AccessLog) error { return nil })
+		default:
+			if !strings.HasPrefix(name, backupStaticPrefix) {
+				err = fmt.Errorf("unexpected entry")
+			}
+		}
+		return err
+	})
+}
+
+// checkSealed makes sure e's keyring opens every sealed value of the
+// encrypted archive at p before any of it is written.
+func checkSealed(e *EncryptedDB, p string) error {
+	_, err := readBackup(p, func(name string, r io.Reader) error {
+		var err error
+		switch name {
+		case backupTagsName:
+			_, err = decodeJSONL(r, func(t *backupTag) error { return e.openTag(&t.Tag) })
+		case backupAccessLogsName:
+			_, err = decodeJSONL(r, func(log *AccessLog) error { return e.openLog(log) })
+		}
+		return err
+	})
+	return err
+}
+
+// Restore loads an archive written by Backup. The archive is verified in
+// full before anything is written. Unless force is set the database must
+// be empty; with force, tags that already exist are skipped along with
+// their history, campaigns are matched up by tenant and name, API keys
+// and retention policies already there are kept and so are existing
+// static files. Campaigns get new IDs, tags are relinked to them. Tenants
+// that already exist are reused. An encrypted archive can only go back
+// behind an EncryptedDB whose keyring opens it, its values are written as
+// they are.
+func Restore(db Database, p, staticDir string, timeout time.Duration, force bool) (map[string]int, error) {
+	manifest, err := VerifyBackup(p)
+	if err != nil {
+		return nil, err
+	}
+	if manifest.Encrypted {
+		e, ok := db.(*EncryptedDB)
+		if !ok {
+			return nil, fmt.Errorf("archive holds encrypted values, restore it with -keyring set")
+		}
+		if err := checkSealed(e, p); err != nil {
+			return nil, fmt.Errorf("keyring can't open the archive: %v", err)
+		}
+		db = e.Database
+	}
+	call := func() (context.Context, context.CancelFunc) {
+		return context.WithTimeout(context.Background(), timeout)
+	}
+	if !force {
+		ctx, cancel := call()
+		tags, err := db.GetTags(ctx)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		ctx, cancel = call()
+		logs, err := db.QueryAccessLogs(ctx, AccessLogQuery{Limit: 1})
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		ctx, cancel = call()
+		campaigns, err := db.GetCampaigns(ctx)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		if len(tags) > 0 || len(logs.Logs) > 0 || len(campaigns) > 0 {
+			return nil, fmt.Errorf("database is not empty, use -force to merge into it")
+		}
+	}
+
+	counts := map[string]int{}
+	skipped := map[string]bool{}
+	existing := map[string]int64{}
+	policies := map[string]bool{}
+	if force {
+		ctx, cancel := call()
+		campaigns, err := db.GetCampaigns(ctx)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range campaigns {
+			existing[c.TenantID+"/"+c.Name] = c.ID
+		}
+		ctx, cancel = call()
+		current, err := db.GetRetentionPolicies(ctx)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		for _, policy := range current {
+			policies[policyKey(policy)] = true
+		}
+	}
+	campaignIDs := map[int64]int64{}
+	_, err = readBackup(p, func(name string, r io.Reader) error {
+		switch name {
+		case backupTenantsName:
+			_, err := decodeJSONL(r, func(t *Tenant) error {
+				ctx, cancel := call()
+				defer cancel()
+				err := db.AddTenant(ctx, t)
+				if errors.Is(err, ErrConflict) {
+					counts["tenants_skipped"]++
+					return nil
+				}
+				if err == nil {
+					counts["tenants"]++
+				}
+				return err
+			})
+			return err
+		case backupAPIKeysName:
+			_, err := decodeJSONL(r, func(k *backupAPIKey) error {
+				ctx, cancel := call()
+				defer cancel()
+				_, err := db.GetAPIKey(ctx, k.Hash)
+				if err == nil {
+					counts["api_keys_skipped"]++
+					return nil
+				}
+				if !errors.Is(err, ErrNotFound) {
+					return err
+				}
+				key := k.APIKey
+				key.ID, key.Hash = 0, k.Hash
+				if err := db.AddAPIKey(ctx, &key); err != nil {
+					return err
+				}
+				counts["api_keys"]++
+				return nil
+			})
+			return err
+		case backupCampaignsName:
+			_, err := decodeJSONL(r, func(c *Campaign) error {
+				if id, ok := existing[tenantFor(context.Background(), c.TenantID)+"/"+c.Name]; ok {
+					campaignIDs[c.ID] = id
+					counts["campaigns_skipped"]++
+					return nil
+				}
+				old := c.ID
+				c.ID = 0
+				ctx, cancel := call()
+				defer cancel()
+				if err := db.SaveCampaign(ctx, c); err != nil {
+					return err
+				}
+				campaignIDs[old] = c.ID
+				counts["campaigns"]++
+				return nil
+			})
+			return err
+		case backupTagsName:
+			_, err := decodeJSONL(r, func(t *backupTag) error {
+				tag := &t.Tag
+				tag.UsernameIndex = t.UsernameIndex
+				tag.CampaignID = campaignIDs[tag.CampaignID]
+				ctx, cancel := call()
+				defer cancel()
+				err := db.InsertTag(ctx, tag, TagChange{})
+				if errors.Is(err, ErrConflict) {
+					skipped[tag.ID] = true
+					counts["tags_skipped"]++
+					return nil
+				}
+				if err == nil {
+					counts["tags"]++
+				}
+				return err
+			})
+			return err
+		case backupHistoryName:
+			_, err := decodeJSONL(r, func(item *backupHistoryItem) error {
+				if skipped[item.TagID] {
+					return nil
+				}
+				ctx, cancel := call()
+				defer cancel()
+				counts["history"]++
+				return db.AddTagHistory(ctx, item.TagID, item.TagHistoryItem)
+			})
+			return err
+		case backupTransitionName:
+			_, err := decodeJSONL(r, func(t *TagTransition) error {
+				if skipped[t.TagID] {
+					return nil
+				}
+				ctx, cancel := call()
+				defer cancel()
+				counts["transitions"]++
+				return db.AddTagTransition(ctx, *t)
+			})
+			return err
+		case backupPoliciesName:
+			_, err := decodeJSONL(r, func(policy *RetentionPolicy) error {
+				if policies[policyKey(policy)] {
+					counts["retention_policies_skipped"]++
+					return nil
+				}
+				policy.ID = 0
+				ctx, cancel := call()
+				defer cancel()
+				if err := db.SaveRetentionPolicy(ctx, policy); err != nil {
+					return err
+				}
+				counts["retention_policies"]++
+				return nil
+			})
+			return err
+		case backupAccessLogsName:
+			var batch []*AccessLog
+			flush := func() error {
+				if len(batch) == 0 {
+					return nil
+				}
+				ctx, cancel := call()
+				defer cancel()
+				err := db.AddAccessLogs(ctx, batch)
+				counts["access_logs"] += len(batch)
+				batch = batch[:0]
+				return err
+			}
+			_, err := decodeJSONL(r, func(log *AccessLog) error {
+				batch = append(batch, log)
+				if len(batch) >= maxAccessLogLimit {
+					return flush()
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			return flush()
+		default:
+			rel := strings.TrimPrefix(name, backupStaticPrefix)
+			// never let an archive write outside staticDir
+			if !fs.ValidPath(rel) {
+				return fmt.Errorf("unsafe path")
+			}
+			dst := filepath.Join(staticDir, filepath.FromSlash(rel))
+			if _, err := os.Stat(dst); err == nil {
+				counts["files_skipped"]++
+				return nil
+			}
+			if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+				return err
+			}
+			out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+			if err != nil {
+				return err
+			}
+			defer out.Close()
+			if _, err := io.Copy(out, r); err != nil {
+				return err
+			}
+			counts["files"]++
+			return out.Close()
+		}
+	})
+	return counts, err
+}
+
+// policyKey tells apart retention policies that do different things.
+func policyKey(p *RetentionPolicy) string {
+	return fmt.Sprintf("%s/%s/%s/%d/%t", p.TenantID, p.TagID, p.Action, p.AfterDays, p.DropUserAgent)
+}
+
+// runBackupCommand implements `thelp backup [-out file] [-static dir]`.
+func runBackupCommand(db Database, args []string) error {
+	fset := flag.NewFlagSet("backup", flag.ExitOnError)
+	out := fset.String("out", fmt.Sprintf("thelp-backup-%s.tar.gz", time.Now().Format("20060102-150405")), "archive to write")
+	staticDir := fset.String("static", "./static", "directory of instrumented files to include")
+	fset.Parse(args)
+	manifest, err := Backup(db, *out, *staticDir, *dbTimeout)
+	if err != nil {
+		os.Remove(*out)
+		return err
+	}
+	for _, name := range backupRecords {
+		fmt.Printf("%s\t%d records\n", name, manifest.Counts[name])
+	}
+	fmt.Printf("static files\t%d\n", len(manifest.Checksums)-len(backupRecords))
+	fmt.Println("wrote", *out)
+	return nil
+}
+
+// runRestoreCommand implements `thelp restore [-verify] [-force] [-static dir] file`.
+func runRestoreCommand(db Database, args []string) error {
+	fset := flag.NewFlagSet("restore", flag.ExitOnError)
+	verify := fset.Bool("verify", false, "only check the archive, write nothing")
+	force := fset.Bool("force", false, "restore into a database that already has data, skipping existing tags")
+	staticDir := fset.String("static", "./static", "directory to restore instrumented files into")
+	fset.Parse(args)
+	if fset.NArg() != 1 {
+		return fmt.Errorf("usage: thelp restore [-verify] [-force] [-static dir] archive")
+	}
+	archive := fset.Arg(0)
+	if *verify {
+		manifest, err := VerifyBackup(archive)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s is a valid version %d backup from %s\n", archive, manifest.Version, time.Unix(manifest.Created, 0).Format(time.RFC3339))
+		names := make([]string, 0, len(manifest.Counts))
+		for name := range manifest.Counts {
+			if !strings.HasPrefix(name, backupStaticPrefix) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("%s\t%d records\n", name, manifest.Counts[name])
+		}
+		fmt.Printf("static files\t%d\n", len(manifest.Checksums)-len(names))
+		return nil
+	}
+	counts, err := Restore(db, archive, path.Clean(*staticDir), *dbTimeout, *force)
+	for name, n := range counts {
+		fmt.Printf("%s\t%d\n", name, n)
+	}
+	return err
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fillBackupSource puts one of every record Backup writes into db.
+func fillBackupSource(t *testing.T, db Database) {
+	t.Helper()
+	ctx := context.Background()
+	if err := db.AddTenant(ctx, &Tenant{ID: "acme", Name: "Acme", Created: 100}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddAPIKey(ctx, &APIKey{TenantID: "acme", Label: "ci", Hash: hashAPIKey("secret"), Created: 100}); err != nil {
+		t.Fatal(err)
+	}
+	campaign := &Campaign{Name: "q3", Created: 100}
+	if err := db.SaveCampaign(ctx, campaign); err != nil {
+		t.Fatal(err)
+	}
+	tag := NewTag(testTagID, "c1", "h1", 100)
+	tag.Username = "alice"
+	tag.FilePath = "docs/plan.pdf"
+	tag.CampaignID = campaign.ID
+	event := TagHistoryItem{ClientID: "c1", Hash: "h1", Created: 100}
+	if err := db.InsertTag(ctx, tag, TagChange{History: &event}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddTagTransition(ctx, TagTransition{TagID: testTagID, From: TagArmed, To: TagDisarmed, Actor: "ops", Created: 101}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SaveRetentionPolicy(ctx, &RetentionPolicy{Action: RetentionTruncate, AfterDays: 30, Created: 100}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddAccessLog(ctx, &AccessLog{IP: "203.0.113.7", UserAgent: "curl", Timestamp: 102, TagID: testTagID}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readBackupEntry returns the raw content of one entry of the archive at p.
+func readBackupEntry(t *testing.T, p, name string) string {
+	t.Helper()
+	f, err := os.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if hdr.Name == name {
+			raw, err := io.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return string(raw)
+		}
+	}
+}
+
+func TestBackupRoundTrip(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db Database) {
+		fillBackupSource(t, db)
+		static := t.TempDir()
+		if err := os.WriteFile(filepath.Join(static, "plan.pdf"), []byte("%PDF"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		archive := filepath.Join(t.TempDir(), "backup.tar.gz")
+		manifest, err := Backup(db, archive, static, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if manifest.Encrypted {
+			t.Error("plain backup marked encrypted")
+		}
+		for _, name := range backupRecords {
+			want := 1
+			if name == backupTenantsName {
+				want = 2
+			}
+			if manifest.Counts[name] != want {
+				t.Errorf("%s: %d records, want %d", name, manifest.Counts[name], want)
+			}
+		}
+
+		restored := NewMemoryDB()
+		dst := t.TempDir()
+		counts, err := Restore(restored, archive, dst, time.Second, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"api_keys", "campaigns", "tags", "history", "transitions", "retention_policies", "access_logs", "files"} {
+			if counts[name] != 1 {
+				t.Errorf("restored %d %s, want 1", counts[name], name)
+			}
+		}
+		ctx := context.Background()
+		key, err := restored.GetAPIKey(ctx, hashAPIKey("secret"))
+		if err != nil || key.TenantID != "acme" || key.Label != "ci" {
+			t.Errorf("api key: got %+v %v", key, err)
+		}
+		tag, err := restored.GetTag(ctx, testTagID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tag.Username != "alice" || tag.CampaignID == 0 {
+			t.Errorf("tag: got %+v", tag)
+		}
+		policies, err := restored.GetRetentionPolicies(ctx)
+		if err != nil || len(policies) != 1 || policies[0].AfterDays != 30 {
+			t.Errorf("policies: got %v %v", policies, err)
+		}
+
+		// a forced second run only finds duplicates
+		counts, err = Restore(restored, archive, dst, time.Second, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"api_keys_skipped", "campaigns_skipped", "tags_skipped", "retention_policies_skipped", "files_skipped"} {
+			if counts[name] != 1 {
+				t.Errorf("second run skipped %d %s, want 1", counts[name], strings.TrimSuffix(name, "_skipped"))
+			}
+		}
+		if policies, _ := restored.GetRetentionPolicies(ctx); len(policies) != 1 {
+			t.Errorf("second run left %d policies", len(policies))
+		}
+	})
+}
+
+func TestBackupEncrypted(t *testing.T) {
+	keys := newTestKeyring(t, "k1")
+	db, err := NewEncryptedDB(NewMemoryDB(), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fillBackupSource(t, db)
+	archive := filepath.Join(t.TempDir(), "backup.tar.gz")
+	manifest, err := Backup(db, archive, t.TempDir(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !manifest.Encrypted {
+		t.Error("backup of an EncryptedDB isn't marked encrypted")
+	}
+	for name, plain := range map[string]string{backupTagsName: "alice", backupAccessLogsName: "203.0.113.7"} {
+		if raw := readBackupEntry(t, archive, name); strings.Contains(raw, plain) || !strings.Contains(raw, encryptedPrefix) {
+			t.Errorf("%s isn't sealed: %s", name, raw)
+		}
+	}
+
+	if _, err := Restore(NewMemoryDB(), archive, t.TempDir(), time.Second, false); err == nil {
+		t.Error("restored an encrypted archive without a keyring")
+	}
+	other, err := NewEncryptedDB(NewMemoryDB(), newTestKeyring(t, "k2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Restore(other, archive, t.TempDir(), time.Second, false); err == nil {
+		t.Error("restored an encrypted archive with the wrong keyring")
+	}
+
+	restored, err := NewEncryptedDB(NewMemoryDB(), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Restore(restored, archive, t.TempDir(), time.Second, false); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	tags, err := restored.GetTagsByUsername(ctx, "alice")
+	if err != nil || len(tags) != 1 || tags[0].FilePath != "docs/plan.pdf" {
+		t.Errorf("lookup by username after restore: got %v %v", tags, err)
+	}
+	page, err := restored.QueryAccessLogs(ctx, AccessLogQuery{})
+	if err != nil || len(page.Logs) != 1 || page.Logs[0].IP != "203.0.113.7" {
+		t.Errorf("access logs after restore: got %v %v", page, err)
+	}
+}
+
+// TestSQLiteSnapshot reads through a snapshot and checks it can't be
+// written to.
+func TestSQLiteSnapshot(t *testing.T) {
+	db := newTestSQLiteDB(t)
+	ctx := context.Background()
+	if err := db.InsertTag(ctx, NewTag(testTagID, "c1", "h1", 100), TagChange{}); err != nil {
+		t.Fatal(err)
+	}
+	err := db.Snapshot(ctx, func(snap Database) error {
+		tags, err := snap.GetTags(ctx)
+		if err != nil {
+			return err
+		}
+		if len(tags) != 1 {
+			t.Errorf("snapshot has %d tags, want 1", len(tags))
+		}
+		if err := snap.InsertTag(ctx, NewTag(testTagID2, "c2", "h2", 101), TagChange{}); err == nil {
+			t.Error("wrote through a read-only snapshot")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetTag(ctx, testTagID2); err == nil {
+		t.Error("the snapshot write went through")
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var decoyDir = flag.String("decoy-dir", "./decoys", "directory holding the decoy files tags can answer with, one subdirectory per tenant under tenants/")
+
+// What the beacon answers with. Whoever opens a tagged document only ever
+// gets one of these, never anything about the tag.
+const (
+	BeaconGIF   = "gif"
+	BeaconPNG   = "png"
+	BeaconCSS   = "css"
+	BeaconFDF   = "fdf"
+	BeaconXFDF  = "xfdf"
+	BeaconPDF   = "pdf"
+	BeaconDecoy = "decoy"
+)
+
+var beaconContentTypes = map[string]string{
+	BeaconGIF:  "image/gif",
+	BeaconPNG:  "image/png",
+	BeaconCSS:  "text/css; charset=utf-8",
+	BeaconFDF:  contentTypeFDF,
+	BeaconXFDF: contentTypeXFDF,
+	BeaconPDF:  "application/pdf",
+}
+
+var beaconBodies = map[string][]byte{
+	BeaconGIF: transparentPixel(BeaconGIF),
+	BeaconPNG: transparentPixel(BeaconPNG),
+	BeaconCSS: {},
+	BeaconFDF: []byte("%FDF-1.2\n1 0 obj\n<< /FDF << /Fields [] >> >>\nendobj\ntrailer\n<< /Root 1 0 R >>\n%%EOF\n"),
+	BeaconXFDF: []byte(`<?xml version="1.0" encoding="UTF-8"?>` + "\n" +
+		`<xfdf xmlns="http://ns.adobe.com/xfdf/" xml:space="preserve"><fields/></xfdf>` + "\n"),
+	BeaconPDF: blankPDF(),
+}
+
+// transparentPixel encodes a 1x1 fully transparent image as a GIF or PNG.
+func transparentPixel(format string) []byte {
+	img := image.NewPaletted(image.Rect(0, 0, 1, 1), color.Palette{color.Transparent})
+	var buf bytes.Buffer
+	var err error
+	if format == BeaconPNG {
+		err = png.Encode(&buf, img)
+	} else {
+		err = gif.Encode(&buf, img, nil)
+	}
+	if err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+// blankPDF builds a single empty page, the xref offsets have to be exact
+// or readers complain about a damaged file.
+func blankPDF() []byte {
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] >>",
+	}
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return buf.Bytes()
+}
+
+// validateBeaconResponse checks what a tag is set to answer with. A decoy
+// is a bare file name in the tenant's decoy directory.
+func validateBeaconResponse(response, decoy string) error {
+	switch response {
+	case "", BeaconGIF, BeaconPNG, BeaconCSS, BeaconFDF, BeaconXFDF, BeaconPDF:
+		if decoy != "" {
+			return fmt.Errorf("%w: decoy is only used with response %s", ErrInvalidQuery, BeaconDecoy)
+		}
+	case BeaconDecoy:
+		if decoy == "" || decoy != filepath.Base(decoy) || strings.HasPrefix(decoy, ".") {
+			return fmt.Errorf("%w: decoy must be a file name in the decoy directory", ErrInvalidQuery)
+		}
+	default:
+		return fmt.Errorf("%w: unknown response %q", ErrInvalidQuery, response)
+	}
+	return nil
+}
+
+// beaconExtensions are the suffixes a beacon URL may carry to say how it
+// is embedded, /<id>.png say.
+var beaconExtensions = map[string]string{
+	".gif":  BeaconGIF,
+	".png":  BeaconPNG,
+	".css":  BeaconCSS,
+	".fdf":  BeaconFDF,
+	".xfdf": BeaconXFDF,
+	".pdf":  BeaconPDF,
+}
+
+// splitBeaconPath splits a known extension off the last path element.
+func splitBeaconPath(p string) (id, response string) {
+	ext := strings.ToLower(filepath.Ext(p))
+	if response, ok := beaconExtensions[ext]; ok {
+		return p[:len(p)-len(ext)], response
+	}
+	return p, ""
+}
+
+// acceptedBeacon picks a response from an Accept header, in the order the
+// client listed its types. Anything we can't tell gets the GIF, which is
+// what INCLUDEPICTURE and most mail clients are happy with.
+func acceptedBeacon(accept string) string {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, _ := strings.Cut(strings.TrimSpace(part), ";")
+		switch strings.ToLower(strings.TrimSpace(mediaType)) {
+		case "image/png", "image/apng":
+			return BeaconPNG
+		case "image/gif", "image/*":
+			return BeaconGIF
+		case "text/css":
+			return BeaconCSS
+		case contentTypeFDF:
+			return BeaconFDF
+		case contentTypeXFDF:
+			return BeaconXFDF
+		case "application/pdf":
+			return BeaconPDF
+		}
+	}
+	return BeaconGIF
+}
+
+// beaconResponse is what a hit on tag gets: the tag's own setting, else the
+// extension the URL was requested with, else the Accept header.
+func beaconResponse(tag *Tag, ext, accept string) string {
+	if tag != nil && tag.Response != "" {
+		return tag.Response
+	}
+	if ext != "" {
+		return ext
+	}
+	return acceptedBeacon(accept)
+}
+
+func tenantDecoyDir(tenant string) string {
+	if tenant == DefaultTenant || tenant == "" {
+		return *decoyDir
+	}
+	return filepath.Join(*decoyDir, "tenants", tenant)
+}
+
+// serveBeacon writes the response for kind. Nothing about the tag goes
+// out, and caches are told not to keep it so every open is a hit.
+func (a *Application) serveBeacon(w http.ResponseWriter, r *http.Request, tag *Tag, kind string) {
+	w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, private")
+	w.Header().Set("Pragma", "no-cache")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if kind == BeaconDecoy {
+		if a.serveDecoy(w, r, tag) {
+			return
+		}
+		kind = BeaconGIF
+	}
+	body := beaconBodies[kind]
+	w.Header().Set("Content-Type", beaconContentTypes[kind])
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		w.Write(body)
+	}
+}
+
+// serveDecoy sends the decoy file of tag, reporting false if there is
+// none to send so the caller can fall back to a pixel.
+func (a *Application) serveDecoy(w http.ResponseWriter, r *http.Request, tag *Tag) bool {
+	if tag == nil || validateBeaconResponse(BeaconDecoy, tag.Decoy) != nil {
+		return false
+	}
+	f, err := os.Open(filepath.Join(tenantDecoyDir(tag.TenantID), tag.Decoy))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			a.Logger.Error("could not open decoy", zap.String("tag_id", tag.ID), zap.Error(err))
+		} else {
+			a.Logger.Warn("decoy missing, answering with a pixel", zap.String("tag_id", tag.ID), zap.String("decoy", tag.Decoy))
+		}
+		return false
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+	if ctype := mime.TypeByExtension(filepath.Ext(tag.Decoy)); ctype != "" {
+		w.Header().Set("Content-Type", ctype)
+	}
+	// no modtime, so there is no Last-Modified for a client to revalidate
+	// against instead of fetching it again
+	http.ServeContent(w, r, tag.Decoy, time.Time{}, f)
+	return true
+}
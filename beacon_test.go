@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSplitBeaconPath(t *testing.T) {
+	for _, tc := range []struct {
+		path, id, response string
+	}{
+		{testTagID, testTagID, ""},
+		{testTagID + ".png", testTagID, BeaconPNG},
+		{testTagID + ".PDF", testTagID, BeaconPDF},
+		{testTagID + ".xfdf", testTagID, BeaconXFDF},
+		{testTagID + ".exe", testTagID + ".exe", ""},
+	} {
+		if id, response := splitBeaconPath(tc.path); id != tc.id || response != tc.response {
+			t.Errorf("%q: got %q %q", tc.path, id, response)
+		}
+	}
+}
+
+func TestAcceptedBeacon(t *testing.T) {
+	for accept, want := range map[string]string{
+		"":                                   BeaconGIF,
+		"*/*":                                BeaconGIF,
+		"image/avif,image/webp,image/png":    BeaconPNG,
+		"image/webp, image/*;q=0.8":          BeaconGIF,
+		"text/css,*/*;q=0.1":                 BeaconCSS,
+		"Application/PDF":                    BeaconPDF,
+		contentTypeFDF + ", application/pdf": BeaconFDF,
+		contentTypeXFDF:                      BeaconXFDF,
+		"text/html,application/xhtml+xml":    BeaconGIF,
+	} {
+		if got := acceptedBeacon(accept); got != want {
+			t.Errorf("%q: got %s, want %s", accept, got, want)
+		}
+	}
+}
+
+func TestBeaconResponse(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		tag         *Tag
+		ext, accept string
+		want        string
+	}{
+		{"tag wins", &Tag{Response: BeaconCSS}, BeaconPNG, "application/pdf", BeaconCSS},
+		{"extension", &Tag{}, BeaconPNG, "application/pdf", BeaconPNG},
+		{"accept", &Tag{}, "", "application/pdf", BeaconPDF},
+		{"no tag", nil, "", "", BeaconGIF},
+	} {
+		if got := beaconResponse(tc.tag, tc.ext, tc.accept); got != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestValidateBeaconResponse(t *testing.T) {
+	for _, tc := range []struct {
+		response, decoy string
+		ok              bool
+	}{
+		{"", "", true},
+		{BeaconPDF, "", true},
+		{BeaconPNG, "cv.pdf", false},
+		{BeaconDecoy, "cv.pdf", true},
+		{BeaconDecoy, "", false},
+		{BeaconDecoy, "../cv.pdf", false},
+		{BeaconDecoy, ".hidden", false},
+		{"html", "", false},
+	} {
+		err := validateBeaconResponse(tc.response, tc.decoy)
+		if tc.ok != (err == nil) || (err != nil && !errors.Is(err, ErrInvalidQuery)) {
+			t.Errorf("%q %q: got %v", tc.response, tc.decoy, err)
+		}
+	}
+}
+
+// TestBeaconNegotiation hits a tag the ways documents embed it and checks
+// the answer never carries the tag.
+func TestBeaconNegotiation(t *testing.T) {
+	dir := t.TempDir()
+	old := *decoyDir
+	*decoyDir = dir
+	t.Cleanup(func() { *decoyDir = old })
+	if err := os.WriteFile(filepath.Join(dir, "cv.txt"), []byte("curriculum"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	app := newTestApp(t)
+	addTestTag(t, app, map[string]any{"id": testTagID, "hash": "secret-hash", "username": "alice"})
+	addTestTag(t, app, map[string]any{"id": testTagID2, "hash": "h", "response": BeaconDecoy, "decoy": "cv.txt"})
+	for _, tc := range []struct {
+		name, method, path, accept string
+		code                       int
+		ctype                      string
+		body                       []byte
+	}{
+		{"default", http.MethodGet, "/" + testTagID, "", http.StatusOK, "image/gif", beaconBodies[BeaconGIF]},
+		{"extension", http.MethodGet, "/" + testTagID + ".png", "text/css", http.StatusOK, "image/png", beaconBodies[BeaconPNG]},
+		{"accept", http.MethodGet, "/" + testTagID, "text/css", http.StatusOK, "text/css; charset=utf-8", beaconBodies[BeaconCSS]},
+		{"pdf", http.MethodGet, "/" + testTagID + ".pdf", "", http.StatusOK, "application/pdf", beaconBodies[BeaconPDF]},
+		{"head", http.MethodHead, "/" + testTagID + ".png", "", http.StatusOK, "image/png", nil},
+		{"decoy", http.MethodGet, "/" + testTagID2, "image/png", http.StatusOK, "text/plain; charset=utf-8", []byte("curriculum")},
+		{"not a uuid", http.MethodGet, "/wp-login.php", "", http.StatusNotFound, "", nil},
+		{"unknown tag", http.MethodGet, "/00000000-0000-4000-8000-000000000000.gif", "", http.StatusNotFound, "", nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, tc.path, nil)
+			if tc.accept != "" {
+				r.Header.Set("Accept", tc.accept)
+			}
+			w := serve(app, r)
+			if w.Code != tc.code {
+				t.Fatalf("got %d %s, want %d", w.Code, w.Body, tc.code)
+			}
+			if tc.code != http.StatusOK {
+				return
+			}
+			if got := w.Header().Get("Content-Type"); got != tc.ctype {
+				t.Errorf("content type %q, want %q", got, tc.ctype)
+			}
+			if !bytes.Equal(w.Body.Bytes(), tc.body) {
+				t.Errorf("body %q, want %q", w.Body, tc.body)
+			}
+			if !strings.Contains(w.Header().Get("Cache-Control"), "no-store") {
+				t.Errorf("cacheable: %q", w.Header().Get("Cache-Control"))
+			}
+			for _, leak := range []string{"secret-hash", "alice", testTagID} {
+				if strings.Contains(w.Body.String(), leak) {
+					t.Errorf("body gives away %q", leak)
+				}
+			}
+		})
+	}
+
+	// a decoy that went missing falls back to the pixel
+	if err := os.Remove(filepath.Join(dir, "cv.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(app, httptest.NewRequest(http.MethodGet, "/"+testTagID2, nil)); w.Header().Get("Content-Type") != "image/gif" {
+		t.Errorf("missing decoy: got %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+}
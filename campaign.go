@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Campaign groups the tags seeded for one deception, a fake M&A data room
+// say. The defaults are filled into tags created in the campaign that
+// don't set their own.
+type Campaign struct {
+	ID               int64  `json:"id"`
+	TenantID         string `json:"tenant_id,omitempty"`
+	Name             string `json:"name"`
+	Owner            string `json:"owner,omitempty"`
+	Description      string `json:"description,omitempty"`
+	DefaultState     string `json:"default_state,omitempty"`
+	DefaultArmAt     int    `json:"default_arm_at,omitempty"`
+	DefaultExpiresAt int    `json:"default_expires_at,omitempty"`
+	Created          int    `json:"created"`
+}
+
+func (c *Campaign) validate() error {
+	c.Name = strings.TrimSpace(c.Name)
+	if c.Name == "" {
+		return fmt.Errorf("%w: name is required", ErrInvalidQuery)
+	}
+	if c.DefaultState != "" {
+		if err := validInitialState(c.DefaultState); err != nil {
+			return err
+		}
+	}
+	return validateSchedule(c.DefaultArmAt, c.DefaultExpiresAt)
+}
+
+// applyDefaults fills in whatever tag left unset.
+func (c *Campaign) applyDefaults(tag *Tag) {
+	if tag.State == "" {
+		tag.State = c.DefaultState
+	}
+	if tag.ArmAt == 0 {
+		tag.ArmAt = c.DefaultArmAt
+	}
+	if tag.ExpiresAt == 0 {
+		tag.ExpiresAt = c.DefaultExpiresAt
+	}
+}
+
+// HitStats sums up a set of access logs. IPs are counted by the client end
+// of the stored chain.
+type HitStats struct {
+	Hits      int `json:"hits"`
+	UniqueIPs int `json:"unique_ips"`
+	FirstHit  int `json:"first_hit,omitempty"`
+	LastHit   int `json:"last_hit,omitempty"`
+	ips       map[string]bool
+}
+
+func (s *HitStats) add(log *AccessLog) {
+	s.Hits++
+	if s.FirstHit == 0 || log.Timestamp < s.FirstHit {
+		s.FirstHit = log.Timestamp
+	}
+	if log.Timestamp > s.LastHit {
+		s.LastHit = log.Timestamp
+	}
+	ip := strings.TrimSpace(strings.Split(log.IP, ",")[0])
+	if addr, ok := accessLogAddr(ip); ok {
+		ip = addr.String()
+	}
+	if s.ips == nil {
+		s.ips = map[string]bool{}
+	}
+	if !s.ips[ip] {
+		s.ips[ip] = true
+		s.UniqueIPs++
+	}
+}
+
+type TagActivity struct {
+	TagID string `json:"tag_id"`
+	URL   string `json:"url"`
+	State string `json:"state"`
+	HitStats
+}
+
+// CampaignDay is one UTC day of a campaign timeline.
+type CampaignDay struct {
+	Day string `json:"day"`
+	HitStats
+}
+
+type CampaignActivity struct {
+	Campaign *Campaign `json:"campaign"`
+	HitStats
+	Tags     []*TagActivity `json:"tags"`
+	Timeline []*CampaignDay `json:"timeline"`
+}
+
+// CampaignActivity aggregates the hits on every tag of a campaign. The
+// numbers are worked out here rather than in SQL since IPs may be stored
+// encrypted. severity, if set, only counts hits of that severity.
+func (a *Application) CampaignActivity(ctx context.Context, id int64, severity string) (*CampaignActivity, error) {
+	dbCtx, cancel := a.dbContext(ctx)
+	campaign, err := a.DB.GetCampaign(dbCtx, id)
+	cancel()
+	if err != nil {
+		return nil, campaignError(err, id)
+	}
+	dbCtx, cancel = a.dbContext(ctx)
+	tags, err := a.DB.GetTagsByCampaign(dbCtx, id)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	out := &CampaignActivity{Campaign: campaign, Tags: []*TagActivity{}, Timeline: []*CampaignDay{}}
+	days := map[string]*CampaignDay{}
+	for _, tag := range tags {
+		activity := &TagActivity{TagID: tag.ID, URL: fmt.Sprintf("%s/%s", a.FQDN, tag.ID), State: tag.lifecycle()}
+		q := AccessLogQuery{TagID: tag.ID, Severity: severity, Limit: maxAccessLogLimit}
+		for {
+			dbCtx, cancel := a.dbContext(ctx)
+			page, err := a.DB.QueryAccessLogs(dbCtx, q)
+			cancel()
+			if err != nil {
+				return nil, err
+			}
+			for _, log := range page.Logs {
+				activity.add(log)
+				out.add(log)
+				day := time.Unix(int64(log.Timestamp), 0).UTC().Format("2006-01-02")
+				if days[day] == nil {
+					days[day] = &CampaignDay{Day: day}
+				}
+				days[day].add(log)
+			}
+			if page.NextCursor == "" {
+				break
+			}
+			q.Cursor = page.NextCursor
+		}
+		out.Tags = append(out.Tags, activity)
+	}
+	for _, day := range days {
+		out.Timeline = append(out.Timeline, day)
+	}
+	sort.Slice(out.Timeline, func(i, j int) bool {
+		return out.Timeline[i].Day < out.Timeline[j].Day
+	})
+	return out, nil
+}
+
+// campaignError names the campaign in a not found error, so it isn't
+// reported as a missing tag.
+func campaignError(err error, id int64) error {
+	if errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("%w: no campaign %d", ErrNotFound, id)
+	}
+	return err
+}
+
+// campaignFor looks up the campaign a tag is being put in, a missing one
+// is the caller's mistake rather than a missing tag.
+func (a *Application) campaignFor(ctx context.Context, id int64) (*Campaign, error) {
+	campaign, err := a.DB.GetCampaign(ctx, id)
+	if errors.Is(err, ErrNotFound) {
+		return nil, fmt.Errorf("%w: no campaign %d", ErrInvalidQuery, id)
+	}
+	return campaign, err
+}
+
+// DeleteCampaign removes a campaign and unlinks its tags.
+func (a *Application) DeleteCampaign(ctx context.Context, id int64) error {
+	ctx, cancel := a.dbContext(ctx)
+	defer cancel()
+	if err := a.DB.DeleteCampaign(ctx, id); err != nil {
+		return campaignError(err, id)
+	}
+	// cached copies still point at the campaign
+	for _, tag := range a.Tags.Tags() {
+		if tag.CampaignID == id {
+			a.Tags.Remove(tag.ID)
+		}
+	}
+	return nil
+}
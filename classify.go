@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"go.uber.org/zap"
+)
+
+var (
+	hitRulesPath = flag.String("hit-rules", "", "JSON file of extra hit classification rules, checked before the built-in ones, reloaded on SIGHUP")
+	hitCIDRsPath = flag.String("hit-cidrs", "", "file of CIDRs known to belong to mail gateways, proxies and sandboxes, one cidr and optional kind per line, reloaded on SIGHUP")
+	alertKinds   = flag.String("alert-kinds", HitHuman, "comma separated kinds of hits that alert, the others are recorded as low severity")
+)
+
+// What is behind a hit. Only a human opening the document is worth paging
+// anyone for, the rest are machines fetching it on someone's behalf.
+const (
+	HitHuman   = "human"
+	HitPreview = "preview"
+	HitScanner = "scanner"
+	HitProxy   = "proxy"
+	HitUnknown = "unknown"
+)
+
+var hitKinds = []string{HitHuman, HitPreview, HitScanner, HitProxy, HitUnknown}
+
+func validHitKind(kind string) bool {
+	for _, k := range hitKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *AccessLog) kind() string {
+	if l.Kind == "" {
+		return HitUnknown
+	}
+	return l.Kind
+}
+
+// HitRule labels the hits it matches with Kind. Every condition that is set
+// has to match: UserAgent is a case-insensitive regexp, Header a request
+// header that has to be present and Value, if set, a case-insensitive
+// regexp its value has to match.
+type HitRule struct {
+	Name      string `json:"name,omitempty"`
+	Kind      string `json:"kind"`
+	UserAgent string `json:"user_agent,omitempty"`
+	Header    string `json:"header,omitempty"`
+	Value     string `json:"value,omitempty"`
+	userAgent *regexp.Regexp
+	value     *regexp.Regexp
+}
+
+func (h *HitRule) compile() error {
+	if !validHitKind(h.Kind) {
+		return fmt.Errorf("rule %q: kind must be one of %s", h.Name, strings.Join(hitKinds, ", "))
+	}
+	if h.UserAgent == "" && h.Header == "" {
+		return fmt.Errorf("rule %q matches every hit, set user_agent or header", h.Name)
+	}
+	var err error
+	if h.UserAgent != "" {
+		if h.userAgent, err = regexp.Compile("(?i)" + h.UserAgent); err != nil {
+			return fmt.Errorf("rule %q: %v", h.Name, err)
+		}
+	}
+	if h.Value != "" {
+		if h.Header == "" {
+			return fmt.Errorf("rule %q has a value but no header", h.Name)
+		}
+		if h.value, err = regexp.Compile("(?i)" + h.Value); err != nil {
+			return fmt.Errorf("rule %q: %v", h.Name, err)
+		}
+	}
+	return nil
+}
+
+func (h *HitRule) matches(r *http.Request) bool {
+	if h.userAgent != nil && !h.userAgent.MatchString(r.UserAgent()) {
+		return false
+	}
+	if h.Header != "" {
+		values := r.Header.Values(h.Header)
+		if len(values) == 0 {
+			return false
+		}
+		if h.value != nil && !h.value.MatchString(strings.Join(values, ", ")) {
+			return false
+		}
+	}
+	return true
+}
+
+// builtinHitRules cover the common unfurlers, image proxies and gateways.
+// Rules from -hit-rules are checked first, so a local rule with kind human
+// can take back anything these get wrong.
+var builtinHitRules = []HitRule{
+	{Name: "prefetch", Kind: HitPreview, Header: "Sec-Purpose", Value: "prefetch|prerender"},
+	{Name: "purpose", Kind: HitPreview, Header: "Purpose", Value: "prefetch|preview"},
+	{Name: "x-purpose", Kind: HitPreview, Header: "X-Purpose", Value: "prefetch|preview"},
+	{Name: "link previews", Kind: HitPreview, UserAgent: `Slackbot|Slack-ImgProxy|SkypeUriPreview|MicrosoftPreview|Twitterbot|facebookexternalhit|Facebot|LinkedInBot|WhatsApp|TelegramBot|Discordbot|redditbot|Iframely|Embedly|vkShare|Pinterestbot|Mattermost-Bot|Applebot`},
+	{Name: "mail image proxies", Kind: HitProxy, UserAgent: `GoogleImageProxy|ggpht\.com|YahooMailProxy|Superhuman`},
+	{Name: "security gateways", Kind: HitScanner, UserAgent: `Barracuda|Mimecast|Proofpoint|MessageLabs|Symantec|Trend ?Micro|FireEye|Sophos|Forcepoint|IronPort|Zscaler|paloaltonetworks|SafeLinks|urlscan|VirusTotal|Netcraft|Cuckoo|Joe ?Sandbox|Hybrid-Analysis`},
+	{Name: "crawlers", Kind: HitScanner, UserAgent: `Googlebot|bingbot|YandexBot|Baiduspider|crawler|spider`},
+	{Name: "scripts", Kind: HitUnknown, UserAgent: `^(curl|Wget|python-requests|python-urllib|Go-http-client|Java/|okhttp|libwww-perl|HTTPie|axios|node-fetch)`},
+}
+
+// hitCIDR is one line of the -hit-cidrs file.
+type hitCIDR struct {
+	prefix netip.Prefix
+	kind   string
+}
+
+type hitRuleSet struct {
+	cidrs []hitCIDR
+	rules []HitRule
+}
+
+// HitClassifier labels hits. Its rules are swapped as a whole on Reload, so
+// a hit is never classified against half a file.
+type HitClassifier struct {
+	RulesPath string
+	CIDRsPath string
+	set       atomic.Pointer[hitRuleSet]
+}
+
+// NewHitClassifier loads the rule and CIDR files, either may be empty to
+// only use the built-in rules.
+func NewHitClassifier(rulesPath, cidrsPath string) (*HitClassifier, error) {
+	c := &HitClassifier{RulesPath: rulesPath, CIDRsPath: cidrsPath}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload reads the files again. On error the rules in use are kept.
+func (c *HitClassifier) Reload() error {
+	set := &hitRuleSet{}
+	if c.RulesPath != "" {
+		rules, err := loadHitRules(c.RulesPath)
+		if err != nil {
+			return err
+		}
+		set.rules = rules
+	}
+	for _, rule := range builtinHitRules {
+		if err := rule.compile(); err != nil {
+			return err
+		}
+		set.rules = append(set.rules, rule)
+	}
+	if c.CIDRsPath != "" {
+		cidrs, err := loadHitCIDRs(c.CIDRsPath)
+		if err != nil {
+			return err
+		}
+		set.cidrs = cidrs
+	}
+	c.set.Store(set)
+	return nil
+}
+
+// Counts reports how many file rules and CIDRs are loaded, for logging.
+func (c *HitClassifier) Counts() (rules, cidrs int) {
+	set := c.set.Load()
+	return len(set.rules) - len(builtinHitRules), len(set.cidrs)
+}
+
+// Classify labels a hit from ip, the client end of the stored address, and
+// the request. Known networks go first since a gateway can send any user
+// agent it likes, then the rules in order. A hit nothing claims is a human
+// as long as it sent a user agent at all.
+func (c *HitClassifier) Classify(r *http.Request, ip string) string {
+	set := c.set.Load()
+	if addr, ok := accessLogAddr(ip); ok {
+		for _, cidr := range set.cidrs {
+			if cidr.prefix.Contains(addr) {
+				return cidr.kind
+			}
+		}
+	}
+	for i := range set.rules {
+		if set.rules[i].matches(r) {
+			return set.rules[i].Kind
+		}
+	}
+	if strings.TrimSpace(r.UserAgent()) == "" {
+		return HitUnknown
+	}
+	return HitHuman
+}
+
+func loadHitRules(path string) ([]HitRule, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Rules []HitRule `json:"rules"`
+	}
+	if err := json.Unmarshal(raw, &file); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for i := range file.Rules {
+		if err := file.Rules[i].compile(); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	return file.Rules, nil
+}
+
+// loadHitCIDRs reads one `cidr [kind]` per line, kind defaulting to
+// scanner. Blank lines and anything after a # are ignored.
+func loadHitCIDRs(path string) ([]hitCIDR, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var cidrs []hitCIDR
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		parts := strings.Fields(line)
+		if len(parts) == 0 {
+			continue
+		}
+		prefix, err := parseIPFilter(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: bad cidr %q", path, n, parts[0])
+		}
+		kind := HitScanner
+		if len(parts) > 1 {
+			kind = parts[1]
+		}
+		if len(parts) > 2 || !validHitKind(kind) {
+			return nil, fmt.Errorf("%s:%d: want `cidr [kind]` with kind one of %s", path, n, strings.Join(hitKinds, ", "))
+		}
+		cidrs = append(cidrs, hitCIDR{prefix: prefix, kind: kind})
+	}
+	return cidrs, scanner.Err()
+}
+
+// parseAlertKinds reads the -alert-kinds flag.
+func parseAlertKinds(s string) (map[string]bool, error) {
+	out := map[string]bool{}
+	for _, kind := range strings.Split(s, ",") {
+		kind = strings.TrimSpace(kind)
+		if kind == "" {
+			continue
+		}
+		if !validHitKind(kind) {
+			return nil, fmt.Errorf("bad alert kind %q, want any of %s", kind, strings.Join(hitKinds, ", "))
+		}
+		out[kind] = true
+	}
+	if len(out) == 0 {
+		return nil, errors.New("-alert-kinds is empty, nothing would ever alert")
+	}
+	return out, nil
+}
+
+// ReloadOnHangup reloads the hit classification rules on every SIGHUP until
+// ctx is done.
+func (a *Application) ReloadOnHangup(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		}
+		if err := a.Classifier.Reload(); err != nil {
+			a.Logger.Error("could not reload hit rules, keeping the old ones", zap.Error(err))
+			continue
+		}
+		rules, cidrs := a.Classifier.Counts()
+		a.Logger.Info("reloaded hit rules", zap.Int("rules", rules), zap.Int("cidrs", cidrs))
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+const browserUA = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0 Safari/537.36"
+
+func writeTestFile(t *testing.T, name, content string) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestClassify(t *testing.T) {
+	rules := writeTestFile(t, "rules.json", `{"rules": [
+		{"name": "our gateway", "kind": "scanner", "header": "X-Gateway"},
+		{"name": "trusted slack", "kind": "human", "user_agent": "Slackbot", "header": "X-Trusted", "value": "^yes$"}
+	]}`)
+	cidrs := writeTestFile(t, "cidrs.txt", "# gateways\n198.51.100.0/24\n203.0.113.0/28 proxy # the office\n")
+	c, err := NewHitClassifier(rules, cidrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, n := c.Counts(); r != 2 || n != 2 {
+		t.Errorf("loaded %d rules and %d cidrs", r, n)
+	}
+	for _, tc := range []struct {
+		name    string
+		ip      string
+		headers map[string]string
+		want    string
+	}{
+		{"browser", "192.0.2.1", map[string]string{"User-Agent": browserUA}, HitHuman},
+		{"no user agent", "192.0.2.1", nil, HitUnknown},
+		{"curl", "192.0.2.1", map[string]string{"User-Agent": "curl/8.4.0"}, HitUnknown},
+		{"slack", "192.0.2.1", map[string]string{"User-Agent": "Slackbot-LinkExpanding 1.0"}, HitPreview},
+		{"slack trusted by a rule", "192.0.2.1", map[string]string{"User-Agent": "Slackbot 1.0", "X-Trusted": "yes"}, HitHuman},
+		{"slack with the wrong value", "192.0.2.1", map[string]string{"User-Agent": "Slackbot 1.0", "X-Trusted": "no"}, HitPreview},
+		{"google image proxy", "192.0.2.1", map[string]string{"User-Agent": "Mozilla/5.0 (via ggpht.com GoogleImageProxy)"}, HitProxy},
+		{"gateway user agent", "192.0.2.1", map[string]string{"User-Agent": "Mimecast URL Protect"}, HitScanner},
+		{"prefetch", "192.0.2.1", map[string]string{"User-Agent": browserUA, "Sec-Purpose": "prefetch;prerender"}, HitPreview},
+		{"header rule", "192.0.2.1", map[string]string{"User-Agent": browserUA, "X-Gateway": "1"}, HitScanner},
+		{"cidr beats user agent", "198.51.100.9", map[string]string{"User-Agent": browserUA}, HitScanner},
+		{"cidr with kind", "203.0.113.3", map[string]string{"User-Agent": browserUA}, HitProxy},
+		{"outside the cidr", "203.0.113.30", map[string]string{"User-Agent": browserUA}, HitHuman},
+		{"pseudonymized ip", "anon:0123456789abcdef", map[string]string{"User-Agent": browserUA}, HitHuman},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			for k, v := range tc.headers {
+				r.Header.Set(k, v)
+			}
+			if got := c.Classify(r, tc.ip); got != tc.want {
+				t.Errorf("got %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestLoadHitRules(t *testing.T) {
+	for name, raw := range map[string]string{
+		"bad json":     `{`,
+		"unknown kind": `{"rules": [{"kind": "robot", "user_agent": "x"}]}`,
+		"matches all":  `{"rules": [{"kind": "scanner"}]}`,
+		"bad regexp":   `{"rules": [{"kind": "scanner", "user_agent": "("}]}`,
+		"value only":   `{"rules": [{"kind": "scanner", "user_agent": "x", "value": "y"}]}`,
+		"bad value":    `{"rules": [{"kind": "scanner", "header": "X", "value": "("}]}`,
+	} {
+		if _, err := loadHitRules(writeTestFile(t, "rules.json", raw)); err == nil {
+			t.Errorf("%s: loaded", name)
+		}
+	}
+	for name, raw := range map[string]string{
+		"bad cidr":     "198.51.100.0/33\n",
+		"unknown kind": "198.51.100.0/24 robot\n",
+		"extra field":  "198.51.100.0/24 proxy more\n",
+	} {
+		if _, err := loadHitCIDRs(writeTestFile(t, "cidrs.txt", raw)); err == nil {
+			t.Errorf("%s: loaded", name)
+		}
+	}
+}
+
+func TestReloadKeepsRules(t *testing.T) {
+	rules := writeTestFile(t, "rules.json", `{"rules": [{"kind": "scanner", "header": "X-Gateway"}]}`)
+	c, err := NewHitClassifier(rules, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(rules, []byte(`{`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Reload(); err == nil {
+		t.Fatal("broken rules reloaded")
+	}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("User-Agent", browserUA)
+	r.Header.Set("X-Gateway", "1")
+	if got := c.Classify(r, "192.0.2.1"); got != HitScanner {
+		t.Errorf("lost the old rules: got %s", got)
+	}
+}
+
+func TestParseAlertKinds(t *testing.T) {
+	for raw, ok := range map[string]bool{
+		"human":          true,
+		"human, preview": true,
+		"human,,":        true,
+		"":               false,
+		" , ":            false,
+		"human,robot":    false,
+	} {
+		if _, err := parseAlertKinds(raw); ok != (err == nil) {
+			t.Errorf("%q: got %v", raw, err)
+		}
+	}
+}
+
+// TestBeaconAlerts checks only hits of an alerting kind page anyone, also
+// outside the armed window where the window decides the severity.
+func TestBeaconAlerts(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		ua       string
+		armAt    int64
+		alert    bool
+		severity string
+	}{
+		{"human", browserUA, 0, true, SeverityNormal},
+		{"scanner", "Mimecast URL Protect", 0, false, SeverityLow},
+		{"human outside the window", browserUA, time.Now().Add(time.Hour).Unix(), true, SeverityLow},
+		{"scanner outside the window", "Mimecast URL Protect", time.Now().Add(time.Hour).Unix(), false, SeverityLow},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			app := newTestApp(t)
+			core, logs := observer.New(zapcore.InfoLevel)
+			app.Logger = zap.New(core)
+			addTestTag(t, app, map[string]any{"id": testTagID, "hash": "h", "arm_at": tc.armAt})
+			r := httptest.NewRequest(http.MethodGet, "/"+testTagID, nil)
+			r.Header.Set("User-Agent", tc.ua)
+			serve(app, r)
+			if alerted := logs.FilterMessage("Tag accessed").Len() > 0; alerted != tc.alert {
+				t.Errorf("alerted %v, want %v", alerted, tc.alert)
+			}
+			page, err := app.DB.QueryAccessLogs(context.Background(), AccessLogQuery{TagID: testTagID})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(page.Logs) != 1 || page.Logs[0].Severity != tc.severity {
+				t.Errorf("got %+v, want one %s hit", page.Logs, tc.severity)
+			}
+		})
+	}
+}
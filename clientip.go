@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	trustedProxies = flag.String("trusted-proxies", "127.0.0.0/8,::1/128", "comma separated CIDRs of the proxies whose X-Forwarded-For, Forwarded and PROXY protocol headers are believed")
+	proxyProtocol  = flag.Bool("proxy-protocol", false, "accept HAProxy PROXY protocol v1 and v2 headers on connections from trusted proxies")
+)
+
+// parseTrustedProxies reads the -trusted-proxies flag. Bare addresses are
+// taken as single hosts.
+func parseTrustedProxies(s string) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		prefix, err := parseIPFilter(part)
+		if err != nil {
+			return nil, fmt.Errorf("bad trusted proxy %q", part)
+		}
+		out = append(out, prefix)
+	}
+	return out, nil
+}
+
+func trusted(proxies []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range proxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP works out who sent r. The peer is the client unless it is a
+// trusted proxy, in which case the forwarding chain is walked from the
+// right, past every trusted proxy, to the first address we can't vouch for.
+// Forwarded wins over X-Forwarded-For when a proxy sends both. Anything
+// left of that address could have been written by the client itself.
+func (a *Application) clientIP(r *http.Request) string {
+	peer := stripPort(r.RemoteAddr)
+	addr, ok := accessLogAddr(peer)
+	if !ok || !trusted(a.TrustedProxies, addr) {
+		return peer
+	}
+	var hops []string
+	if forwarded := r.Header.Values("Forwarded"); len(forwarded) > 0 {
+		hops = forwardedFor(strings.Join(forwarded, ","))
+	} else if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops = strings.Split(strings.Join(xff, ","), ",")
+	}
+	client := addr
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, ok := accessLogAddr(hops[i])
+		if !ok {
+			// unknown, an obfuscated name or junk: the trusted proxy that
+			// passed it on is as far as we can tell
+			break
+		}
+		client = hop
+		if !trusted(a.TrustedProxies, hop) {
+			break
+		}
+	}
+	return client.String()
+}
+
+// forwardedFor returns the for= values of an RFC 7239 Forwarded header,
+// one per element, quotes, brackets and ports left for accessLogAddr to
+// deal with.
+func forwardedFor(header string) []string {
+	var hops []string
+	for _, element := range splitQuoted(header, ',') {
+		hop := ""
+		for _, pair := range splitQuoted(element, ';') {
+			name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok || !strings.EqualFold(name, "for") {
+				continue
+			}
+			value = strings.TrimSpace(value)
+			if unquoted, err := strconv.Unquote(value); err == nil {
+				value = unquoted
+			}
+			// [2001:db8::1] and [2001:db8::1]:4711 both need the brackets
+			// gone or replaced by a host:port accessLogAddr understands
+			if strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]") {
+				value = value[1 : len(value)-1]
+			}
+			hop = value
+		}
+		hops = append(hops, hop)
+	}
+	return hops
+}
+
+// splitQuoted splits s on sep outside of double quoted strings.
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	quoted, escaped, start := false, false, 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case escaped:
+			escaped = false
+		case c == '\\' && quoted:
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case c == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// the PROXY protocol v2 signature, every v2 header starts with it
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyHeaderTimeout bounds how long a trusted proxy gets to send its
+// PROXY header before the connection is dropped.
+const proxyHeaderTimeout = 5 * time.Second
+
+// proxyListener reads PROXY protocol headers off connections from trusted
+// proxies. Other peers are handed through untouched, so a PROXY header
+// from them is just a malformed request.
+type proxyListener struct {
+	net.Listener
+	trusted []netip.Prefix
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	addr, ok := accessLogAddr(conn.RemoteAddr().String())
+	if !ok || !trusted(l.trusted, addr) {
+		return conn, nil
+	}
+	return &proxyConn{Conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// proxyConn reads the PROXY header on first use rather than in Accept, so
+// a slow proxy doesn't hold up every other connection. The header is
+// optional, a trusted peer that sends plain HTTP is its own client.
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.remote, c.err = readProxyHeader(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader consumes a v1 or v2 PROXY header if r starts with one and
+// returns the source address it names. A missing header, LOCAL and UNKNOWN
+// all give a nil address.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	start, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch start[0] {
+	case 'P':
+		if sig, err := r.Peek(6); err != nil || string(sig) != "PROXY " {
+			return nil, nil
+		}
+		return readProxyV1(r)
+	case '\r':
+		if sig, err := r.Peek(len(proxyV2Signature)); err != nil || !bytes.Equal(sig, proxyV2Signature) {
+			return nil, nil
+		}
+		return readProxyV2(r)
+	}
+	return nil, nil
+}
+
+var errBadProxyHeader = errors.New("malformed PROXY protocol header")
+
+// readProxyV1 parses `PROXY TCP4|TCP6|UNKNOWN src dst sport dport\r\n`,
+// at most 107 bytes long.
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < 107 {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errBadProxyHeader
+	}
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errBadProxyHeader
+	}
+	src, err := netip.ParseAddr(fields[2])
+	if err != nil || src.Is4() != (fields[1] == "TCP4") {
+		return nil, errBadProxyHeader
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, errBadProxyHeader
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, uint16(port))), nil
+}
+
+// readProxyV2 parses the binary header: signature, version and command,
+// family and protocol, a length, then the addresses and any TLVs, which are
+// skipped.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, errBadProxyHeader
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	switch header[12] & 0x0f {
+	case 0:
+		// LOCAL, the proxy talking for itself, health checks and such
+		return nil, nil
+	case 1:
+	default:
+		return nil, errBadProxyHeader
+	}
+	var size int
+	switch header[13] >> 4 {
+	case 1:
+		size = 4
+	case 2:
+		size = 16
+	default:
+		// AF_UNSPEC or a unix socket, nothing we can record
+		return nil, nil
+	}
+	if len(body) < 2*size+4 {
+		return nil, errBadProxyHeader
+	}
+	src, _ := netip.AddrFromSlice(body[:size])
+	port := binary.BigEndian.Uint16(body[2*size:])
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(src.Unmap(), port)), nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	got, err := parseTrustedProxies("10.0.0.0/8, 192.0.2.1,,::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"10.0.0.0/8", "192.0.2.1/32", "::1/128"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v", got)
+	}
+	for i, p := range got {
+		if p.String() != want[i] {
+			t.Errorf("%d: got %s, want %s", i, p, want[i])
+		}
+	}
+	if _, err := parseTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Error("bad cidr accepted")
+	}
+}
+
+func TestForwardedFor(t *testing.T) {
+	for header, want := range map[string][]string{
+		"for=192.0.2.60": {"192.0.2.60"},
+		`for=192.0.2.43, for="[2001:db8:cafe::17]:4711"`:  {"192.0.2.43", "[2001:db8:cafe::17]:4711"},
+		`For="[2001:db8::1]";proto=https;by=203.0.113.43`: {"2001:db8::1"},
+		`for=unknown, for=_hidden`:                        {"unknown", "_hidden"},
+		`proto=https, for="192.0.2.1;evil, for=10.0.0.1"`: {"", "192.0.2.1;evil, for=10.0.0.1"},
+		`for="\"quoted\""`:                                {`"quoted"`},
+	} {
+		got := forwardedFor(header)
+		if strings.Join(got, "|") != strings.Join(want, "|") {
+			t.Errorf("%s: got %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	app := newTestApp(t)
+	proxies, err := parseTrustedProxies("10.0.0.0/8,2001:db8:ffff::/48")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.TrustedProxies = proxies
+	for _, tc := range []struct {
+		name      string
+		peer      string
+		xff       []string
+		forwarded []string
+		want      string
+	}{
+		{"direct", "192.0.2.1:5000", nil, nil, "192.0.2.1"},
+		{"untrusted peer's header ignored", "192.0.2.1:5000", []string{"198.51.100.1"}, nil, "192.0.2.1"},
+		{"trusted proxy", "10.0.0.1:5000", []string{"198.51.100.1"}, nil, "198.51.100.1"},
+		{"forged left of the client", "10.0.0.1:5000", []string{"203.0.113.9, 198.51.100.1"}, nil, "198.51.100.1"},
+		{"chain of trusted proxies", "10.0.0.1:5000", []string{"198.51.100.1, 10.0.0.3", "10.0.0.2"}, nil, "198.51.100.1"},
+		{"all trusted", "10.0.0.1:5000", []string{"10.0.0.3"}, nil, "10.0.0.3"},
+		{"junk hop", "10.0.0.1:5000", []string{"198.51.100.1, garbage"}, nil, "10.0.0.1"},
+		{"no header from a proxy", "10.0.0.1:5000", nil, nil, "10.0.0.1"},
+		{"forwarded wins", "10.0.0.1:5000", []string{"198.51.100.1"}, []string{`for="[2001:db8::7]:4711"`}, "2001:db8::7"},
+		{"forwarded unknown", "10.0.0.1:5000", nil, []string{"for=unknown"}, "10.0.0.1"},
+		{"ipv6 proxy", "[2001:db8:ffff::1]:443", []string{"198.51.100.1"}, nil, "198.51.100.1"},
+		{"mapped hop", "10.0.0.1:5000", []string{"::ffff:198.51.100.1"}, nil, "198.51.100.1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tc.peer
+			for _, v := range tc.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			for _, v := range tc.forwarded {
+				r.Header.Add("Forwarded", v)
+			}
+			if got := app.clientIP(r); got != tc.want {
+				t.Errorf("got %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+// proxyV2 builds a v2 header for cmd and src:port, tlv appended to the
+// addresses.
+func proxyV2(cmd byte, src netip.AddrPort, tlv []byte) []byte {
+	var buf bytes.Buffer
+	buf.Write(proxyV2Signature)
+	buf.WriteByte(0x20 | cmd)
+	var addrs []byte
+	if src.Addr().Is4() {
+		buf.WriteByte(0x11)
+		addrs = append(addrs, src.Addr().AsSlice()...)
+		addrs = append(addrs, 10, 0, 0, 1)
+	} else {
+		buf.WriteByte(0x21)
+		addrs = append(addrs, src.Addr().AsSlice()...)
+		addrs = append(addrs, netip.MustParseAddr("2001:db8::ffff").AsSlice()...)
+	}
+	addrs = binary.BigEndian.AppendUint16(addrs, src.Port())
+	addrs = binary.BigEndian.AppendUint16(addrs, 443)
+	addrs = append(addrs, tlv...)
+	binary.Write(&buf, binary.BigEndian, uint16(len(addrs)))
+	buf.Write(addrs)
+	return buf.Bytes()
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v6 := proxyV2(1, netip.MustParseAddrPort("[2001:db8::7]:4711"), nil)
+	unix := proxyV2(1, netip.MustParseAddrPort("192.0.2.1:1"), nil)
+	unix[13] = 0x31
+	badVersion := proxyV2(1, netip.MustParseAddrPort("192.0.2.1:1"), nil)
+	badVersion[12] = 0x11
+	short := proxyV2(1, netip.MustParseAddrPort("192.0.2.1:1"), nil)
+	binary.BigEndian.PutUint16(short[14:], 4)
+	for _, tc := range []struct {
+		name   string
+		input  []byte
+		want   string
+		ok     bool
+		remain string
+	}{
+		{"plain http", []byte("GET / HTTP/1.1\r\n"), "", true, "GET / HTTP/1.1\r\n"},
+		{"post", []byte("POST / HTTP/1.1\r\n"), "", true, "POST / HTTP/1.1\r\n"},
+		{"v1 tcp4", []byte("PROXY TCP4 192.0.2.1 10.0.0.1 56324 443\r\nGET /"), "192.0.2.1:56324", true, "GET /"},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::7 2001:db8::1 4711 443\r\nGET /"), "[2001:db8::7]:4711", true, "GET /"},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\nGET /"), "", true, "GET /"},
+		{"v1 family mismatch", []byte("PROXY TCP4 2001:db8::7 10.0.0.1 1 443\r\n"), "", false, ""},
+		{"v1 bad port", []byte("PROXY TCP4 192.0.2.1 10.0.0.1 99999 443\r\n"), "", false, ""},
+		{"v1 no crlf", []byte("PROXY TCP4 192.0.2.1 10.0.0.1 1 443\n"), "", false, ""},
+		{"v1 too long", []byte("PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n"), "", false, ""},
+		{"v2 tcp4", append(proxyV2(1, netip.MustParseAddrPort("192.0.2.1:56324"), nil), "GET /"...), "192.0.2.1:56324", true, "GET /"},
+		{"v2 tcp6", append(v6, "GET /"...), "[2001:db8::7]:4711", true, "GET /"},
+		{"v2 with tlvs", append(proxyV2(1, netip.MustParseAddrPort("192.0.2.1:1"), []byte{0x04, 0, 2, 'h', 'i'}), "GET /"...), "192.0.2.1:1", true, "GET /"},
+		{"v2 local", append(proxyV2(0, netip.MustParseAddrPort("192.0.2.1:1"), nil), "GET /"...), "", true, "GET /"},
+		{"v2 unix", append(unix, "GET /"...), "", true, "GET /"},
+		{"v2 bad version", badVersion, "", false, ""},
+		{"v2 bad command", proxyV2(2, netip.MustParseAddrPort("192.0.2.1:1"), nil), "", false, ""},
+		{"v2 short addresses", short, "", false, ""},
+		{"v2 truncated", v6[:20], "", false, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := bufio.NewReader(bytes.NewReader(tc.input))
+			addr, err := readProxyHeader(r)
+			if tc.ok != (err == nil) {
+				t.Fatalf("got %v", err)
+			}
+			if !tc.ok {
+				return
+			}
+			got := ""
+			if addr != nil {
+				got = addr.String()
+			}
+			if got != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+			if rest, _ := io.ReadAll(r); string(rest) != tc.remain {
+				t.Errorf("left %q, want %q", rest, tc.remain)
+			}
+		})
+	}
+}
+
+// TestProxyListener sends a PROXY header over a real connection and checks
+// the server sees the address it names.
+func TestProxyListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	proxies, _ := parseTrustedProxies("127.0.0.0/8")
+	pl := &proxyListener{Listener: ln, trusted: proxies}
+	defer pl.Close()
+	seen := make(chan string, 1)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen <- r.RemoteAddr
+	})}
+	go srv.Serve(pl)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("PROXY TCP4 192.0.2.1 10.0.0.1 56324 80\r\nGET / HTTP/1.1\r\nHost: x\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-seen; got != "192.0.2.1:56324" {
+		t.Errorf("got %s", got)
+	}
+}
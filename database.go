@@ -2,26 +2,121 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"strings"
-	"time"
 
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+var (
+	ErrNotFound = errors.New("not found")
+	ErrConflict = errors.New("conflict")
+)
+
+// isTimeout reports whether err came from a database call running out of
+// time, as opposed to the record not existing or the query failing.
+func isTimeout(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) || pgconn.Timeout(err)
+}
+
+// pgTenantScope returns " AND cond" with the tenant of ctx added to args
+// as the placeholder in cond, or nothing when ctx isn't scoped.
+func pgTenantScope(ctx context.Context, cond string, args []any) (string, []any) {
+	tenant, ok := tenantFrom(ctx)
+	if !ok {
+		return "", args
+	}
+	args = append(args, tenant)
+	return " AND " + fmt.Sprintf(cond, fmt.Sprintf("$%d", len(args))), args
+}
+
+// tags of the tenant, for tables that only know the tag. tags.id is a uuid,
+// the TEXT tag_id columns (transitions, access logs) need pgTenantTagsText.
+const (
+	pgTenantTags     = "tag_id IN (SELECT id FROM tags WHERE tenant_id = %s)"
+	pgTenantTagsText = "tag_id IN (SELECT id::text FROM tags WHERE tenant_id = %s)"
+)
+
+// ConflictError is returned when a tag write expected a version the store
+// no longer has. Actual is 0 when the tag already existed on insert and its
+// version is unknown.
+type ConflictError struct {
+	ID       string
+	Expected int
+	Actual   int
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("tag %s was modified concurrently: expected version %d, have %d", e.ID, e.Expected, e.Actual)
+}
+
+func (e *ConflictError) Unwrap() error {
+	return ErrConflict
+}
+
+// Database is the storage behind the application. Called with a context
+// from WithTenant, an implementation only reads and changes the records of
+// that tenant.
 type Database interface {
-	InsertTag(tag *Tag) error
-	GetTag(id string) (*Tag, error)
-	GetTags() ([]*Tag, error)
-	UpdateTag(tag *Tag) error
-	DeleteTag(id string) error
-	AddAccessLog(log *AccessLog) error
-	GetAccessLogs(table string) ([]*AccessLog, error)
+	InsertTag(ctx context.Context, tag *Tag, change TagChange) error
+	GetTag(ctx context.Context, id string) (*Tag, error)
+	GetTags(ctx context.Context) ([]*Tag, error)
+	UpdateTag(ctx context.Context, tag *Tag, change TagChange) error
+	AddTagHistory(ctx context.Context, tagID string, item TagHistoryItem) error
+	GetTagHistory(ctx context.Context, q TagHistoryQuery) (*TagHistoryPage, error)
+	DeleteTag(ctx context.Context, id string) error
+	AddAccessLog(ctx context.Context, log *AccessLog) error
+	AddAccessLogs(ctx context.Context, logs []*AccessLog) error
+	QueryAccessLogs(ctx context.Context, q AccessLogQuery) (*AccessLogPage, error)
+	GetTagsByUsername(ctx context.Context, username string) ([]*Tag, error)
+	GetExpiredTags(ctx context.Context, now int) ([]*Tag, error)
+	DeleteTagHistory(ctx context.Context, tagID string) error
+	AddTagTransition(ctx context.Context, t TagTransition) error
+	GetTagTransitions(ctx context.Context, tagID string) ([]TagTransition, error)
+	DeleteAccessLogs(ctx context.Context, q AccessLogQuery) (int64, error)
+	GetRetentionPolicies(ctx context.Context) ([]*RetentionPolicy, error)
+	SaveRetentionPolicy(ctx context.Context, policy *RetentionPolicy) error
+	DeleteRetentionPolicy(ctx context.Context, id int64) error
+	GetCampaigns(ctx context.Context) ([]*Campaign, error)
+	GetCampaign(ctx context.Context, id int64) (*Campaign, error)
+	SaveCampaign(ctx context.Context, c *Campaign) error
+	DeleteCampaign(ctx context.Context, id int64) error
+	GetTagsByCampaign(ctx context.Context, id int64) ([]*Tag, error)
+	FindTags(ctx context.Context, f TagFilter) ([]*Tag, error)
+	GetTenants(ctx context.Context) ([]*Tenant, error)
+	AddTenant(ctx context.Context, t *Tenant) error
+	AddAPIKey(ctx context.Context, k *APIKey) error
+	GetAPIKey(ctx context.Context, hash string) (*APIKey, error)
+	GetAPIKeys(ctx context.Context) ([]*APIKey, error)
+	DeleteAPIKey(ctx context.Context, id int64) error
+}
+
+// NewDatabase picks a Database implementation based on the scheme of dsn.
+// memory:// gives an in-memory store, sqlite://path opens a SQLite file and
+// anything else is handed to pgx.
+func NewDatabase(dsn string) (Database, error) {
+	switch {
+	case strings.HasPrefix(dsn, "memory://"):
+		return NewMemoryDB(), nil
+	case strings.HasPrefix(dsn, "sqlite://"):
+		return NewSQLiteDB(strings.TrimPrefix(dsn, "sqlite://"))
+	default:
+		return NewPostgresDB(dsn)
+	}
 }
 
 type PostgresDB struct {
 	Pool *pgxpool.Pool
+	// Instance is sent as application_name so tag events this process
+	// caused can be told apart from everyone else's.
+	Instance string
+	// tx is set on the copy Snapshot hands out
+	tx pgx.Tx
 }
 
 func NewPostgresDB(dsn string) (*PostgresDB, error) {
@@ -29,148 +124,743 @@ func NewPostgresDB(dsn string) (*PostgresDB, error) {
 	if err != nil {
 		return nil, err
 	}
+	instance := "thelp-" + uuid.New().String()
+	cfg.ConnConfig.RuntimeParams["application_name"] = instance
 	pool, err := pgxpool.NewWithConfig(context.Background(), cfg)
 	if err != nil {
 		return nil, err
 	}
-	p := &PostgresDB{Pool: pool}
-	if err := p.createTables(); err != nil {
-		return nil, err
+	return &PostgresDB{Pool: pool, Instance: instance}, nil
+}
+
+// pgQuerier is the part of a pool or a transaction PostgresDB queries
+// through.
+type pgQuerier interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+	CopyFrom(ctx context.Context, table pgx.Identifier, columns []string, src pgx.CopyFromSource) (int64, error)
+	SendBatch(ctx context.Context, b *pgx.Batch) pgx.BatchResults
+	Begin(ctx context.Context) (pgx.Tx, error)
+}
+
+// conn is what queries go through, the pool or a Snapshot transaction.
+func (p *PostgresDB) conn() pgQuerier {
+	if p.tx != nil {
+		return p.tx
 	}
-	fmt.Println("PostgresDB created, cleaning old responses")
-	return p, nil
+	return p.Pool
 }
 
-func (p *PostgresDB) createTables() error {
-	_, err := p.Pool.Exec(context.Background(), `
-		CREATE TABLE IF NOT EXISTS tags (
-			id UUID PRIMARY KEY,
-			username TEXT,
-			file_path TEXT,
-			client_id TEXT,
-			hash TEXT,
-			url TEXT,
-			created INT,
-			history JSONB,
-			access JSONB
-		);
-	`)
-	return err
+// Snapshot runs fn against a copy of p that reads from one REPEATABLE READ,
+// read-only transaction, so everything fn sees is from the same moment.
+func (p *PostgresDB) Snapshot(ctx context.Context, fn func(Database) error) error {
+	opts := pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly}
+	return pgx.BeginTxFunc(ctx, p.Pool, opts, func(tx pgx.Tx) error {
+		return fn(&PostgresDB{Pool: p.Pool, Instance: p.Instance, tx: tx})
+	})
 }
 
-func (p *PostgresDB) InsertTag(tag *Tag) error {
-	_, err := p.Pool.Exec(context.Background(), `
-        INSERT INTO tags (id, username, file_path, client_id, hash, created, history)
-        VALUES ($1, $2, $3, $4, $5, $6, $7)
-        ON CONFLICT (id) DO NOTHING
-    `, tag.ID, tag.Username, tag.FilePath, tag.ClientID, tag.Hash, tag.Created, tag.History)
-	return err
+// InsertTag creates a tag at version 1. It returns a ConflictError if the
+// ID is already taken rather than silently keeping the old row.
+func (p *PostgresDB) InsertTag(ctx context.Context, tag *Tag, change TagChange) error {
+	var version int
+	err := pgx.BeginFunc(ctx, p.conn(), func(tx pgx.Tx) error {
+		err := tx.QueryRow(ctx, `
+			INSERT INTO tags (id, username, file_path, client_id, hash, created, version, username_index, arm_at, expires_at, expired_at, state, campaign_id, tenant_id, metadata, response, decoy)
+			VALUES ($1, $2, $3, $4, $5, $6, 1, NULLIF($7, ''), $8, $9, $10, $11, NULLIF($12, 0), $13, $14::jsonb, $15, $16)
+			ON CONFLICT (id) DO NOTHING
+			RETURNING version
+		`, tag.ID, tag.Username, tag.FilePath, tag.ClientID, tag.Hash, tag.Created, tag.UsernameIndex, tag.ArmAt, tag.ExpiresAt, tag.ExpiredAt, tag.lifecycle(), tag.CampaignID,
+			tenantFor(ctx, tag.TenantID), tag.TagMetadata.encode(), tag.Response, tag.Decoy).Scan(&version)
+		if err != nil {
+			return err
+		}
+		return pgRecordTagChange(ctx, tx, tag.ID, change)
+	})
+	if errors.Is(err, pgx.ErrNoRows) {
+		return &ConflictError{ID: tag.ID, Expected: 0, Actual: p.tagVersion(ctx, tag.ID)}
+	}
+	if err != nil {
+		return err
+	}
+	tag.Version, tag.TenantID = version, tenantFor(ctx, tag.TenantID)
+	return nil
 }
 
-func (p *PostgresDB) GetTag(id string) (*Tag, error) {
-	var tag Tag
-	err := p.Pool.QueryRow(context.Background(), `
-		SELECT id, username, file_path, client_id, hash, created, history
-		FROM tags
-		WHERE id = $1
-	`, id).Scan(&tag.ID, &tag.Username, &tag.FilePath, &tag.ClientID, &tag.Hash, &tag.Created, &tag.History)
+// tagVersion is a best effort lookup used to fill in conflict errors. A
+// tag of another tenant reads as missing.
+func (p *PostgresDB) tagVersion(ctx context.Context, id string) int {
+	var version int
+	scope, args := pgTenantScope(ctx, "tenant_id = %s", []any{id})
+	p.conn().QueryRow(ctx, `SELECT version FROM tags WHERE id = $1`+scope, args...).Scan(&version)
+	return version
+}
+
+func (p *PostgresDB) GetTag(ctx context.Context, id string) (*Tag, error) {
+	scope, args := pgTenantScope(ctx, "tenant_id = %s", []any{id})
+	tag, err := scanPgTag(p.conn().QueryRow(ctx, `SELECT `+pgTagColumns+` FROM tags WHERE id = $1`+scope, args...))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	tag.History, err = recentTagHistory(ctx, p, id)
 	if err != nil {
 		return nil, err
 	}
-	return &tag, err
+	return tag, nil
+}
+
+func (p *PostgresDB) GetTags(ctx context.Context) ([]*Tag, error) {
+	scope, args := pgTenantScope(ctx, "tenant_id = %s", nil)
+	return p.queryTags(ctx, `SELECT `+pgTagColumns+` FROM tags WHERE true`+scope, args...)
+}
+
+// GetTagsByUsername matches either the plaintext username or its blind
+// index, see EncryptedDB.
+func (p *PostgresDB) GetTagsByUsername(ctx context.Context, username string) ([]*Tag, error) {
+	scope, args := pgTenantScope(ctx, "tenant_id = %s", []any{username})
+	return p.queryTags(ctx, `
+		SELECT `+pgTagColumns+` FROM tags
+		WHERE (username = $1 OR username_index = $1)`+scope+`
+		ORDER BY created
+	`, args...)
+}
+
+func (p *PostgresDB) GetTagsByCampaign(ctx context.Context, id int64) ([]*Tag, error) {
+	scope, args := pgTenantScope(ctx, "tenant_id = %s", []any{id})
+	return p.queryTags(ctx, `
+		SELECT `+pgTagColumns+` FROM tags
+		WHERE campaign_id = $1`+scope+`
+		ORDER BY created
+	`, args...)
+}
+
+// FindTags returns the tags whose metadata matches f, going through the
+// GIN index on metadata.
+func (p *PostgresDB) FindTags(ctx context.Context, f TagFilter) ([]*Tag, error) {
+	scope, args := pgTenantScope(ctx, "tenant_id = %s", []any{f.containment()})
+	return p.queryTags(ctx, `
+		SELECT `+pgTagColumns+` FROM tags
+		WHERE metadata @> $1::jsonb`+scope+`
+		ORDER BY created
+	`, args...)
+}
+
+// GetExpiredTags returns the tags whose expires_at has passed at now but
+// that the sweeper hasn't marked yet.
+func (p *PostgresDB) GetExpiredTags(ctx context.Context, now int) ([]*Tag, error) {
+	scope, args := pgTenantScope(ctx, "tenant_id = %s", []any{now})
+	return p.queryTags(ctx, `
+		SELECT `+pgTagColumns+` FROM tags
+		WHERE expires_at <> 0 AND expired_at = 0 AND expires_at <= $1`+scope, args...)
 }
 
-func (p *PostgresDB) GetTags() ([]*Tag, error) {
-	rows, err := p.Pool.Query(context.Background(), `
-		SELECT id, username, file_path, client_id, hash, created, history
-		FROM tags
-	`)
+func (p *PostgresDB) queryTags(ctx context.Context, query string, args ...any) ([]*Tag, error) {
+	rows, err := p.conn().Query(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 	var tags []*Tag
 	for rows.Next() {
-		var tag Tag
-		if err := rows.Scan(&tag.ID, &tag.Username, &tag.FilePath, &tag.ClientID, &tag.Hash, &tag.Created, &tag.History); err != nil {
+		tag, err := scanPgTag(rows)
+		if err != nil {
 			return nil, err
 		}
-		tags = append(tags, &tag)
+		tags = append(tags, tag)
 	}
-	return tags, nil
+	return tags, rows.Err()
 }
 
-func (p *PostgresDB) UpdateTag(tag *Tag) error {
-	_, err := p.Pool.Exec(context.Background(), `
-		UPDATE tags
-		SET client_id = $2, hash = $3, created = $4, history = $5, username = $6, file_path = $7
-		WHERE id = $1
-	`, tag.ID, tag.ClientID, tag.Hash, tag.Created, tag.History, tag.Username, tag.FilePath)
+const pgTagColumns = `id, username, file_path, client_id, hash, created, version, COALESCE(username_index, ''), arm_at, expires_at, expired_at, state, COALESCE(campaign_id, 0), tenant_id, metadata, response, decoy`
+
+func scanPgTag(row pgx.Row) (*Tag, error) {
+	var tag Tag
+	var metadata []byte
+	if err := row.Scan(&tag.ID, &tag.Username, &tag.FilePath, &tag.ClientID, &tag.Hash, &tag.Created, &tag.Version, &tag.UsernameIndex, &tag.ArmAt, &tag.ExpiresAt, &tag.ExpiredAt, &tag.State, &tag.CampaignID, &tag.TenantID, &metadata, &tag.Response, &tag.Decoy); err != nil {
+		return nil, err
+	}
+	var err error
+	if tag.TagMetadata, err = decodeTagMetadata(metadata); err != nil {
+		return nil, fmt.Errorf("tag %s has bad metadata: %v", tag.ID, err)
+	}
+	return &tag, nil
+}
+
+// UpdateTag writes tag only if the stored version still matches
+// tag.Version, then bumps it. A mismatch returns a ConflictError and a
+// missing row ErrNotFound.
+func (p *PostgresDB) UpdateTag(ctx context.Context, tag *Tag, change TagChange) error {
+	var version int
+	scope, args := pgTenantScope(ctx, "tenant_id = %s", []any{tag.ID, tag.ClientID, tag.Hash, tag.Created, tag.Username, tag.FilePath, tag.Version,
+		tag.UsernameIndex, tag.ArmAt, tag.ExpiresAt, tag.ExpiredAt, tag.lifecycle(), tag.CampaignID, tag.TagMetadata.encode(), tag.Response, tag.Decoy})
+	err := pgx.BeginFunc(ctx, p.conn(), func(tx pgx.Tx) error {
+		err := tx.QueryRow(ctx, `
+			UPDATE tags
+			SET client_id = $2, hash = $3, created = $4, username = $5, file_path = $6, version = version + 1,
+				username_index = NULLIF($8, ''), arm_at = $9, expires_at = $10, expired_at = $11, state = $12,
+				campaign_id = NULLIF($13, 0), metadata = $14::jsonb, response = $15, decoy = $16
+			WHERE id = $1 AND version = $7`+scope+`
+			RETURNING version
+		`, args...).Scan(&version)
+		if err != nil {
+			return err
+		}
+		return pgRecordTagChange(ctx, tx, tag.ID, change)
+	})
+	if errors.Is(err, pgx.ErrNoRows) {
+		actual := p.tagVersion(ctx, tag.ID)
+		if actual == 0 {
+			return ErrNotFound
+		}
+		return &ConflictError{ID: tag.ID, Expected: tag.Version, Actual: actual}
+	}
+	if err != nil {
+		return err
+	}
+	tag.Version = version
+	return nil
+}
+
+func (p *PostgresDB) AddTagHistory(ctx context.Context, tagID string, item TagHistoryItem) error {
+	return pgAddTagHistory(ctx, p.Pool, tagID, item)
+}
+
+func pgAddTagHistory(ctx context.Context, q pgQuerier, tagID string, item TagHistoryItem) error {
+	_, err := q.Exec(ctx, `
+		INSERT INTO tag_history (tag_id, client_id, hash, created)
+		VALUES ($1, $2, $3, $4)
+	`, tagID, item.ClientID, item.Hash, item.Created)
+	return err
+}
+
+// pgRecordTagChange writes what goes with a tag write in its transaction.
+func pgRecordTagChange(ctx context.Context, tx pgx.Tx, tagID string, change TagChange) error {
+	if change.History != nil {
+		if err := pgAddTagHistory(ctx, tx, tagID, *change.History); err != nil {
+			return err
+		}
+	}
+	if change.Transition != nil {
+		t := *change.Transition
+		t.TagID = tagID
+		return pgAddTagTransition(ctx, tx, t)
+	}
+	return nil
+}
+
+func (p *PostgresDB) GetTagHistory(ctx context.Context, q TagHistoryQuery) (*TagHistoryPage, error) {
+	cursor, err := q.normalize()
+	if err != nil {
+		return nil, err
+	}
+	order, cmp := "ASC", ">"
+	if q.Descending {
+		order, cmp = "DESC", "<"
+	}
+	args := []any{q.TagID, q.Limit + 1}
+	query := `SELECT id, client_id, hash, created FROM tag_history WHERE tag_id = $1`
+	if cursor != 0 {
+		query += fmt.Sprintf(" AND id %s $3", cmp)
+		args = append(args, cursor)
+	}
+	scope, args := pgTenantScope(ctx, pgTenantTags, args)
+	query += scope + fmt.Sprintf(" ORDER BY id %s LIMIT $2", order)
+	rows, err := p.conn().Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []TagHistoryItem
+	for rows.Next() {
+		var item TagHistoryItem
+		var clientID, hash *string
+		if err := rows.Scan(&item.ID, &clientID, &hash, &item.Created); err != nil {
+			return nil, err
+		}
+		if clientID != nil {
+			item.ClientID = *clientID
+		}
+		if hash != nil {
+			item.Hash = *hash
+		}
+		items = append(items, item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return q.page(items), nil
+}
+
+func (p *PostgresDB) AddTagTransition(ctx context.Context, t TagTransition) error {
+	return pgAddTagTransition(ctx, p.conn(), t)
+}
+
+func pgAddTagTransition(ctx context.Context, q pgQuerier, t TagTransition) error {
+	_, err := q.Exec(ctx, `
+		INSERT INTO tag_transitions (tag_id, from_state, to_state, actor, reason, created)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, t.TagID, t.From, t.To, t.Actor, t.Reason, t.Created)
 	return err
 }
 
-func (p *PostgresDB) DeleteTag(id string) error {
-	_, err := p.Pool.Exec(context.Background(), `
+func (p *PostgresDB) GetTagTransitions(ctx context.Context, tagID string) ([]TagTransition, error) {
+	scope, args := pgTenantScope(ctx, pgTenantTagsText, []any{tagID})
+	rows, err := p.conn().Query(ctx, `
+		SELECT id, tag_id, from_state, to_state, COALESCE(actor, ''), COALESCE(reason, ''), created
+		FROM tag_transitions
+		WHERE tag_id = $1`+scope+`
+		ORDER BY id
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	transitions := []TagTransition{}
+	for rows.Next() {
+		var t TagTransition
+		if err := rows.Scan(&t.ID, &t.TagID, &t.From, &t.To, &t.Actor, &t.Reason, &t.Created); err != nil {
+			return nil, err
+		}
+		transitions = append(transitions, t)
+	}
+	return transitions, rows.Err()
+}
+
+// DeleteTagHistory drops the audit trail of a tag, its history and state
+// transitions. DeleteTag leaves it alone on purpose, this is for erasure
+// requests.
+func (p *PostgresDB) DeleteTagHistory(ctx context.Context, tagID string) error {
+	scope, args := pgTenantScope(ctx, pgTenantTags, []any{tagID})
+	textScope, _ := pgTenantScope(ctx, pgTenantTagsText, []any{tagID})
+	return pgx.BeginFunc(ctx, p.conn(), func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `DELETE FROM tag_history WHERE tag_id = $1`+scope, args...); err != nil {
+			return err
+		}
+		_, err := tx.Exec(ctx, `DELETE FROM tag_transitions WHERE tag_id = $1`+textScope, args...)
+		return err
+	})
+}
+
+func (p *PostgresDB) DeleteTag(ctx context.Context, id string) error {
+	scope, args := pgTenantScope(ctx, "tenant_id = %s", []any{id})
+	_, err := p.conn().Exec(ctx, `
 		DELETE FROM tags
-		WHERE id = $1
-	`, id)
+		WHERE id = $1`+scope, args...)
 	return err
 }
 
-func (p *PostgresDB) AddAccessLog(log *AccessLog) error {
-	currentTime := time.Now()
-	month := strings.ToLower(currentTime.Format("Jan"))
-	year := currentTime.Format("2006")
-	tableName := fmt.Sprintf("access_logs_%s_%s", month, year)
-
-	// First, create the table if it doesn't exist
-	createQuery := fmt.Sprintf(`
-        CREATE TABLE IF NOT EXISTS %s (
-            id SERIAL PRIMARY KEY,
-            ip TEXT,
-            user_agent TEXT,
-            timestamp INT,
-            tag_id TEXT
-        )`, tableName)
-	_, err := p.Pool.Exec(context.Background(), createQuery)
-	if err != nil {
-		return fmt.Errorf("failed to create table: %v", err)
-	}
-
-	// Then, insert the data
-	insertQuery := fmt.Sprintf(`
-        INSERT INTO %s (ip, user_agent, timestamp, tag_id)
-        VALUES ($1, $2, $3, $4)`, tableName)
-	_, err = p.Pool.Exec(context.Background(), insertQuery,
-		log.IP,
-		log.UserAgent,
-		log.Timestamp,
-		log.TagID,
-	)
+func (p *PostgresDB) AddAccessLog(ctx context.Context, log *AccessLog) error {
+	args := append([]any{log.IP, log.UserAgent, log.Timestamp, log.TagID, log.severity(), tenantFor(ctx, log.TenantID), encodeLogFields(log.Fields), log.kind(), log.ForwardedFor, log.Forwarded}, log.Geo.values()...)
+	_, err := p.conn().Exec(ctx, `
+		INSERT INTO access_logs (ip, user_agent, timestamp, tag_id, severity, tenant_id, fields, kind, forwarded_for, forwarded, `+geoColumnList+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
+	`, args...)
 	if err != nil {
 		return fmt.Errorf("failed to insert log: %v", err)
 	}
+	return nil
+}
 
+// AddAccessLogs writes a batch of hits with COPY.
+func (p *PostgresDB) AddAccessLogs(ctx context.Context, logs []*AccessLog) error {
+	if len(logs) == 0 {
+		return nil
+	}
+	_, err := p.conn().CopyFrom(ctx,
+		pgx.Identifier{"access_logs"},
+		append([]string{"ip", "user_agent", "timestamp", "tag_id", "severity", "tenant_id", "fields", "kind", "forwarded_for", "forwarded"}, geoColumns...),
+		pgx.CopyFromSlice(len(logs), func(i int) ([]any, error) {
+			row := []any{logs[i].IP, logs[i].UserAgent, logs[i].Timestamp, logs[i].TagID, logs[i].severity(), tenantFor(ctx, logs[i].TenantID), encodeLogFields(logs[i].Fields), logs[i].kind(), logs[i].ForwardedFor, logs[i].Forwarded}
+			return append(row, logs[i].Geo.values()...), nil
+		}),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to copy logs: %v", err)
+	}
 	return nil
 }
 
-func (p *PostgresDB) GetAccessLogs(table string) ([]*AccessLog, error) {
-	rows, err := p.Pool.Query(context.Background(), `
-		SELECT ip, user_agent, timestamp, tag_id
-		FROM access_logs_%s
-	`, table)
+// pgAccessLogFilters turns the tag and time filters of q into SQL, adding
+// parameters through arg.
+func pgAccessLogFilters(q AccessLogQuery, arg func(any) string) []string {
+	var where []string
+	if q.TenantID != "" {
+		where = append(where, "tenant_id = "+arg(q.TenantID))
+	}
+	if q.TagID != "" {
+		where = append(where, "tag_id = "+arg(q.TagID))
+	}
+	if len(q.ExcludeTagIDs) > 0 {
+		where = append(where, "(tag_id IS NULL OR tag_id <> ALL("+arg(q.ExcludeTagIDs)+"::text[]))")
+	}
+	if !q.Tags.empty() {
+		where = append(where, "tag_id IN (SELECT id::text FROM tags WHERE metadata @> "+arg(q.Tags.containment())+"::jsonb)")
+	}
+	if q.Severity != "" {
+		where = append(where, "severity = "+arg(q.Severity))
+	}
+	if q.Kind != "" {
+		where = append(where, "kind = "+arg(q.Kind))
+	}
+	if q.Since != 0 {
+		where = append(where, "timestamp >= "+arg(q.Since))
+	}
+	if q.Until != 0 {
+		where = append(where, "timestamp < "+arg(q.Until))
+	}
+	return where
+}
+
+// DeleteAccessLogs removes the logs matching the tag and time filters of q
+// and reports how many went.
+func (p *PostgresDB) DeleteAccessLogs(ctx context.Context, q AccessLogQuery) (int64, error) {
+	if err := q.deletable(); err != nil {
+		return 0, err
+	}
+	q.scope(ctx)
+	var args []any
+	arg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	where := pgAccessLogFilters(q, arg)
+	res, err := p.conn().Exec(ctx, `DELETE FROM access_logs WHERE `+strings.Join(where, " AND "), args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected(), nil
+}
+
+func (p *PostgresDB) QueryAccessLogs(ctx context.Context, q AccessLogQuery) (*AccessLogPage, error) {
+	cursor, prefix, err := q.normalize()
+	if err != nil {
+		return nil, err
+	}
+	q.scope(ctx)
+	var args []any
+	arg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	where := pgAccessLogFilters(q, arg)
+	if prefix != nil {
+		where = append(where, "access_log_inet(ip) <<= "+arg(prefix.String())+"::cidr")
+	}
+	if q.UserAgent != "" {
+		where = append(where, "strpos(lower(user_agent), lower("+arg(q.UserAgent)+")) > 0")
+	}
+	if q.Country != "" {
+		where = append(where, "geo_country = "+arg(q.Country))
+	}
+	if q.ASN != 0 {
+		where = append(where, "geo_asn = "+arg(int64(q.ASN)))
+	}
+	order, cmp := "ASC", ">"
+	if q.Descending {
+		order, cmp = "DESC", "<"
+	}
+	if cursor != nil {
+		where = append(where, fmt.Sprintf("(timestamp, id) %s (%s, %s)", cmp, arg(cursor.Timestamp), arg(cursor.ID)))
+	}
+	query := `SELECT id, ip, user_agent, timestamp, tag_id, severity, tenant_id, fields, kind, forwarded_for, forwarded, ` + geoColumnList + ` FROM access_logs`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += fmt.Sprintf(" ORDER BY timestamp %s, id %s LIMIT %s", order, order, arg(q.Limit+1))
+
+	rows, err := p.conn().Query(ctx, query, args...)
 	if err != nil {
-		log.Println("GetAccessLogs error getting access logs", err)
+		log.Println("QueryAccessLogs error getting access logs", err)
 		return nil, err
 	}
 	defer rows.Close()
 	var logs []*AccessLog
 	for rows.Next() {
 		var log AccessLog
-		if err := rows.Scan(&log.IP, &log.UserAgent, &log.Timestamp, &log.TagID); err != nil {
+		var ip, userAgent, tagID *string
+		var fields []byte
+		var geo geoScan
+		dest := append([]any{&log.ID, &ip, &userAgent, &log.Timestamp, &tagID, &log.Severity, &log.TenantID, &fields, &log.Kind, &log.ForwardedFor, &log.Forwarded}, geo.dest()...)
+		if err := rows.Scan(dest...); err != nil {
 			return nil, err
 		}
+		log.Fields = decodeLogFields(fields)
+		log.Geo = geo.info()
+		if ip != nil {
+			log.IP = *ip
+		}
+		if userAgent != nil {
+			log.UserAgent = *userAgent
+		}
+		if tagID != nil {
+			log.TagID = *tagID
+		}
 		logs = append(logs, &log)
 	}
-	return logs, nil
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return q.page(logs), nil
+}
+
+// RewriteTag replaces the stored username, its index and the file path
+// without bumping the version. It is meant for key rotation, not edits.
+func (p *PostgresDB) RewriteTag(ctx context.Context, tag *Tag) error {
+	res, err := p.conn().Exec(ctx, `
+		UPDATE tags SET username = $2, username_index = NULLIF($3, ''), file_path = $4
+		WHERE id = $1
+	`, tag.ID, tag.Username, tag.UsernameIndex, tag.FilePath)
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// RewriteAccessLogs replaces the ip, user agent, forwarding headers,
+// fields and location of existing logs in one round trip. timestamp is in
+// the WHERE so each update only touches its own partition.
+func (p *PostgresDB) RewriteAccessLogs(ctx context.Context, logs []*AccessLog) error {
+	set := make([]string, len(geoColumns))
+	for i, column := range geoColumns {
+		set[i] = fmt.Sprintf("%s = $%d", column, i+8)
+	}
+	query := `
+			UPDATE access_logs SET ip = $1, user_agent = $2, fields = $3, forwarded_for = $4, forwarded = $5, ` + strings.Join(set, ", ") + `
+			WHERE id = $6 AND timestamp = $7`
+	batch := &pgx.Batch{}
+	for _, log := range logs {
+		args := []any{log.IP, log.UserAgent, encodeLogFields(log.Fields), log.ForwardedFor, log.Forwarded, log.ID, log.Timestamp}
+		batch.Queue(query, append(args, log.Geo.values()...)...)
+	}
+	return p.conn().SendBatch(ctx, batch).Close()
+}
+
+func (p *PostgresDB) GetRetentionPolicies(ctx context.Context) ([]*RetentionPolicy, error) {
+	scope, args := pgTenantScope(ctx, "tenant_id = %s", nil)
+	rows, err := p.conn().Query(ctx, `
+		SELECT id, tenant_id, COALESCE(tag_id, ''), action, after_days, drop_user_agent, applied_until, created
+		FROM retention_policies
+		WHERE true`+scope+`
+		ORDER BY after_days, id
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var policies []*RetentionPolicy
+	for rows.Next() {
+		var policy RetentionPolicy
+		if err := rows.Scan(&policy.ID, &policy.TenantID, &policy.TagID, &policy.Action, &policy.AfterDays, &policy.DropUserAgent, &policy.AppliedUntil, &policy.Created); err != nil {
+			return nil, err
+		}
+		policies = append(policies, &policy)
+	}
+	return policies, rows.Err()
+}
+
+// SaveRetentionPolicy inserts policy when it has no ID yet and overwrites
+// the stored one otherwise.
+func (p *PostgresDB) SaveRetentionPolicy(ctx context.Context, policy *RetentionPolicy) error {
+	if policy.ID == 0 {
+		policy.TenantID = tenantFor(ctx, policy.TenantID)
+		return p.conn().QueryRow(ctx, `
+			INSERT INTO retention_policies (tenant_id, tag_id, action, after_days, drop_user_agent, applied_until, created)
+			VALUES ($1, NULLIF($2, ''), $3, $4, $5, $6, $7)
+			RETURNING id
+		`, policy.TenantID, policy.TagID, policy.Action, policy.AfterDays, policy.DropUserAgent, policy.AppliedUntil, policy.Created).Scan(&policy.ID)
+	}
+	scope, args := pgTenantScope(ctx, "tenant_id = %s", []any{policy.ID, policy.TagID, policy.Action, policy.AfterDays, policy.DropUserAgent, policy.AppliedUntil})
+	res, err := p.conn().Exec(ctx, `
+		UPDATE retention_policies
+		SET tag_id = NULLIF($2, ''), action = $3, after_days = $4, drop_user_agent = $5, applied_until = $6
+		WHERE id = $1`+scope, args...)
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (p *PostgresDB) DeleteRetentionPolicy(ctx context.Context, id int64) error {
+	scope, args := pgTenantScope(ctx, "tenant_id = %s", []any{id})
+	res, err := p.conn().Exec(ctx, `DELETE FROM retention_policies WHERE id = $1`+scope, args...)
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+const pgCampaignColumns = `id, tenant_id, name, owner, description, default_state, default_arm_at, default_expires_at, created`
+
+func scanPgCampaign(row pgx.Row) (*Campaign, error) {
+	var c Campaign
+	if err := row.Scan(&c.ID, &c.TenantID, &c.Name, &c.Owner, &c.Description, &c.DefaultState, &c.DefaultArmAt, &c.DefaultExpiresAt, &c.Created); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (p *PostgresDB) GetCampaigns(ctx context.Context) ([]*Campaign, error) {
+	scope, args := pgTenantScope(ctx, "tenant_id = %s", nil)
+	rows, err := p.conn().Query(ctx, `SELECT `+pgCampaignColumns+` FROM campaigns WHERE true`+scope+` ORDER BY id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var campaigns []*Campaign
+	for rows.Next() {
+		c, err := scanPgCampaign(rows)
+		if err != nil {
+			return nil, err
+		}
+		campaigns = append(campaigns, c)
+	}
+	return campaigns, rows.Err()
+}
+
+func (p *PostgresDB) GetCampaign(ctx context.Context, id int64) (*Campaign, error) {
+	scope, args := pgTenantScope(ctx, "tenant_id = %s", []any{id})
+	c, err := scanPgCampaign(p.conn().QueryRow(ctx, `SELECT `+pgCampaignColumns+` FROM campaigns WHERE id = $1`+scope, args...))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return c, err
+}
+
+// SaveCampaign inserts c when it has no ID yet and overwrites the stored
+// one otherwise.
+func (p *PostgresDB) SaveCampaign(ctx context.Context, c *Campaign) error {
+	if c.ID == 0 {
+		c.TenantID = tenantFor(ctx, c.TenantID)
+		return p.conn().QueryRow(ctx, `
+			INSERT INTO campaigns (tenant_id, name, owner, description, default_state, default_arm_at, default_expires_at, created)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+			RETURNING id
+		`, c.TenantID, c.Name, c.Owner, c.Description, c.DefaultState, c.DefaultArmAt, c.DefaultExpiresAt, c.Created).Scan(&c.ID)
+	}
+	scope, args := pgTenantScope(ctx, "tenant_id = %s", []any{c.ID, c.Name, c.Owner, c.Description, c.DefaultState, c.DefaultArmAt, c.DefaultExpiresAt})
+	res, err := p.conn().Exec(ctx, `
+		UPDATE campaigns
+		SET name = $2, owner = $3, description = $4, default_state = $5, default_arm_at = $6, default_expires_at = $7
+		WHERE id = $1`+scope, args...)
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DeleteCampaign removes a campaign, its tags stay but lose the link.
+func (p *PostgresDB) DeleteCampaign(ctx context.Context, id int64) error {
+	scope, args := pgTenantScope(ctx, "tenant_id = %s", []any{id})
+	res, err := p.conn().Exec(ctx, `DELETE FROM campaigns WHERE id = $1`+scope, args...)
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (p *PostgresDB) GetTenants(ctx context.Context) ([]*Tenant, error) {
+	rows, err := p.conn().Query(ctx, `SELECT id, name, created FROM tenants ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tenants []*Tenant
+	for rows.Next() {
+		var t Tenant
+		if err := rows.Scan(&t.ID, &t.Name, &t.Created); err != nil {
+			return nil, err
+		}
+		tenants = append(tenants, &t)
+	}
+	return tenants, rows.Err()
+}
+
+// AddTenant creates t, an existing ID is ErrConflict.
+func (p *PostgresDB) AddTenant(ctx context.Context, t *Tenant) error {
+	res, err := p.conn().Exec(ctx, `
+		INSERT INTO tenants (id, name, created) VALUES ($1, $2, $3)
+		ON CONFLICT (id) DO NOTHING
+	`, t.ID, t.Name, t.Created)
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() == 0 {
+		return fmt.Errorf("%w: tenant %s exists", ErrConflict, t.ID)
+	}
+	return nil
+}
+
+func (p *PostgresDB) AddAPIKey(ctx context.Context, k *APIKey) error {
+	return p.conn().QueryRow(ctx, `
+		INSERT INTO api_keys (tenant_id, key_hash, label, created) VALUES ($1, $2, $3, $4)
+		RETURNING id
+	`, k.TenantID, k.Hash, k.Label, k.Created).Scan(&k.ID)
+}
+
+// GetAPIKey finds a key by its hash, whatever tenant ctx is scoped to.
+func (p *PostgresDB) GetAPIKey(ctx context.Context, hash string) (*APIKey, error) {
+	var k APIKey
+	err := p.conn().QueryRow(ctx, `
+		SELECT id, tenant_id, key_hash, label, created FROM api_keys WHERE key_hash = $1
+	`, hash).Scan(&k.ID, &k.TenantID, &k.Hash, &k.Label, &k.Created)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+func (p *PostgresDB) GetAPIKeys(ctx context.Context) ([]*APIKey, error) {
+	scope, args := pgTenantScope(ctx, "tenant_id = %s", nil)
+	rows, err := p.conn().Query(ctx, `
+		SELECT id, tenant_id, key_hash, label, created FROM api_keys
+		WHERE true`+scope+`
+		ORDER BY id
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []*APIKey
+	for rows.Next() {
+		var k APIKey
+		if err := rows.Scan(&k.ID, &k.TenantID, &k.Hash, &k.Label, &k.Created); err != nil {
+			return nil, err
+		}
+		keys = append(keys, &k)
+	}
+	return keys, rows.Err()
+}
+
+func (p *PostgresDB) DeleteAPIKey(ctx context.Context, id int64) error {
+	scope, args := pgTenantScope(ctx, "tenant_id = %s", []any{id})
+	res, err := p.conn().Exec(ctx, `DELETE FROM api_keys WHERE id = $1`+scope, args...)
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
 }
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// forEachBackend runs fn against a fresh MemoryDB, a migrated SQLite file
+// and, when THELP_TEST_POSTGRES names a scratch database, Postgres. The
+// Postgres tables are emptied first, don't point it at anything you want
+// to keep.
+func forEachBackend(t *testing.T, fn func(t *testing.T, db Database)) {
+	t.Run("memory", func(t *testing.T) {
+		fn(t, NewMemoryDB())
+	})
+	t.Run("sqlite", func(t *testing.T) {
+		fn(t, newTestSQLiteDB(t))
+	})
+	t.Run("postgres", func(t *testing.T) {
+		dsn := os.Getenv("THELP_TEST_POSTGRES")
+		if dsn == "" {
+			t.Skip("THELP_TEST_POSTGRES not set")
+		}
+		db, err := NewPostgresDB(dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(db.Pool.Close)
+		if err := db.MigrateUp(0); err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Pool.Exec(context.Background(), `TRUNCATE tags, tag_history, tag_transitions, access_logs,
+			retention_policies, campaigns, api_keys;
+			DELETE FROM tenants WHERE id <> 'default'`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fn(t, db)
+	})
+}
+
+func newTestSQLiteDB(t *testing.T) *SQLiteDB {
+	t.Helper()
+	db, err := NewSQLiteDB(filepath.Join(t.TempDir(), "thelp.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.DB.Close() })
+	if err := db.MigrateUp(0); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestDatabaseTags(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db Database) {
+		ctx := context.Background()
+		tag := NewTag(testTagID, "c1", "h1", 1000)
+		tag.Username = "alice"
+		if err := db.InsertTag(ctx, tag, TagChange{}); err != nil {
+			t.Fatal(err)
+		}
+		if tag.Version != 1 || tag.TenantID != DefaultTenant {
+			t.Errorf("after insert got version %d tenant %q", tag.Version, tag.TenantID)
+		}
+
+		var conflict *ConflictError
+		if err := db.InsertTag(ctx, NewTag(testTagID, "c2", "h2", 1001), TagChange{}); !errors.As(err, &conflict) || conflict.Actual != 1 {
+			t.Errorf("duplicate insert: got %v", err)
+		}
+
+		got, err := db.GetTag(ctx, testTagID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Hash != "h1" || got.Username != "alice" || got.State != TagArmed || got.Version != 1 {
+			t.Errorf("got %+v", got)
+		}
+
+		got.Hash = "h2"
+		if err := db.UpdateTag(ctx, got, TagChange{}); err != nil {
+			t.Fatal(err)
+		}
+		if got.Version != 2 {
+			t.Errorf("after update got version %d, want 2", got.Version)
+		}
+		stale := NewTag(testTagID, "c1", "h3", 1000)
+		stale.Version = 1
+		if err := db.UpdateTag(ctx, stale, TagChange{}); !errors.As(err, &conflict) || conflict.Expected != 1 || conflict.Actual != 2 {
+			t.Errorf("stale update: got %v", err)
+		}
+		if err := db.UpdateTag(ctx, NewTag(testTagID2, "c1", "h", 1000), TagChange{}); !errors.Is(err, ErrNotFound) {
+			t.Errorf("update of a missing tag: got %v", err)
+		}
+		if _, err := db.GetTag(ctx, testTagID2); !errors.Is(err, ErrNotFound) {
+			t.Errorf("get of a missing tag: got %v", err)
+		}
+
+		tags, err := db.GetTagsByUsername(ctx, "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tags) != 1 || tags[0].ID != testTagID {
+			t.Errorf("by username got %v", tags)
+		}
+
+		if err := db.DeleteTag(ctx, testTagID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.GetTag(ctx, testTagID); !errors.Is(err, ErrNotFound) {
+			t.Errorf("get after delete: got %v", err)
+		}
+	})
+}
+
+func TestDatabaseTagHistory(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db Database) {
+		ctx := context.Background()
+		if err := db.InsertTag(ctx, NewTag(testTagID, "c", "h", 1000), TagChange{}); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 5; i++ {
+			if err := db.AddTagHistory(ctx, testTagID, TagHistoryItem{ClientID: "c", Hash: "h", Created: 1000 + i}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for _, desc := range []bool{false, true} {
+			var created []int
+			q := TagHistoryQuery{TagID: testTagID, Limit: 2, Descending: desc}
+			for pages := 0; ; pages++ {
+				if pages > 5 {
+					t.Fatal("history paging doesn't end")
+				}
+				page, err := db.GetTagHistory(ctx, q)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, item := range page.History {
+					created = append(created, item.Created)
+				}
+				if page.NextCursor == "" {
+					break
+				}
+				q.Cursor = page.NextCursor
+			}
+			want := []int{1000, 1001, 1002, 1003, 1004}
+			if desc {
+				want = []int{1004, 1003, 1002, 1001, 1000}
+			}
+			if !slices.Equal(created, want) {
+				t.Errorf("descending %v: got %v, want %v", desc, created, want)
+			}
+		}
+
+		if err := db.DeleteTagHistory(ctx, testTagID); err != nil {
+			t.Fatal(err)
+		}
+		page, err := db.GetTagHistory(ctx, TagHistoryQuery{TagID: testTagID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page.History) != 0 {
+			t.Errorf("after delete got %v", page.History)
+		}
+	})
+}
+
+// TestDatabaseTagChange checks the history entry goes in with the tag
+// write, and not at all when the write is refused.
+func TestDatabaseTagChange(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db Database) {
+		ctx := context.Background()
+		historyLen := func() int {
+			page, err := db.GetTagHistory(ctx, TagHistoryQuery{TagID: testTagID})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return len(page.History)
+		}
+		transitions := func() []TagTransition {
+			got, err := db.GetTagTransitions(ctx, testTagID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return got
+		}
+		tag := NewTag(testTagID, "c1", "h1", 1000)
+		created := &TagTransition{To: TagArmed, Actor: "key:1", Reason: "created", Created: 1000}
+		if err := db.InsertTag(ctx, tag, TagChange{History: &TagHistoryItem{ClientID: "c1", Hash: "h1", Created: 1000}, Transition: created}); err != nil {
+			t.Fatal(err)
+		}
+		if n := historyLen(); n != 1 {
+			t.Fatalf("after insert got %d history entries, want 1", n)
+		}
+		dup := NewTag(testTagID, "c2", "h2", 1001)
+		if err := db.InsertTag(ctx, dup, TagChange{History: &TagHistoryItem{ClientID: "c2", Hash: "h2", Created: 1001}}); !errors.Is(err, ErrConflict) {
+			t.Fatalf("duplicate insert: got %v", err)
+		}
+		tag.Hash = "h3"
+		if err := db.UpdateTag(ctx, tag, TagChange{History: &TagHistoryItem{ClientID: "c1", Hash: "h3", Created: 1002}}); err != nil {
+			t.Fatal(err)
+		}
+		stale := NewTag(testTagID, "c1", "h4", 1003)
+		stale.Version = 1
+		stale.State = TagDisarmed
+		disarm := &TagTransition{From: TagArmed, To: TagDisarmed, Created: 1003}
+		if err := db.UpdateTag(ctx, stale, TagChange{History: &TagHistoryItem{ClientID: "c1", Hash: "h4", Created: 1003}, Transition: disarm}); !errors.Is(err, ErrConflict) {
+			t.Fatalf("stale update: got %v", err)
+		}
+		if n := historyLen(); n != 2 {
+			t.Errorf("got %d history entries, want 2", n)
+		}
+		if got := transitions(); len(got) != 1 || got[0].TagID != testTagID || got[0].Actor != "key:1" || got[0].To != TagArmed {
+			t.Errorf("got transitions %+v, want only the creation", got)
+		}
+	})
+}
+
+func TestDatabaseAccessLogs(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db Database) {
+		ctx := context.Background()
+		for _, id := range []string{testTagID, testTagID2} {
+			if err := db.InsertTag(ctx, NewTag(id, "c", "h", 1000), TagChange{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		logs := []*AccessLog{
+			{IP: "203.0.113.1", UserAgent: "curl/8.0", Timestamp: 2000, TagID: testTagID},
+			{IP: "203.0.113.2", UserAgent: "Mozilla/5.0", Timestamp: 2001, TagID: testTagID},
+			{IP: "198.51.100.1", UserAgent: "Mozilla/5.0", Timestamp: 2002, TagID: testTagID2},
+			{IP: "2001:db8::1", UserAgent: "Mozilla/5.0", Timestamp: 2003, TagID: testTagID},
+		}
+		if err := db.AddAccessLogs(ctx, logs[:3]); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.AddAccessLog(ctx, logs[3]); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, tc := range []struct {
+			name string
+			q    AccessLogQuery
+			want []string
+		}{
+			{"all", AccessLogQuery{}, []string{"203.0.113.1", "203.0.113.2", "198.51.100.1", "2001:db8::1"}},
+			{"tag", AccessLogQuery{TagID: testTagID2}, []string{"198.51.100.1"}},
+			{"exclude", AccessLogQuery{ExcludeTagIDs: []string{testTagID}}, []string{"198.51.100.1"}},
+			{"since until", AccessLogQuery{Since: 2001, Until: 2003}, []string{"203.0.113.2", "198.51.100.1"}},
+			{"ip", AccessLogQuery{IP: "203.0.113.2"}, []string{"203.0.113.2"}},
+			{"cidr", AccessLogQuery{IP: "203.0.113.0/24"}, []string{"203.0.113.1", "203.0.113.2"}},
+			{"user agent", AccessLogQuery{UserAgent: "curl"}, []string{"203.0.113.1"}},
+			{"descending", AccessLogQuery{Descending: true, Limit: 2}, []string{"2001:db8::1", "198.51.100.1"}},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				page, err := db.QueryAccessLogs(ctx, tc.q)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var ips []string
+				for _, log := range page.Logs {
+					ips = append(ips, log.IP)
+				}
+				if !slices.Equal(ips, tc.want) {
+					t.Errorf("got %v, want %v", ips, tc.want)
+				}
+			})
+		}
+
+		var seen []int
+		q := AccessLogQuery{Limit: 1}
+		for pages := 0; ; pages++ {
+			if pages > 5 {
+				t.Fatal("access log paging doesn't end")
+			}
+			page, err := db.QueryAccessLogs(ctx, q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, log := range page.Logs {
+				seen = append(seen, log.Timestamp)
+			}
+			if page.NextCursor == "" {
+				break
+			}
+			q.Cursor = page.NextCursor
+		}
+		if !slices.Equal(seen, []int{2000, 2001, 2002, 2003}) {
+			t.Errorf("paged through %v", seen)
+		}
+
+		if _, err := db.DeleteAccessLogs(ctx, AccessLogQuery{}); !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("unbounded delete: got %v", err)
+		}
+		n, err := db.DeleteAccessLogs(ctx, AccessLogQuery{TagID: testTagID, Until: 2002})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 2 {
+			t.Errorf("deleted %d, want 2", n)
+		}
+		page, err := db.QueryAccessLogs(ctx, AccessLogQuery{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Logs) != 2 {
+			t.Errorf("after delete got %d logs, want 2", len(page.Logs))
+		}
+	})
+}
+
+func TestDatabaseTransitions(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db Database) {
+		ctx := context.Background()
+		if err := db.InsertTag(ctx, NewTag(testTagID, "c", "h", 1000), TagChange{}); err != nil {
+			t.Fatal(err)
+		}
+		for _, tr := range []TagTransition{
+			{TagID: testTagID, From: TagArmed, To: TagDisarmed, Actor: "key:1", Created: 1001},
+			{TagID: testTagID, From: TagDisarmed, To: TagRetired, Reason: "done", Created: 1002},
+		} {
+			if err := db.AddTagTransition(ctx, tr); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got, err := db.GetTagTransitions(ctx, testTagID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 2 || got[0].To != TagDisarmed || got[0].Actor != "key:1" || got[1].Reason != "done" {
+			t.Errorf("got %+v", got)
+		}
+		if err := db.DeleteTagHistory(ctx, testTagID); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := db.GetTagTransitions(ctx, testTagID); len(got) != 0 {
+			t.Errorf("after delete got %+v", got)
+		}
+	})
+}
+
+func TestDatabaseRetentionPolicies(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db Database) {
+		ctx := context.Background()
+		late := &RetentionPolicy{Action: RetentionDelete, AfterDays: 90, Created: 1000}
+		early := &RetentionPolicy{Action: RetentionTruncate, AfterDays: 30, DropUserAgent: true, Created: 1000}
+		for _, p := range []*RetentionPolicy{late, early} {
+			if err := db.SaveRetentionPolicy(ctx, p); err != nil {
+				t.Fatal(err)
+			}
+			if p.ID == 0 {
+				t.Fatal("saved policy has no id")
+			}
+		}
+		early.AppliedUntil = 5000
+		if err := db.SaveRetentionPolicy(ctx, early); err != nil {
+			t.Fatal(err)
+		}
+		policies, err := db.GetRetentionPolicies(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(policies) != 2 || policies[0].ID != early.ID || policies[0].AppliedUntil != 5000 || !policies[0].DropUserAgent {
+			t.Errorf("got %+v", policies)
+		}
+		if err := db.DeleteRetentionPolicy(ctx, late.ID); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.DeleteRetentionPolicy(ctx, late.ID); !errors.Is(err, ErrNotFound) {
+			t.Errorf("second delete: got %v", err)
+		}
+		if err := db.SaveRetentionPolicy(ctx, &RetentionPolicy{ID: late.ID, Action: RetentionDelete}); !errors.Is(err, ErrNotFound) {
+			t.Errorf("update of a deleted policy: got %v", err)
+		}
+	})
+}
+
+func TestDatabaseRewriteAccessLogs(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db Database) {
+		rw, ok := db.(FieldRewriter)
+		if !ok {
+			t.Skipf("%T can't rewrite access logs", db)
+		}
+		ctx := context.Background()
+		lat, long := 59.91, 10.75
+		geo := &GeoInfo{Country: "NO", City: "Oslo", Latitude: &lat, Longitude: &long, ASN: 64500, Org: "Example"}
+		if err := db.AddAccessLog(ctx, &AccessLog{IP: "203.0.113.7", UserAgent: "curl", Timestamp: 100, TagID: testTagID, Geo: geo,
+			ForwardedFor: "198.51.100.1", Forwarded: "for=198.51.100.1", Fields: map[string]string{"field.name": "alice"}}); err != nil {
+			t.Fatal(err)
+		}
+		page, err := db.QueryAccessLogs(ctx, AccessLogQuery{})
+		if err != nil || len(page.Logs) != 1 {
+			t.Fatalf("got %v %v", page, err)
+		}
+		log := page.Logs[0]
+		log.IP, log.UserAgent, log.ForwardedFor, log.Forwarded = "203.0.113.0", "", "198.51.100.0", ""
+		log.Fields = map[string]string{"field.name": "redacted"}
+		log.Geo = log.Geo.coarse()
+		if err := rw.RewriteAccessLogs(ctx, []*AccessLog{log}); err != nil {
+			t.Fatal(err)
+		}
+		page, err = db.QueryAccessLogs(ctx, AccessLogQuery{})
+		if err != nil || len(page.Logs) != 1 {
+			t.Fatalf("got %v %v", page, err)
+		}
+		got := page.Logs[0]
+		if got.IP != "203.0.113.0" || got.UserAgent != "" || got.ForwardedFor != "198.51.100.0" || got.Forwarded != "" || got.Fields["field.name"] != "redacted" {
+			t.Errorf("got %+v", got)
+		}
+		if got.Geo == nil || got.Geo.precise() || got.Geo.Country != "NO" || got.Geo.ASN != 64500 || got.Geo.Org != "Example" {
+			t.Errorf("location %+v, want only country and network", got.Geo)
+		}
+	})
+}
+
+func TestDatabaseCampaigns(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db Database) {
+		ctx := context.Background()
+		c := &Campaign{Name: "data room", Owner: "sec", Created: 1000}
+		if err := db.SaveCampaign(ctx, c); err != nil {
+			t.Fatal(err)
+		}
+		tag := NewTag(testTagID, "c", "h", 1000)
+		tag.CampaignID = c.ID
+		if err := db.InsertTag(ctx, tag, TagChange{}); err != nil {
+			t.Fatal(err)
+		}
+		tags, err := db.GetTagsByCampaign(ctx, c.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tags) != 1 || tags[0].ID != testTagID {
+			t.Errorf("campaign tags got %v", tags)
+		}
+
+		c.Description = "q3"
+		if err := db.SaveCampaign(ctx, c); err != nil {
+			t.Fatal(err)
+		}
+		got, err := db.GetCampaign(ctx, c.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Name != "data room" || got.Description != "q3" || got.TenantID != DefaultTenant {
+			t.Errorf("got %+v", got)
+		}
+
+		if err := db.DeleteCampaign(ctx, c.ID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.GetCampaign(ctx, c.ID); !errors.Is(err, ErrNotFound) {
+			t.Errorf("get after delete: got %v", err)
+		}
+		if tag, err := db.GetTag(ctx, testTagID); err != nil || tag.CampaignID != 0 {
+			t.Errorf("tag after campaign delete: %v %v", tag, err)
+		}
+	})
+}
+
+func TestDatabaseTenants(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db Database) {
+		ctx := context.Background()
+		if err := db.AddTenant(ctx, &Tenant{ID: "acme", Name: "Acme", Created: 1000}); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.AddTenant(ctx, &Tenant{ID: "acme", Created: 1000}); !errors.Is(err, ErrConflict) {
+			t.Errorf("duplicate tenant: got %v", err)
+		}
+		tenants, err := db.GetTenants(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tenants) != 2 || tenants[0].ID != "acme" || tenants[1].ID != DefaultTenant {
+			t.Errorf("got %+v", tenants)
+		}
+
+		key := &APIKey{TenantID: "acme", Label: "ci", Hash: hashAPIKey("thelp_secret"), Created: 1000}
+		if err := db.AddAPIKey(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+		got, err := db.GetAPIKey(ctx, hashAPIKey("thelp_secret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.ID != key.ID || got.TenantID != "acme" || got.Label != "ci" {
+			t.Errorf("got %+v", got)
+		}
+		if keys, _ := db.GetAPIKeys(WithTenant(ctx, DefaultTenant)); len(keys) != 0 {
+			t.Errorf("default tenant sees keys %+v", keys)
+		}
+		if err := db.DeleteAPIKey(WithTenant(ctx, DefaultTenant), key.ID); !errors.Is(err, ErrNotFound) {
+			t.Errorf("delete from another tenant: got %v", err)
+		}
+		if err := db.DeleteAPIKey(WithTenant(ctx, "acme"), key.ID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.GetAPIKey(ctx, hashAPIKey("thelp_secret")); !errors.Is(err, ErrNotFound) {
+			t.Errorf("get after delete: got %v", err)
+		}
+	})
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestKeyring loads a keyring holding ids, the first one active. Each
+// id always maps to the same key, so keyrings can share keys.
+func newTestKeyring(t *testing.T, ids ...string) *Keyring {
+	t.Helper()
+	keys := map[string][]byte{}
+	for _, id := range ids {
+		key := sha256.Sum256([]byte(id))
+		keys[id] = key[:]
+	}
+	index := sha256.Sum256([]byte("index"))
+	raw, err := json.Marshal(map[string]any{"active": ids[0], "keys": keys, "index_key": index[:]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(t.TempDir(), "keyring.json")
+	if err := os.WriteFile(p, raw, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	k, err := LoadKeyring(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestLoadKeyring(t *testing.T) {
+	key := strings.Repeat("A", 43) + "="
+	for _, tc := range []struct {
+		name, raw string
+	}{
+		{"not json", `{`},
+		{"no active key", `{"active": "k2", "keys": {"k1": "` + key + `"}, "index_key": "` + key + `"}`},
+		{"short key", `{"active": "k1", "keys": {"k1": "AAAA"}, "index_key": "` + key + `"}`},
+		{"colon in id", `{"active": "k:1", "keys": {"k:1": "` + key + `"}, "index_key": "` + key + `"}`},
+		{"short index key", `{"active": "k1", "keys": {"k1": "` + key + `"}, "index_key": "AAAA"}`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := filepath.Join(t.TempDir(), "keyring.json")
+			if err := os.WriteFile(p, []byte(tc.raw), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := LoadKeyring(p); err == nil {
+				t.Error("bad keyring loaded")
+			}
+		})
+	}
+	t.Setenv("THELP_KEYRING", "")
+	if k, err := LoadKeyring(""); k != nil || err != nil {
+		t.Errorf("no keyring: got %v %v", k, err)
+	}
+}
+
+func TestEncryptedDBSeals(t *testing.T) {
+	raw := NewMemoryDB()
+	e, err := NewEncryptedDB(raw, newTestKeyring(t, "k1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	tag := NewTag(testTagID, "c1", "h1", 100)
+	tag.Username, tag.FilePath = "alice", "docs/plan.pdf"
+	if err := e.InsertTag(ctx, tag, TagChange{}); err != nil {
+		t.Fatal(err)
+	}
+	lat := 59.91
+	log := &AccessLog{IP: "203.0.113.7", UserAgent: "curl", TagID: testTagID, Timestamp: 100, Fields: map[string]string{"name": "alice"},
+		Geo: &GeoInfo{Country: "NO", City: "Oslo", Latitude: &lat, Longitude: &lat, ASN: 64500}}
+	if err := e.AddAccessLog(ctx, log); err != nil {
+		t.Fatal(err)
+	}
+	if log.IP != "203.0.113.7" {
+		t.Error("AddAccessLog sealed the caller's log")
+	}
+
+	stored, err := raw.GetTag(ctx, testTagID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, err := raw.QueryAccessLogs(ctx, AccessLogQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for field, v := range map[string]string{
+		"username":   stored.Username,
+		"file_path":  stored.FilePath,
+		"ip":         page.Logs[0].IP,
+		"user_agent": page.Logs[0].UserAgent,
+		"fields":     page.Logs[0].Fields["name"],
+	} {
+		if !strings.HasPrefix(v, encryptedPrefix+"k1:") {
+			t.Errorf("%s stored as %q", field, v)
+		}
+	}
+	if geo := page.Logs[0].Geo; geo.precise() || geo.Country != "NO" || geo.ASN != 64500 {
+		t.Errorf("stored location %+v, want only country and network", geo)
+	}
+	if stored.UsernameIndex == "" || stored.UsernameIndex == "alice" {
+		t.Errorf("blind index %q", stored.UsernameIndex)
+	}
+
+	got, err := e.GetTag(ctx, testTagID)
+	if err != nil || got.Username != "alice" || got.FilePath != "docs/plan.pdf" {
+		t.Errorf("GetTag: got %+v %v", got, err)
+	}
+	byName, err := e.GetTagsByUsername(ctx, "alice")
+	if err != nil || len(byName) != 1 {
+		t.Errorf("GetTagsByUsername: got %v %v", byName, err)
+	}
+	page, err = e.QueryAccessLogs(ctx, AccessLogQuery{IP: "203.0.113.0/24"})
+	if err != nil || len(page.Logs) != 1 || page.Logs[0].UserAgent != "curl" || page.Logs[0].Fields["name"] != "alice" {
+		t.Errorf("QueryAccessLogs by ip: got %+v %v", page, err)
+	}
+
+	// a value moved to another column doesn't open
+	if _, err := e.decrypt("file_path", stored.Username); err == nil {
+		t.Error("username ciphertext opened as a file path")
+	}
+	other, err := NewEncryptedDB(raw, newTestKeyring(t, "k2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.GetTag(ctx, testTagID); err == nil {
+		t.Error("opened with a keyring that lacks k1")
+	}
+}
+
+// TestRotate starts from rows written in plaintext and under k1, rotates to
+// k2 and checks every value ends up under k2 with its index intact.
+func TestRotate(t *testing.T) {
+	raw := NewMemoryDB()
+	ctx := context.Background()
+	legacy := NewTag(testTagID, "c1", "h1", 100)
+	legacy.Username, legacy.FilePath = "bob", "docs/old.pdf"
+	if err := raw.InsertTag(ctx, legacy, TagChange{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := raw.AddAccessLog(ctx, &AccessLog{IP: "198.51.100.1", TagID: testTagID, Timestamp: 100}); err != nil {
+		t.Fatal(err)
+	}
+	old, err := NewEncryptedDB(raw, newTestKeyring(t, "k1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag := NewTag(testTagID2, "c2", "h2", 101)
+	tag.Username, tag.FilePath = "alice", "docs/plan.pdf"
+	if err := old.InsertTag(ctx, tag, TagChange{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := old.AddAccessLog(ctx, &AccessLog{IP: "203.0.113.7", UserAgent: "curl", TagID: testTagID2, Timestamp: 101}); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := NewEncryptedDB(raw, newTestKeyring(t, "k2", "k1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags, logs, err := e.Rotate(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tags != 2 || logs != 2 {
+		t.Errorf("rotated %d tags and %d logs, want 2 and 2", tags, logs)
+	}
+	stored, err := raw.GetTags(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tag := range stored {
+		if e.stale(tag.Username) || e.stale(tag.FilePath) || tag.UsernameIndex == "" {
+			t.Errorf("tag %s after rotation: %+v", tag.ID, tag)
+		}
+		if tag.Version != 1 {
+			t.Errorf("rotation bumped tag %s to version %d", tag.ID, tag.Version)
+		}
+	}
+	page, err := raw.QueryAccessLogs(ctx, AccessLogQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, log := range page.Logs {
+		if e.staleLog(log) {
+			t.Errorf("log %d after rotation: %+v", log.ID, log)
+		}
+	}
+	for _, name := range []string{"alice", "bob"} {
+		if found, err := e.GetTagsByUsername(ctx, name); err != nil || len(found) != 1 {
+			t.Errorf("%s after rotation: got %v %v", name, found, err)
+		}
+	}
+
+	// a finished rotation has nothing left to do
+	if tags, logs, err := e.Rotate(time.Second); err != nil || tags != 0 || logs != 0 {
+		t.Errorf("second rotation: %d tags, %d logs, %v", tags, logs, err)
+	}
+	// and k1 can go now
+	only, err := NewEncryptedDB(raw, newTestKeyring(t, "k2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := only.GetTags(ctx); err != nil {
+		t.Errorf("reading without k1: %v", err)
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+	"go.uber.org/zap"
+)
+
+var (
+	geoipCity  = flag.String("geoip-city", "", "GeoLite2 or GeoIP2 City .mmdb file used to locate hits, empty to skip")
+	geoipASN   = flag.String("geoip-asn", "", "GeoLite2 ASN .mmdb file used to name the network of hits, empty to skip")
+	geoipCheck = flag.Duration("geoip-check", time.Minute, "how often the .mmdb files are checked for changes on disk")
+)
+
+// GeoInfo is where a hit came from, as far as the local databases know.
+// Country is the ISO code. Fields whose database isn't configured stay
+// empty.
+type GeoInfo struct {
+	Country   string   `json:"country,omitempty"`
+	City      string   `json:"city,omitempty"`
+	Latitude  *float64 `json:"latitude,omitempty"`
+	Longitude *float64 `json:"longitude,omitempty"`
+	ASN       uint     `json:"asn,omitempty"`
+	Org       string   `json:"org,omitempty"`
+}
+
+// the parts of the MaxMind records we keep
+type geoCityRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Location struct {
+		Latitude  *float64 `maxminddb:"latitude"`
+		Longitude *float64 `maxminddb:"longitude"`
+	} `maxminddb:"location"`
+}
+
+type geoASNRecord struct {
+	ASN uint   `maxminddb:"autonomous_system_number"`
+	Org string `maxminddb:"autonomous_system_organization"`
+}
+
+// geoDB is one loaded .mmdb file. The whole file is read into memory rather
+// than mapped, so a replaced reader can be dropped while lookups on it are
+// still running.
+type geoDB struct {
+	reader  *maxminddb.Reader
+	modTime time.Time
+	size    int64
+}
+
+func loadGeoDB(path string) (*geoDB, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := maxminddb.FromBytes(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &geoDB{reader: reader, modTime: info.ModTime(), size: info.Size()}, nil
+}
+
+// GeoIP enriches hits from a City and an ASN database, either of which may
+// be left out.
+type GeoIP struct {
+	CityPath string
+	ASNPath  string
+	city     atomic.Pointer[geoDB]
+	asn      atomic.Pointer[geoDB]
+}
+
+// NewGeoIP loads the configured databases, nil if there are none.
+func NewGeoIP(cityPath, asnPath string) (*GeoIP, error) {
+	if cityPath == "" && asnPath == "" {
+		return nil, nil
+	}
+	g := &GeoIP{CityPath: cityPath, ASNPath: asnPath}
+	if _, err := g.reload(true); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// reload reads the files that changed since they were loaded, or all of
+// them if force is set, and reports which were reloaded. A file that fails
+// to load leaves the one in use in place.
+func (g *GeoIP) reload(force bool) ([]string, error) {
+	var reloaded []string
+	for _, db := range []struct {
+		path    string
+		current *atomic.Pointer[geoDB]
+	}{{g.CityPath, &g.city}, {g.ASNPath, &g.asn}} {
+		if db.path == "" {
+			continue
+		}
+		if old := db.current.Load(); old != nil && !force {
+			info, err := os.Stat(db.path)
+			if err != nil {
+				return reloaded, err
+			}
+			if info.ModTime().Equal(old.modTime) && info.Size() == old.size {
+				continue
+			}
+		}
+		loaded, err := loadGeoDB(db.path)
+		if err != nil {
+			return reloaded, err
+		}
+		db.current.Store(loaded)
+		reloaded = append(reloaded, db.path)
+	}
+	return reloaded, nil
+}
+
+// Lookup enriches ip, the stored address of a hit. It returns nil when g is
+// nil or the databases know nothing about the address, which is the case
+// for private ranges.
+func (g *GeoIP) Lookup(ip string) *GeoInfo {
+	if g == nil {
+		return nil
+	}
+	addr, ok := accessLogAddr(ip)
+	if !ok {
+		return nil
+	}
+	netIP := net.IP(addr.AsSlice())
+	var info GeoInfo
+	found := false
+	if db := g.city.Load(); db != nil {
+		var rec geoCityRecord
+		if _, ok, err := db.reader.LookupNetwork(netIP, &rec); err == nil && ok {
+			found = true
+			info.Country = rec.Country.ISOCode
+			if info.Country == "" {
+				info.Country = rec.RegisteredCountry.ISOCode
+			}
+			info.City = rec.City.Names["en"]
+			info.Latitude, info.Longitude = rec.Location.Latitude, rec.Location.Longitude
+		}
+	}
+	if db := g.asn.Load(); db != nil {
+		var rec geoASNRecord
+		if _, ok, err := db.reader.LookupNetwork(netIP, &rec); err == nil && ok {
+			found = true
+			info.ASN, info.Org = rec.ASN, rec.Org
+		}
+	}
+	if !found {
+		return nil
+	}
+	return &info
+}
+
+// WatchGeoIP reloads the .mmdb files whenever they change on disk, checking
+// every interval until ctx is done.
+func (a *Application) WatchGeoIP(ctx context.Context, every time.Duration) {
+	if a.GeoIP == nil || every <= 0 {
+		return
+	}
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		reloaded, err := a.GeoIP.reload(false)
+		for _, path := range reloaded {
+			a.Logger.Info("reloaded geoip database", zap.String("path", path))
+		}
+		if err != nil {
+			// a download half written, most likely, the next check retries
+			a.Logger.Warn("could not reload geoip database, keeping the old one", zap.Error(err))
+		}
+	}
+}
+
+// geoColumns are the access_logs columns GeoInfo is stored in, all NULL for
+// hits that weren't enriched.
+var geoColumns = []string{"geo_country", "geo_city", "geo_latitude", "geo_longitude", "geo_asn", "geo_org"}
+
+var geoColumnList = strings.Join(geoColumns, ", ")
+
+// values is g in the order of geoColumns.
+func (g *GeoInfo) values() []any {
+	if g == nil {
+		return []any{nil, nil, nil, nil, nil, nil}
+	}
+	return []any{g.Country, g.City, g.Latitude, g.Longitude, int64(g.ASN), g.Org}
+}
+
+// coarse is g without the city and coordinates, which still point at
+// someone once their address is truncated or gone. Country and network
+// stay.
+func (g *GeoInfo) coarse() *GeoInfo {
+	if g == nil {
+		return nil
+	}
+	return &GeoInfo{Country: g.Country, ASN: g.ASN, Org: g.Org}
+}
+
+// precise reports whether g holds anything coarse drops.
+func (g *GeoInfo) precise() bool {
+	return g != nil && (g.City != "" || g.Latitude != nil || g.Longitude != nil)
+}
+
+// geoScan receives the geoColumns of a row. geo_country is written for
+// every enriched hit, so it tells whether there is anything to return.
+type geoScan struct {
+	country, city, org  *string
+	latitude, longitude *float64
+	asn                 *int64
+}
+
+func (s *geoScan) dest() []any {
+	return []any{&s.country, &s.city, &s.latitude, &s.longitude, &s.asn, &s.org}
+}
+
+func (s *geoScan) info() *GeoInfo {
+	if s.country == nil {
+		return nil
+	}
+	g := &GeoInfo{Country: *s.country, Latitude: s.latitude, Longitude: s.longitude}
+	if s.city != nil {
+		g.City = *s.city
+	}
+	if s.asn != nil {
+		g.ASN = uint(*s.asn)
+	}
+	if s.org != nil {
+		g.Org = *s.org
+	}
+	return g
+}
@@ -1,11 +1,17 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/google/uuid"
 	"go.uber.org/zap"
 )
 
@@ -24,7 +30,18 @@ func (a *Application) AddTagHandler(w http.ResponseWriter, r *http.Request) {
 	if tag.Created == 0 {
 		tag.Created = int(time.Now().Unix())
 	}
-	a.AddTag(tag)
+	if err := validateSchedule(tag.ArmAt, tag.ExpiresAt); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validInitialState(tag.lifecycle()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := a.AddTag(r.Context(), tag); err != nil {
+		a.dbError(w, r, err)
+		return
+	}
 	if tag.URL == "" {
 		tag.URL = fmt.Sprintf("%s/%s", a.FQDN, tag.ID)
 	}
@@ -38,6 +55,33 @@ func (a *Application) AddTagHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(Response{Data: wordString})
 }
 
+// dbError answers with a status that tells a missing record apart from a
+// slow database or a client that went away.
+func (a *Application) dbError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		// anything but a tag says what is missing
+		msg := "Tag not found"
+		if err != ErrNotFound {
+			msg = err.Error()
+		}
+		http.Error(w, msg, http.StatusNotFound)
+	case errors.Is(err, ErrInvalidQuery):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrConflict):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, context.Canceled):
+		// the client hung up, there is nobody to answer
+		a.Logger.Debug("request canceled", zap.String("path", r.URL.Path), zap.Error(err))
+	case isTimeout(err):
+		a.Logger.Warn("database timeout", zap.String("path", r.URL.Path), zap.Error(err))
+		http.Error(w, "database timeout", http.StatusGatewayTimeout)
+	default:
+		a.Logger.Error("database error", zap.String("path", r.URL.Path), zap.Error(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
 type TagQuery struct {
 	ID string `json:"id"`
 }
@@ -48,9 +92,8 @@ func (a *Application) TagExistsHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	tag := a.GetTag(query.ID)
-	if tag == nil {
-		http.Error(w, "Tag not found", http.StatusNotFound)
+	if _, err := a.GetTag(r.Context(), query.ID); err != nil {
+		a.dbError(w, r, err)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
@@ -63,49 +106,569 @@ func (a *Application) GetTagHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	tag := a.GetTag(query.ID)
-	if tag == nil {
-		http.Error(w, "Tag not found", http.StatusNotFound)
+	tag, err := a.GetTag(r.Context(), query.ID)
+	if err != nil {
+		a.dbError(w, r, err)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(tag)
+	json.NewEncoder(w).Encode(tag.clone())
 }
 
-func (a *Application) tagHandler(tag *Tag) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		remoteIP := r.Header.Get("X-Forwarded-For")
-		if remoteIP == "" {
-			remoteIP = r.RemoteAddr
+// tagHandler is the catch-all beacon route. The tag is looked up on every
+// hit so deleted tags stop answering right away. /<id> may carry an
+// extension, /<id>.png say, to pick the response; see serveBeacon.
+func (a *Application) tagHandler(w http.ResponseWriter, r *http.Request) {
+	id, ext := splitBeaconPath(strings.TrimPrefix(r.URL.Path, "/"))
+	// tag IDs are UUIDs, favicon.ico and whatever scanners probe for
+	// aren't worth a trip to the database, which would reject them anyway
+	if _, err := uuid.Parse(id); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	// a PDF viewer posting its form wants a form back, anything else makes
+	// it show an error the reader would notice
+	submit := pdfSubmitFormat(r)
+	if submit != "" {
+		ext = submit
+	}
+	tag, err := a.GetTag(r.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	if err != nil {
+		// whoever opened the document doesn't get to see our database
+		// trouble, the hit is lost though
+		a.Logger.Error("beacon lookup failed", zap.String("tag_id", id), zap.Error(err))
+		a.serveBeacon(w, r, nil, beaconResponse(nil, ext, r.Header.Get("Accept")))
+		return
+	}
+	state := tag.lifecycle()
+	if state == TagRetired {
+		http.NotFound(w, r)
+		return
+	}
+	remoteIP := a.clientIP(r)
+	userAgent := r.Header.Get("User-Agent")
+	kind := a.Classifier.Classify(r, remoteIP)
+	now := time.Now()
+	severity := a.hitSeverity(tag)
+	// unfurlers, gateways and the like never page anyone unless asked to,
+	// whatever the tag's state or window
+	record, alert := true, a.AlertKinds[kind]
+	if !alert {
+		severity = SeverityLow
+	}
+	switch {
+	case state != TagArmed:
+		// drafts and disarmed tags keep a record but nobody gets paged
+		severity, alert = SeverityLow, false
+	case !tag.armed(now):
+		severity, record = SeverityLow, a.OutOfWindow != OutOfWindowIgnore
+	}
+	// whoever fetched the beacon gets the same answer either way, only what
+	// we keep differs
+	if record {
+		if alert {
+			a.Logger.Info("Tag accessed", zap.String("tag_id", tag.ID), zap.String("remote_ip", remoteIP), zap.String("user_agent", userAgent), zap.String("severity", severity), zap.String("kind", kind))
+		} else {
+			a.Logger.Debug("hit that doesn't alert", zap.String("tag_id", tag.ID), zap.String("state", state), zap.String("kind", kind))
 		}
-		userAgent := r.Header.Get("User-Agent")
-		a.Logger.Info("Tag accessed", zap.String("tag_id", tag.ID), zap.String("remote_ip", remoteIP), zap.String("user_agent", userAgent))
-		go tag.AddAccess(remoteIP, userAgent, int(time.Now().Unix()))
+		var fields map[string]string
+		if r.Method == http.MethodPost {
+			fields = readSubmission(r)
+		}
+		geo := a.GeoIP.Lookup(remoteIP)
+		go tag.AddAccess(remoteIP, userAgent, int(now.Unix()), geo)
 		a.AddAccess(&AccessLog{
 			IP:        remoteIP,
 			UserAgent: userAgent,
-			Timestamp: int(time.Now().Unix()),
+			Timestamp: int(now.Unix()),
 			TagID:     tag.ID,
+			Severity:  severity,
+			TenantID:  tag.TenantID,
+			Kind:      kind,
+			Geo:       geo,
+			Fields:    fields,
+			// kept even from peers we don't trust, a forged chain says
+			// something about who is looking
+			ForwardedFor: strings.Join(r.Header.Values("X-Forwarded-For"), ", "),
+			Forwarded:    strings.Join(r.Header.Values("Forwarded"), ", "),
 		})
-		if err := a.DB.UpdateTag(tag); err != nil {
-			// log.Println("error updating tag", err)
-			a.Logger.Error("error updating tag", zap.String("tag_id", tag.ID), zap.Error(err))
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+	} else {
+		a.Logger.Debug("ignoring hit outside armed window", zap.String("tag_id", tag.ID))
+	}
+	if submit != "" {
+		// the tag's own response would be refused by the viewer
+		a.serveBeacon(w, r, nil, submit)
+		return
+	}
+	if r.Method == http.MethodPost {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	a.serveBeacon(w, r, tag, beaconResponse(tag, ext, r.Header.Get("Accept")))
+}
+
+func (a *Application) DeleteTagHandler(w http.ResponseWriter, r *http.Request) {
+	query := &TagQuery{}
+	if err := json.NewDecoder(r.Body).Decode(query); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if query.ID == "" {
+		http.Error(w, "ID is required", http.StatusBadRequest)
+		return
+	}
+	if err := a.DeleteTag(r.Context(), query.ID); err != nil {
+		a.dbError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type tagScheduleRequest struct {
+	ID        string `json:"id"`
+	ArmAt     int    `json:"arm_at"`
+	ExpiresAt int    `json:"expires_at"`
+	Version   int    `json:"version"`
+}
+
+// TagScheduleHandler serves POST /tag-schedule, replacing the armed window
+// of a tag. Zero arm_at or expires_at leaves that side open.
+func (a *Application) TagScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	req := &tagScheduleRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.ID == "" {
+		http.Error(w, "ID is required", http.StatusBadRequest)
+		return
+	}
+	tag, err := a.SetTagSchedule(r.Context(), req.ID, req.ArmAt, req.ExpiresAt, req.Version)
+	if err != nil {
+		a.dbError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tag.clone())
+}
+
+type tagStateRequest struct {
+	ID      string `json:"id"`
+	State   string `json:"state"`
+	Reason  string `json:"reason"`
+	Version int    `json:"version"`
+}
+
+// TagStateHandler serves POST /tag-state, moving a tag to another
+// lifecycle state. Transitions the state machine doesn't allow get a 409.
+func (a *Application) TagStateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	req := &tagStateRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.ID == "" || req.State == "" {
+		http.Error(w, "ID and state is required", http.StatusBadRequest)
+		return
+	}
+	tag, err := a.TransitionTag(r.Context(), req.ID, req.State, req.Reason, req.Version)
+	if err != nil {
+		a.dbError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tag.clone())
+}
+
+// TagTransitionsHandler serves GET /tag-transitions?id=, oldest first.
+func (a *Application) TagTransitionsHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "id is required", http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := a.dbContext(r.Context())
+	defer cancel()
+	transitions, err := a.DB.GetTagTransitions(ctx, id)
+	if err != nil {
+		a.dbError(w, r, err)
+		return
+	}
+	if transitions == nil {
+		transitions = []TagTransition{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(transitions)
+}
+
+// TagsByUserHandler serves GET /tags-by-user?username=
+func (a *Application) TagsByUserHandler(w http.ResponseWriter, r *http.Request) {
+	username := r.URL.Query().Get("username")
+	if username == "" {
+		http.Error(w, "username is required", http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := a.dbContext(r.Context())
+	defer cancel()
+	tags, err := a.DB.GetTagsByUsername(ctx, username)
+	if err != nil {
+		a.dbError(w, r, err)
+		return
+	}
+	if tags == nil {
+		tags = []*Tag{}
+	}
+	for _, tag := range tags {
+		if tag.URL == "" {
+			tag.URL = fmt.Sprintf("%s/%s", a.FQDN, tag.ID)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tags)
+}
+
+// TagsHandler serves GET /tags?classification=&label=key:value, label can
+// be repeated and every one has to match.
+func (a *Application) TagsHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseTagFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := a.dbContext(r.Context())
+	defer cancel()
+	tags, err := a.DB.FindTags(ctx, filter)
+	if err != nil {
+		a.dbError(w, r, err)
+		return
+	}
+	if tags == nil {
+		tags = []*Tag{}
+	}
+	for _, tag := range tags {
+		if tag.URL == "" {
+			tag.URL = fmt.Sprintf("%s/%s", a.FQDN, tag.ID)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tags)
+}
+
+type eraseUserRequest struct {
+	Username string `json:"username"`
+}
+
+// EraseUserHandler serves POST /erase-user, removing every tag of a user
+// and everything recorded for those tags.
+func (a *Application) EraseUserHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	req := &eraseUserRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Username == "" {
+		http.Error(w, "username is required", http.StatusBadRequest)
+		return
+	}
+	tags, logs, err := a.EraseUser(r.Context(), req.Username)
+	if err != nil {
+		a.dbError(w, r, err)
+		return
+	}
+	a.Logger.Info("erased user", zap.Int("tags", tags), zap.Int64("access_logs", logs))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int64{"tags": int64(tags), "access_logs": logs})
+}
+
+// RetentionHandler lists retention policies on GET, adds one on POST and
+// removes the one named by ?id= on DELETE.
+func (a *Application) RetentionHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := a.dbContext(r.Context())
+	defer cancel()
+	switch r.Method {
+	case http.MethodGet:
+		policies, err := a.DB.GetRetentionPolicies(ctx)
+		if err != nil {
+			a.dbError(w, r, err)
 			return
 		}
-		if r.Method == http.MethodPost {
-			// Handle form submission
-			w.WriteHeader(http.StatusNoContent)
+		if policies == nil {
+			policies = []*RetentionPolicy{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(policies)
+	case http.MethodPost:
+		policy := &RetentionPolicy{}
+		if err := json.NewDecoder(r.Body).Decode(policy); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := policy.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if policy.Action == RetentionPseudonymize && a.PseudonymKey == nil {
+			http.Error(w, "pseudonymize needs -pseudonym-key or THELP_PSEUDONYM_KEY", http.StatusBadRequest)
+			return
+		}
+		// a policy may only cover the caller's own tags
+		if policy.TagID != "" {
+			if _, err := a.GetTag(ctx, policy.TagID); err != nil {
+				a.dbError(w, r, err)
+				return
+			}
+		}
+		policy.ID, policy.AppliedUntil, policy.Created = 0, 0, int(time.Now().Unix())
+		if err := a.resetRetention(ctx); err != nil {
+			a.dbError(w, r, err)
+			return
+		}
+		if err := a.DB.SaveRetentionPolicy(ctx, policy); err != nil {
+			a.dbError(w, r, err)
 			return
 		}
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(tag)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(policy)
+	case http.MethodDelete:
+		id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid id", http.StatusBadRequest)
+			return
+		}
+		if err := a.DB.DeleteRetentionPolicy(ctx, id); err != nil {
+			a.dbError(w, r, err)
+			return
+		}
+		if err := a.resetRetention(ctx); err != nil {
+			a.dbError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// CampaignsHandler serves GET /campaigns, POST /campaigns to create or,
+// with an id, update one and DELETE /campaigns?id=. Deleting a campaign
+// keeps its tags.
+func (a *Application) CampaignsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := a.dbContext(r.Context())
+	defer cancel()
+	switch r.Method {
+	case http.MethodGet:
+		campaigns, err := a.DB.GetCampaigns(ctx)
+		if err != nil {
+			a.dbError(w, r, err)
+			return
+		}
+		if campaigns == nil {
+			campaigns = []*Campaign{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(campaigns)
+	case http.MethodPost:
+		campaign := &Campaign{}
+		if err := json.NewDecoder(r.Body).Decode(campaign); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := campaign.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		status := http.StatusOK
+		if campaign.ID == 0 {
+			campaign.Created = int(time.Now().Unix())
+			status = http.StatusCreated
+		}
+		if err := a.DB.SaveCampaign(ctx, campaign); err != nil {
+			a.dbError(w, r, campaignError(err, campaign.ID))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(campaign)
+	case http.MethodDelete:
+		id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid id", http.StatusBadRequest)
+			return
+		}
+		if err := a.DeleteCampaign(r.Context(), id); err != nil {
+			a.dbError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
-func (a *Application) AccessHandler(w http.ResponseWriter, r *http.Request) {
+// CampaignActivityHandler serves GET /campaign-activity?id=&severity=, the
+// tags of a campaign with hit counts, unique IPs, first and last hit, and
+// a per-day timeline.
+func (a *Application) CampaignActivityHandler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	id, err := strconv.ParseInt(params.Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	activity, err := a.CampaignActivity(r.Context(), id, params.Get("severity"))
+	if err != nil {
+		a.dbError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(activity)
+}
+
+// TagHistoryHandler serves GET /tag-history?id=&order=&limit=&cursor=
+func (a *Application) TagHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	q := TagHistoryQuery{
+		TagID:  params.Get("id"),
+		Cursor: params.Get("cursor"),
+	}
+	if limit := params.Get("limit"); limit != "" {
+		var err error
+		if q.Limit, err = strconv.Atoi(limit); err != nil {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	switch params.Get("order") {
+	case "", "asc":
+	case "desc":
+		q.Descending = true
+	default:
+		http.Error(w, "order must be asc or desc", http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := a.dbContext(r.Context())
+	defer cancel()
+	page, err := a.DB.GetTagHistory(ctx, q)
+	if err != nil {
+		a.dbError(w, r, err)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
-	a.Memory.RLock()
-	defer a.Memory.RUnlock()
-	json.NewEncoder(w).Encode(a.AccessLogs)
+	json.NewEncoder(w).Encode(page)
+}
+
+// parseQueryTime accepts unix seconds or RFC 3339.
+func parseQueryTime(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if n, err := strconv.Atoi(s); err == nil {
+		return n, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, want unix seconds or RFC 3339", s)
+	}
+	return int(t.Unix()), nil
+}
+
+// AccessQueryHandler serves GET /access?tag_id=&since=&until=&ip=&user_agent=&severity=&kind=&country=&asn=&classification=&label=&order=&limit=&cursor=
+func (a *Application) AccessQueryHandler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	q := AccessLogQuery{
+		TagID:     params.Get("tag_id"),
+		Severity:  params.Get("severity"),
+		Kind:      params.Get("kind"),
+		IP:        params.Get("ip"),
+		UserAgent: params.Get("user_agent"),
+		Country:   strings.ToUpper(params.Get("country")),
+		Cursor:    params.Get("cursor"),
+	}
+	if q.Kind != "" && !validHitKind(q.Kind) {
+		http.Error(w, "kind must be one of "+strings.Join(hitKinds, ", "), http.StatusBadRequest)
+		return
+	}
+	var err error
+	if asn := strings.TrimPrefix(strings.ToUpper(params.Get("asn")), "AS"); asn != "" {
+		n, err := strconv.ParseUint(asn, 10, 32)
+		if err != nil {
+			http.Error(w, "invalid asn", http.StatusBadRequest)
+			return
+		}
+		q.ASN = uint(n)
+	}
+	if q.Tags, err = parseTagFilter(params); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if q.Since, err = parseQueryTime(params.Get("since")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if q.Until, err = parseQueryTime(params.Get("until")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if limit := params.Get("limit"); limit != "" {
+		if q.Limit, err = strconv.Atoi(limit); err != nil {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	switch params.Get("order") {
+	case "", "asc":
+	case "desc":
+		q.Descending = true
+	default:
+		http.Error(w, "order must be asc or desc", http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := a.dbContext(r.Context())
+	defer cancel()
+	page, err := a.DB.QueryAccessLogs(ctx, q)
+	if err != nil {
+		a.dbError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// MetricsHandler serves the app's expvar counters. expvar.Handler would
+// also publish cmdline, and with it the password in -db.
+func (a *Application) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprint(w, "{")
+	first := true
+	expvar.Do(func(kv expvar.KeyValue) {
+		if kv.Key == "cmdline" || kv.Key == "memstats" {
+			return
+		}
+		if !first {
+			fmt.Fprint(w, ",")
+		}
+		first = false
+		fmt.Fprintf(w, "\n%q: %s", kv.Key, kv.Value)
+	})
+	fmt.Fprint(w, "\n}\n")
 }
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	testTagID  = "6f1c1f3e-2b1a-4a57-9d3c-0a4f8f3b2c11"
+	testTagID2 = "0b9d7d4e-8f0e-4c55-a1b2-3c4d5e6f7a8b"
+)
+
+// newTestApp is an Application on a fresh MemoryDB with no background
+// workers, hits are written straight through.
+func newTestApp(t *testing.T) *Application {
+	t.Helper()
+	app := NewApplication("http://thelp.test", NewMemoryDB())
+	app.Logger = zap.NewNop()
+	app.AnonymousTenant = DefaultTenant
+	return app
+}
+
+func serve(app *Application, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	app.Gateway.ServeHTTP(w, r)
+	return w
+}
+
+func jsonRequest(t *testing.T, method, path string, body any) *http.Request {
+	t.Helper()
+	raw, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(method, path, bytes.NewReader(raw))
+	r.Header.Set("Content-Type", "application/json")
+	return r
+}
+
+// addTestTag creates a tag through the API and fails the test if that
+// doesn't give a 201.
+func addTestTag(t *testing.T, app *Application, tag map[string]any) {
+	t.Helper()
+	w := serve(app, jsonRequest(t, http.MethodPost, "/tag", tag))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("POST /tag %v: %d %s", tag, w.Code, w.Body)
+	}
+}
+
+func getTestTag(t *testing.T, app *Application, id string) *Tag {
+	t.Helper()
+	w := serve(app, jsonRequest(t, http.MethodPost, "/get-tag", TagQuery{ID: id}))
+	if w.Code != http.StatusOK {
+		t.Fatalf("get-tag %s: %d %s", id, w.Code, w.Body)
+	}
+	tag := &Tag{}
+	if err := json.NewDecoder(w.Body).Decode(tag); err != nil {
+		t.Fatal(err)
+	}
+	return tag
+}
+
+func TestTagHandlers(t *testing.T) {
+	app := newTestApp(t)
+	addTestTag(t, app, map[string]any{"id": testTagID, "hash": "h1", "client_id": "c1", "username": "alice"})
+
+	tag := getTestTag(t, app, testTagID)
+	if tag.Hash != "h1" || tag.Username != "alice" || tag.Version != 1 {
+		t.Errorf("got %+v", tag)
+	}
+	if tag.URL != "http://thelp.test/"+testTagID {
+		t.Errorf("url %q", tag.URL)
+	}
+
+	// a re-tag keeps the tag and adds to its history
+	addTestTag(t, app, map[string]any{"id": testTagID, "hash": "h2", "client_id": "c2"})
+	tag = getTestTag(t, app, testTagID)
+	if tag.Hash != "h2" || tag.Version != 2 || len(tag.History) != 2 {
+		t.Errorf("after re-tag got hash %q version %d history %v", tag.Hash, tag.Version, tag.History)
+	}
+
+	for _, tc := range []struct {
+		name string
+		r    *http.Request
+		want int
+	}{
+		{"exists", jsonRequest(t, http.MethodPost, "/tag-exists", TagQuery{ID: testTagID}), http.StatusOK},
+		{"missing", jsonRequest(t, http.MethodPost, "/tag-exists", TagQuery{ID: testTagID2}), http.StatusNotFound},
+		{"no hash", jsonRequest(t, http.MethodPost, "/tag", map[string]any{"id": testTagID2}), http.StatusBadRequest},
+		{"bad json", httptest.NewRequest(http.MethodPost, "/tag", bytes.NewBufferString("{")), http.StatusBadRequest},
+		{"history", httptest.NewRequest(http.MethodGet, "/tag-history?id="+testTagID, nil), http.StatusOK},
+		{"delete", jsonRequest(t, http.MethodPost, "/delete-tag", TagQuery{ID: testTagID}), http.StatusNoContent},
+		{"deleted", jsonRequest(t, http.MethodPost, "/get-tag", TagQuery{ID: testTagID}), http.StatusNotFound},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if w := serve(app, tc.r); w.Code != tc.want {
+				t.Errorf("got %d %s, want %d", w.Code, w.Body, tc.want)
+			}
+		})
+	}
+}
+
+func TestBeaconRecordsHit(t *testing.T) {
+	app := newTestApp(t)
+	addTestTag(t, app, map[string]any{"id": testTagID, "hash": "h"})
+
+	r := httptest.NewRequest(http.MethodGet, "/"+testTagID, nil)
+	r.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64)")
+	r.RemoteAddr = "203.0.113.7:51234"
+	w := serve(app, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("beacon: %d %s", w.Code, w.Body)
+	}
+
+	page, err := app.DB.QueryAccessLogs(context.Background(), AccessLogQuery{TagID: testTagID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Logs) != 1 {
+		t.Fatalf("got %d access logs, want 1", len(page.Logs))
+	}
+	log := page.Logs[0]
+	if log.IP != "203.0.113.7" || log.TenantID != DefaultTenant || log.Kind != HitHuman {
+		t.Errorf("got %+v", log)
+	}
+
+	if w := serve(app, httptest.NewRequest(http.MethodGet, "/"+testTagID2, nil)); w.Code != http.StatusNotFound {
+		t.Errorf("unknown tag: got %d, want 404", w.Code)
+	}
+}
+
+// TestTagVersionConflict re-tags with the version the caller last saw, a
+// stale one has to be refused without touching the tag.
+func TestTagVersionConflict(t *testing.T) {
+	app := newTestApp(t)
+	addTestTag(t, app, map[string]any{"id": testTagID, "hash": "h1"})
+	addTestTag(t, app, map[string]any{"id": testTagID, "hash": "h2", "version": 1})
+
+	w := serve(app, jsonRequest(t, http.MethodPost, "/tag", map[string]any{"id": testTagID, "hash": "h3", "version": 1}))
+	if w.Code != http.StatusConflict {
+		t.Fatalf("stale re-tag: got %d %s, want 409", w.Code, w.Body)
+	}
+	tag := getTestTag(t, app, testTagID)
+	if tag.Hash != "h2" || tag.Version != 2 || len(tag.History) != 2 {
+		t.Errorf("after the refused re-tag got hash %q version %d history %d", tag.Hash, tag.Version, len(tag.History))
+	}
+
+	// without a version the write goes on top of whatever is there
+	addTestTag(t, app, map[string]any{"id": testTagID, "hash": "h4"})
+	if tag := getTestTag(t, app, testTagID); tag.Version != 3 {
+		t.Errorf("got version %d, want 3", tag.Version)
+	}
+}
+
+// TestTagConflictFromElsewhere has another writer bump the stored tag
+// behind the cache's back, the next write through the app must notice.
+func TestTagConflictFromElsewhere(t *testing.T) {
+	app := newTestApp(t)
+	addTestTag(t, app, map[string]any{"id": testTagID, "hash": "h1"})
+	getTestTag(t, app, testTagID)
+
+	ctx := context.Background()
+	stored, err := app.DB.GetTag(ctx, testTagID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := app.DB.UpdateTag(ctx, stored, TagChange{}); err != nil {
+		t.Fatal(err)
+	}
+
+	w := serve(app, jsonRequest(t, http.MethodPost, "/tag", map[string]any{"id": testTagID, "hash": "h2"}))
+	if w.Code != http.StatusConflict {
+		t.Fatalf("got %d %s, want 409", w.Code, w.Body)
+	}
+	// the stale copy is gone from the cache, a retry succeeds
+	addTestTag(t, app, map[string]any{"id": testTagID, "hash": "h2"})
+	if tag := getTestTag(t, app, testTagID); tag.Version != 3 || tag.Hash != "h2" {
+		t.Errorf("after retry got version %d hash %q", tag.Version, tag.Hash)
+	}
+}
+
+// stuckDB never answers a tag lookup before the context gives up, and
+// counts how often it was asked.
+type stuckDB struct {
+	*MemoryDB
+	lookups int
+}
+
+func (s *stuckDB) GetTag(ctx context.Context, id string) (*Tag, error) {
+	s.lookups++
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestDatabaseDeadline(t *testing.T) {
+	db := &stuckDB{MemoryDB: NewMemoryDB()}
+	app := newTestApp(t)
+	app.DB = db
+	app.DBTimeout = 10 * time.Millisecond
+	w := serve(app, jsonRequest(t, http.MethodPost, "/get-tag", TagQuery{ID: testTagID}))
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("get-tag: got %d, want 504", w.Code)
+	}
+	// the beacon still answers, the hit is lost
+	if w := serve(app, httptest.NewRequest(http.MethodGet, "/"+testTagID, nil)); w.Code != http.StatusOK {
+		t.Errorf("beacon: got %d, want 200", w.Code)
+	}
+}
+
+func TestBeaconSkipsNonTagPaths(t *testing.T) {
+	db := &stuckDB{MemoryDB: NewMemoryDB()}
+	app := newTestApp(t)
+	app.DB = db
+	for _, path := range []string{"/favicon.ico", "/wp-login.php", "/" + testTagID + "/x", "/not-a-uuid.png"} {
+		if w := serve(app, httptest.NewRequest(http.MethodGet, path, nil)); w.Code != http.StatusNotFound {
+			t.Errorf("%s: got %d, want 404", path, w.Code)
+		}
+	}
+	if db.lookups != 0 {
+		t.Errorf("%d lookups reached the database", db.lookups)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+)
+
+// tagHistoryWindow is how many of the most recent history entries are kept
+// on a Tag in memory. The database keeps every entry, older ones are read
+// through GetTagHistory.
+const tagHistoryWindow = 150
+
+// TagChange is what a tag write records next to the tag, in the same
+// transaction, so the tag never moves on without its history or the audit
+// row of a state change.
+type TagChange struct {
+	History    *TagHistoryItem
+	Transition *TagTransition
+}
+
+type TagHistoryQuery struct {
+	TagID      string
+	Cursor     string
+	Limit      int
+	Descending bool
+}
+
+type TagHistoryPage struct {
+	History    []TagHistoryItem `json:"history"`
+	NextCursor string           `json:"next_cursor,omitempty"`
+}
+
+func encodeTagHistoryCursor(item TagHistoryItem) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(item.ID, 10)))
+}
+
+func decodeTagHistoryCursor(cursor string) (int64, error) {
+	if cursor == "" {
+		return 0, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, fmt.Errorf("%w: bad cursor: %v", ErrInvalidQuery, err)
+	}
+	id, err := strconv.ParseInt(string(raw), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: bad cursor: %v", ErrInvalidQuery, err)
+	}
+	return id, nil
+}
+
+func (q *TagHistoryQuery) normalize() (int64, error) {
+	if q.TagID == "" {
+		return 0, fmt.Errorf("%w: tag id is required", ErrInvalidQuery)
+	}
+	if q.Limit <= 0 {
+		q.Limit = defaultAccessLogLimit
+	}
+	if q.Limit > maxAccessLogLimit {
+		q.Limit = maxAccessLogLimit
+	}
+	return decodeTagHistoryCursor(q.Cursor)
+}
+
+// page trims items, which must hold up to Limit+1 entries in order, to one
+// page and sets the cursor for the next one.
+func (q *TagHistoryQuery) page(items []TagHistoryItem) *TagHistoryPage {
+	page := &TagHistoryPage{History: items}
+	if len(items) > q.Limit {
+		page.History = items[:q.Limit]
+		page.NextCursor = encodeTagHistoryCursor(page.History[q.Limit-1])
+	}
+	if page.History == nil {
+		page.History = []TagHistoryItem{}
+	}
+	return page
+}
+
+// recentTagHistory loads the last tagHistoryWindow entries for a tag, oldest
+// first, which is what Tag.History holds.
+func recentTagHistory(ctx context.Context, db Database, id string) ([]TagHistoryItem, error) {
+	page, err := db.GetTagHistory(ctx, TagHistoryQuery{TagID: id, Limit: tagHistoryWindow, Descending: true})
+	if err != nil {
+		return nil, err
+	}
+	history := page.History
+	for i, j := 0, len(history)-1; i < j; i, j = i+1, j-1 {
+		history[i], history[j] = history[j], history[i]
+	}
+	return history, nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestTagHistoryCursor(t *testing.T) {
+	id, err := decodeTagHistoryCursor(encodeTagHistoryCursor(TagHistoryItem{ID: 77}))
+	if err != nil || id != 77 {
+		t.Errorf("got %d %v", id, err)
+	}
+	for _, bad := range []string{"!!", "eA"} {
+		if _, err := decodeTagHistoryCursor(bad); !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("%q: got %v", bad, err)
+		}
+	}
+	q := TagHistoryQuery{}
+	if _, err := q.normalize(); !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("query without a tag: got %v", err)
+	}
+}
+
+func TestRecentTagHistoryWindow(t *testing.T) {
+	db := NewMemoryDB()
+	ctx := context.Background()
+	if err := db.InsertTag(ctx, NewTag(testTagID, "c", "h", 0), TagChange{}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < tagHistoryWindow+10; i++ {
+		if err := db.AddTagHistory(ctx, testTagID, TagHistoryItem{Created: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	history, err := recentTagHistory(ctx, db, testTagID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != tagHistoryWindow {
+		t.Fatalf("got %d entries, want %d", len(history), tagHistoryWindow)
+	}
+	if history[0].Created != 10 || history[len(history)-1].Created != tagHistoryWindow+9 {
+		t.Errorf("window runs from %d to %d", history[0].Created, history[len(history)-1].Created)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// A tag starts as a draft while its document is being prepared, is armed
+// once it goes out, can be disarmed and re-armed, and ends up retired.
+// Draft and disarmed tags still record hits but never alert, a retired tag
+// is gone as far as the beacon is concerned.
+const (
+	TagDraft    = "draft"
+	TagArmed    = "armed"
+	TagDisarmed = "disarmed"
+	TagRetired  = "retired"
+)
+
+// tagTransitions lists the states each state may move to.
+var tagTransitions = map[string][]string{
+	TagDraft:    {TagArmed, TagRetired},
+	TagArmed:    {TagDisarmed, TagRetired},
+	TagDisarmed: {TagArmed, TagRetired},
+	TagRetired:  {},
+}
+
+// TagTransition is one audited state change.
+type TagTransition struct {
+	ID      int64  `json:"id"`
+	TagID   string `json:"tag_id"`
+	From    string `json:"from"`
+	To      string `json:"to"`
+	Actor   string `json:"actor,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+	Created int    `json:"created"`
+}
+
+// lifecycle is the state of t. Tags written before states existed were
+// live, so they count as armed.
+func (t *Tag) lifecycle() string {
+	if t.State == "" {
+		return TagArmed
+	}
+	return t.State
+}
+
+// validInitialState checks the state a tag is created in. Only drafts and
+// armed tags can be created, the rest has to go through TransitionTag.
+func validInitialState(state string) error {
+	if state != TagDraft && state != TagArmed {
+		return fmt.Errorf("%w: a new tag must be %s or %s", ErrInvalidQuery, TagDraft, TagArmed)
+	}
+	return nil
+}
+
+func canTransition(from, to string) bool {
+	for _, next := range tagTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// TransitionTag moves a tag to state and records, in the same write, who
+// did it and why. The actor is whoever ctx acts for. version is the one
+// the caller last saw, 0 to skip the check.
+func (a *Application) TransitionTag(ctx context.Context, id, state, reason string, version int) (*Tag, error) {
+	if _, ok := tagTransitions[state]; !ok {
+		return nil, fmt.Errorf("%w: unknown state %q", ErrInvalidQuery, state)
+	}
+	ctx, cancel := a.dbContext(ctx)
+	defer cancel()
+	a.Memory.Lock()
+	defer a.Memory.Unlock()
+	tag, err := a.DB.GetTag(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	from := tag.lifecycle()
+	if !canTransition(from, state) {
+		return nil, fmt.Errorf("%w: tag %s can't go from %s to %s", ErrConflict, id, from, state)
+	}
+	if version != 0 {
+		tag.Version = version
+	}
+	tag.State = state
+	actor := actorFrom(ctx)
+	transition := TagTransition{From: from, To: state, Actor: actor, Reason: reason, Created: int(time.Now().Unix())}
+	if err := a.DB.UpdateTag(ctx, tag, TagChange{Transition: &transition}); err != nil {
+		a.Tags.Remove(id)
+		return nil, err
+	}
+	a.Logger.Info("tag state changed", zap.String("tag_id", id), zap.String("from", from), zap.String("to", state), zap.String("actor", actor))
+	if tag.URL == "" {
+		tag.URL = fmt.Sprintf("%s/%s", a.FQDN, tag.ID)
+	}
+	a.Tags.Set(tag)
+	return tag, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCanTransition(t *testing.T) {
+	states := []string{TagDraft, TagArmed, TagDisarmed, TagRetired}
+	allowed := map[[2]string]bool{
+		{TagDraft, TagArmed}:      true,
+		{TagDraft, TagRetired}:    true,
+		{TagArmed, TagDisarmed}:   true,
+		{TagArmed, TagRetired}:    true,
+		{TagDisarmed, TagArmed}:   true,
+		{TagDisarmed, TagRetired}: true,
+	}
+	for _, from := range states {
+		for _, to := range states {
+			if got := canTransition(from, to); got != allowed[[2]string{from, to}] {
+				t.Errorf("%s -> %s: got %v", from, to, got)
+			}
+		}
+	}
+}
+
+func TestValidInitialState(t *testing.T) {
+	for state, ok := range map[string]bool{TagDraft: true, TagArmed: true, TagDisarmed: false, TagRetired: false, "bogus": false} {
+		if err := validInitialState(state); ok != (err == nil) || (err != nil && !errors.Is(err, ErrInvalidQuery)) {
+			t.Errorf("%s: got %v", state, err)
+		}
+	}
+}
+
+// TestTagStateHandler walks a tag through its states with an API key and
+// checks the audit trail names the key, whatever the body claims.
+func TestTagStateHandler(t *testing.T) {
+	app := newTestApp(t)
+	if err := app.DB.AddAPIKey(context.Background(), &APIKey{TenantID: DefaultTenant, Label: "ci", Hash: hashAPIKey("secret")}); err != nil {
+		t.Fatal(err)
+	}
+	keyed := func(r *http.Request) *http.Request {
+		r.Header.Set("Authorization", "Bearer secret")
+		return r
+	}
+	serve(app, keyed(jsonRequest(t, http.MethodPost, "/tag", map[string]any{"id": testTagID, "hash": "h", "state": TagDraft})))
+
+	for _, tc := range []struct {
+		name string
+		body map[string]any
+		code int
+	}{
+		{"arm", map[string]any{"id": testTagID, "state": TagArmed, "actor": "someone else", "reason": "sent"}, http.StatusOK},
+		{"arm again", map[string]any{"id": testTagID, "state": TagArmed}, http.StatusConflict},
+		{"unknown state", map[string]any{"id": testTagID, "state": "lost"}, http.StatusBadRequest},
+		{"stale version", map[string]any{"id": testTagID, "state": TagDisarmed, "version": 1}, http.StatusConflict},
+		{"disarm", map[string]any{"id": testTagID, "state": TagDisarmed}, http.StatusOK},
+		{"retire", map[string]any{"id": testTagID, "state": TagRetired}, http.StatusOK},
+		{"back from retired", map[string]any{"id": testTagID, "state": TagArmed}, http.StatusConflict},
+		{"unknown tag", map[string]any{"id": testTagID2, "state": TagArmed}, http.StatusNotFound},
+		{"no state", map[string]any{"id": testTagID}, http.StatusBadRequest},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := serve(app, keyed(jsonRequest(t, http.MethodPost, "/tag-state", tc.body)))
+			if w.Code != tc.code {
+				t.Errorf("got %d %s, want %d", w.Code, w.Body, tc.code)
+			}
+		})
+	}
+
+	w := serve(app, keyed(httptest.NewRequest(http.MethodGet, "/tag-transitions?id="+testTagID, nil)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("transitions: %d %s", w.Code, w.Body)
+	}
+	var transitions []TagTransition
+	if err := json.NewDecoder(w.Body).Decode(&transitions); err != nil {
+		t.Fatal(err)
+	}
+	want := [][2]string{{"", TagDraft}, {TagDraft, TagArmed}, {TagArmed, TagDisarmed}, {TagDisarmed, TagRetired}}
+	if len(transitions) != len(want) {
+		t.Fatalf("got %+v", transitions)
+	}
+	for i, tr := range transitions {
+		if tr.From != want[i][0] || tr.To != want[i][1] || tr.Actor != "key:1 (ci)" {
+			t.Errorf("transition %d: got %+v", i, tr)
+		}
+	}
+
+	// a retired tag is gone for the beacon
+	if w := serve(app, httptest.NewRequest(http.MethodGet, "/"+testTagID, nil)); w.Code != http.StatusNotFound {
+		t.Errorf("beacon on a retired tag: got %d", w.Code)
+	}
+}
+
+func TestTagStateAnonymousActor(t *testing.T) {
+	app := newTestApp(t)
+	addTestTag(t, app, map[string]any{"id": testTagID, "hash": "h"})
+	if w := serve(app, jsonRequest(t, http.MethodPost, "/tag-state", map[string]any{"id": testTagID, "state": TagDisarmed, "actor": "admin"})); w.Code != http.StatusOK {
+		t.Fatalf("got %d %s", w.Code, w.Body)
+	}
+	transitions, err := app.DB.GetTagTransitions(context.Background(), testTagID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := transitions[len(transitions)-1]; last.Actor != "anonymous" {
+		t.Errorf("got actor %q, want anonymous", last.Actor)
+	}
+}
@@ -1,19 +1,123 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"go.uber.org/zap"
 )
 
+var (
+	autoMigrate      = flag.Bool("migrate", true, "apply pending schema migrations at startup")
+	partitionsAhead  = flag.Int("partitions-ahead", 3, "months of access log partitions to create ahead of time")
+	dropLegacyAccess = flag.Bool("drop-legacy", false, "drop the old monthly access log tables after import-access-logs instead of renaming them")
+	accessFlush      = flag.Int("access-flush", 5, "seconds between flushes of buffered hits")
+	keyringPath      = flag.String("keyring", "", "JSON keyring used to encrypt sensitive fields, THELP_KEYRING is read if unset")
+	pseudonymKeyPath = flag.String("pseudonym-key", "", "file with the base64 HMAC key for pseudonymized IPs, THELP_PSEUDONYM_KEY is read if unset")
+)
+
 func main() {
 	flag.Parse()
-	db, err := NewPostgresDB(*dbLocation)
+	if *accessFlush <= 0 {
+		log.Fatal("-access-flush must be at least 1 second")
+	}
+	if *accessBatchSize <= 0 || *accessQueueSize <= 0 {
+		log.Fatal("-access-batch and -access-queue must be positive")
+	}
+	if *outOfWindow != OutOfWindowLow && *outOfWindow != OutOfWindowIgnore {
+		log.Fatalf("-out-of-window must be %s or %s", OutOfWindowLow, OutOfWindowIgnore)
+	}
+	classSeverity, err := parseClassificationSeverity(*classificationSeverity)
+	if err != nil {
+		log.Fatal(err)
+	}
+	alertOn, err := parseAlertKinds(*alertKinds)
+	if err != nil {
+		log.Fatal(err)
+	}
+	proxies, err := parseTrustedProxies(*trustedProxies)
+	if err != nil {
+		log.Fatal(err)
+	}
+	db, err := NewDatabase(*dbLocation)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if flag.Arg(0) == "migrate" {
+		if err := runMigrateCommand(db, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if m, ok := db.(Migrator); ok {
+		if *autoMigrate {
+			if err := m.MigrateUp(0); err != nil {
+				log.Fatal(err)
+			}
+		} else {
+			pending, err := pendingMigrations(m)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if pending > 0 {
+				log.Fatalf("%d schema migrations pending, run `thelp migrate up` first", pending)
+			}
+		}
+	}
+	if flag.Arg(0) == "import-access-logs" {
+		p, ok := db.(*PostgresDB)
+		if !ok {
+			log.Fatalf("%T has no legacy access log tables to import", db)
+		}
+		if err := p.ImportLegacyAccessLogs(*dropLegacyAccess); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if p, ok := db.(*PostgresDB); ok {
+		if err := p.EnsureAccessLogPartitions(time.Now(), *partitionsAhead); err != nil {
+			log.Fatal(err)
+		}
+		go p.MaintainAccessLogPartitions(context.Background(), 24*time.Hour, *partitionsAhead)
+	}
+	keys, err := LoadKeyring(*keyringPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if keys != nil {
+		if db, err = NewEncryptedDB(db, keys); err != nil {
+			log.Fatal(err)
+		}
+	}
+	switch flag.Arg(0) {
+	case "keys":
+		if err := runKeysCommand(db, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "tenants":
+		if err := runTenantsCommand(db, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "backup":
+		if err := runBackupCommand(db, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "restore":
+		if err := runRestoreCommand(db, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	logger, err := zap.NewProduction()
 	if err != nil {
 		log.Fatal(err)
@@ -21,7 +125,48 @@ func main() {
 	defer logger.Sync()
 	app := NewApplication("http://localhost:8081", db)
 	app.Logger = logger
+	app.AccessFlushFrequency = *accessFlush
+	app.ClassificationSeverity = classSeverity
+	app.AlertKinds = alertOn
+	app.TrustedProxies = proxies
+	if app.Classifier, err = NewHitClassifier(*hitRulesPath, *hitCIDRsPath); err != nil {
+		log.Fatal(err)
+	}
+	if app.GeoIP, err = NewGeoIP(*geoipCity, *geoipASN); err != nil {
+		log.Fatal(err)
+	}
+	if app.PseudonymKey, err = LoadPseudonymKey(*pseudonymKeyPath); err != nil {
+		log.Fatal(err)
+	}
+	app.Start()
 	// sb := SoundBlockIn880Hz(time.Second)
 	// sb.PlaySound()
-	log.Fatal(http.ListenAndServe(":8081", app.Gateway))
+	srv := &http.Server{Addr: ":8081", Handler: app.Gateway}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go app.ReloadOnHangup(ctx)
+	go app.WatchGeoIP(ctx, *geoipCheck)
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-ctx.Done()
+		logger.Info("shutting down")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *proxyProtocol {
+		ln = &proxyListener{Listener: ln, trusted: app.TrustedProxies}
+	}
+	if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	// Serve returns as soon as Shutdown starts, wait for in-flight
+	// handlers so nothing is enqueued after the writer drains
+	<-shutdownDone
+	app.Stop()
 }
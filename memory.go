@@ -0,0 +1,580 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryDB is a Database that keeps everything in process memory. It is meant
+// for local development and tests, nothing survives a restart.
+type MemoryDB struct {
+	Memory      *sync.RWMutex
+	Tags        map[string]*Tag
+	History     map[string][]TagHistoryItem
+	AccessLogs  []*AccessLog
+	Policies    []*RetentionPolicy
+	Transitions map[string][]TagTransition
+	Campaigns   []*Campaign
+	Tenants     []*Tenant
+	APIKeys     []*APIKey
+	lastID      int64
+}
+
+func NewMemoryDB() *MemoryDB {
+	return &MemoryDB{
+		Memory:      &sync.RWMutex{},
+		Tags:        map[string]*Tag{},
+		History:     map[string][]TagHistoryItem{},
+		Transitions: map[string][]TagTransition{},
+		Tenants:     []*Tenant{{ID: DefaultTenant, Name: DefaultTenant, Created: int(time.Now().Unix())}},
+	}
+}
+
+// tagVisible is m.Tags[id] if ctx may see it. Callers hold the lock.
+func (m *MemoryDB) tagVisible(ctx context.Context, id string) (*Tag, bool) {
+	tag, ok := m.Tags[id]
+	if !ok || !inTenant(ctx, tag.TenantID) {
+		return nil, false
+	}
+	return tag, true
+}
+
+// storedTag copies the fields PostgresDB persists so callers never share
+// state with the store.
+func storedTag(tag *Tag) *Tag {
+	out := &Tag{
+		Memory:        &sync.RWMutex{},
+		ID:            tag.ID,
+		Username:      tag.Username,
+		UsernameIndex: tag.UsernameIndex,
+		FilePath:      tag.FilePath,
+		ClientID:      tag.ClientID,
+		Hash:          tag.Hash,
+		Created:       tag.Created,
+		Version:       tag.Version,
+		ArmAt:         tag.ArmAt,
+		ExpiresAt:     tag.ExpiresAt,
+		ExpiredAt:     tag.ExpiredAt,
+		State:         tag.lifecycle(),
+		CampaignID:    tag.CampaignID,
+		TenantID:      tag.TenantID,
+		Response:      tag.Response,
+		Decoy:         tag.Decoy,
+		TagMetadata:   tag.TagMetadata.clone(),
+	}
+	return out
+}
+
+func (m *MemoryDB) InsertTag(ctx context.Context, tag *Tag, change TagChange) error {
+	m.Memory.Lock()
+	defer m.Memory.Unlock()
+	if existing, ok := m.Tags[tag.ID]; ok {
+		actual := 0
+		if inTenant(ctx, existing.TenantID) {
+			actual = existing.Version
+		}
+		return &ConflictError{ID: tag.ID, Expected: 0, Actual: actual}
+	}
+	tag.Version, tag.TenantID = 1, tenantFor(ctx, tag.TenantID)
+	m.Tags[tag.ID] = storedTag(tag)
+	m.recordTagChange(tag.ID, change)
+	return nil
+}
+
+func (m *MemoryDB) GetTag(ctx context.Context, id string) (*Tag, error) {
+	m.Memory.RLock()
+	tag, ok := m.tagVisible(ctx, id)
+	if ok {
+		tag = storedTag(tag)
+	}
+	m.Memory.RUnlock()
+	if !ok {
+		return nil, ErrNotFound
+	}
+	history, err := recentTagHistory(ctx, m, id)
+	if err != nil {
+		return nil, err
+	}
+	tag.History = history
+	return tag, nil
+}
+
+func (m *MemoryDB) GetTags(ctx context.Context) ([]*Tag, error) {
+	m.Memory.RLock()
+	defer m.Memory.RUnlock()
+	var tags []*Tag
+	for _, tag := range m.Tags {
+		if inTenant(ctx, tag.TenantID) {
+			tags = append(tags, storedTag(tag))
+		}
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		return tags[i].Created < tags[j].Created
+	})
+	return tags, nil
+}
+
+func (m *MemoryDB) FindTags(ctx context.Context, f TagFilter) ([]*Tag, error) {
+	m.Memory.RLock()
+	defer m.Memory.RUnlock()
+	var tags []*Tag
+	for _, tag := range m.Tags {
+		if f.matches(tag) && inTenant(ctx, tag.TenantID) {
+			tags = append(tags, storedTag(tag))
+		}
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		return tags[i].Created < tags[j].Created
+	})
+	return tags, nil
+}
+
+// GetExpiredTags returns the tags whose expires_at has passed at now but
+// that the sweeper hasn't marked yet.
+func (m *MemoryDB) GetExpiredTags(ctx context.Context, now int) ([]*Tag, error) {
+	m.Memory.RLock()
+	defer m.Memory.RUnlock()
+	var tags []*Tag
+	for _, tag := range m.Tags {
+		if tag.ExpiresAt != 0 && tag.ExpiredAt == 0 && tag.ExpiresAt <= now && inTenant(ctx, tag.TenantID) {
+			tags = append(tags, storedTag(tag))
+		}
+	}
+	return tags, nil
+}
+
+// GetTagsByUsername matches either the plaintext username or its blind
+// index, see EncryptedDB.
+func (m *MemoryDB) GetTagsByUsername(ctx context.Context, username string) ([]*Tag, error) {
+	m.Memory.RLock()
+	defer m.Memory.RUnlock()
+	var tags []*Tag
+	for _, tag := range m.Tags {
+		if (tag.Username == username || tag.UsernameIndex == username) && inTenant(ctx, tag.TenantID) {
+			tags = append(tags, storedTag(tag))
+		}
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		return tags[i].Created < tags[j].Created
+	})
+	return tags, nil
+}
+
+func (m *MemoryDB) UpdateTag(ctx context.Context, tag *Tag, change TagChange) error {
+	m.Memory.Lock()
+	defer m.Memory.Unlock()
+	existing, ok := m.tagVisible(ctx, tag.ID)
+	if !ok {
+		return ErrNotFound
+	}
+	if existing.Version != tag.Version {
+		return &ConflictError{ID: tag.ID, Expected: tag.Version, Actual: existing.Version}
+	}
+	tag.Version++
+	tag.TenantID = existing.TenantID
+	m.Tags[tag.ID] = storedTag(tag)
+	m.recordTagChange(tag.ID, change)
+	return nil
+}
+
+func (m *MemoryDB) DeleteTag(ctx context.Context, id string) error {
+	m.Memory.Lock()
+	defer m.Memory.Unlock()
+	if _, ok := m.tagVisible(ctx, id); ok {
+		delete(m.Tags, id)
+	}
+	return nil
+}
+
+func (m *MemoryDB) AddTagTransition(ctx context.Context, t TagTransition) error {
+	m.Memory.Lock()
+	defer m.Memory.Unlock()
+	m.addTagTransition(t)
+	return nil
+}
+
+func (m *MemoryDB) addTagTransition(t TagTransition) {
+	m.lastID++
+	t.ID = m.lastID
+	m.Transitions[t.TagID] = append(m.Transitions[t.TagID], t)
+}
+
+func (m *MemoryDB) GetTagTransitions(ctx context.Context, tagID string) ([]TagTransition, error) {
+	m.Memory.RLock()
+	defer m.Memory.RUnlock()
+	if _, ok := m.tagVisible(ctx, tagID); !ok {
+		return []TagTransition{}, nil
+	}
+	return append([]TagTransition{}, m.Transitions[tagID]...), nil
+}
+
+func (m *MemoryDB) DeleteTagHistory(ctx context.Context, tagID string) error {
+	m.Memory.Lock()
+	defer m.Memory.Unlock()
+	// another tenant's tag, the SQL backends match nothing either
+	if tag, ok := m.Tags[tagID]; ok && !inTenant(ctx, tag.TenantID) {
+		return nil
+	}
+	delete(m.History, tagID)
+	delete(m.Transitions, tagID)
+	return nil
+}
+
+func (m *MemoryDB) AddTagHistory(ctx context.Context, tagID string, item TagHistoryItem) error {
+	m.Memory.Lock()
+	defer m.Memory.Unlock()
+	m.addTagHistory(tagID, item)
+	return nil
+}
+
+// Callers hold the lock.
+func (m *MemoryDB) addTagHistory(tagID string, item TagHistoryItem) {
+	m.lastID++
+	item.ID = m.lastID
+	m.History[tagID] = append(m.History[tagID], item)
+}
+
+// recordTagChange writes what goes with a tag write under the same lock.
+func (m *MemoryDB) recordTagChange(tagID string, change TagChange) {
+	if change.History != nil {
+		m.addTagHistory(tagID, *change.History)
+	}
+	if change.Transition != nil {
+		t := *change.Transition
+		t.TagID = tagID
+		m.addTagTransition(t)
+	}
+}
+
+func (m *MemoryDB) GetTagHistory(ctx context.Context, q TagHistoryQuery) (*TagHistoryPage, error) {
+	cursor, err := q.normalize()
+	if err != nil {
+		return nil, err
+	}
+	m.Memory.RLock()
+	defer m.Memory.RUnlock()
+	var history []TagHistoryItem
+	if _, ok := m.tagVisible(ctx, q.TagID); ok {
+		history = m.History[q.TagID]
+	}
+	var items []TagHistoryItem
+	for i := range history {
+		item := history[i]
+		if q.Descending {
+			item = history[len(history)-1-i]
+		}
+		if cursor != 0 && ((q.Descending && item.ID >= cursor) || (!q.Descending && item.ID <= cursor)) {
+			continue
+		}
+		items = append(items, item)
+		if len(items) > q.Limit {
+			break
+		}
+	}
+	return q.page(items), nil
+}
+
+func (m *MemoryDB) AddAccessLog(ctx context.Context, log *AccessLog) error {
+	m.Memory.Lock()
+	defer m.Memory.Unlock()
+	m.lastID++
+	entry := *log
+	entry.ID = m.lastID
+	entry.Severity = log.severity()
+	entry.Kind = log.kind()
+	entry.TenantID = tenantFor(ctx, log.TenantID)
+	m.AccessLogs = append(m.AccessLogs, &entry)
+	return nil
+}
+
+func (m *MemoryDB) AddAccessLogs(ctx context.Context, logs []*AccessLog) error {
+	for _, log := range logs {
+		if err := m.AddAccessLog(ctx, log); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MemoryDB) QueryAccessLogs(ctx context.Context, q AccessLogQuery) (*AccessLogPage, error) {
+	cursor, prefix, err := q.normalize()
+	if err != nil {
+		return nil, err
+	}
+	q.scope(ctx)
+	m.Memory.RLock()
+	var logs []*AccessLog
+	for _, log := range m.AccessLogs {
+		if q.matches(log, prefix) && q.after(log, cursor) && (q.Tags.empty() || q.Tags.matches(m.Tags[log.TagID])) {
+			entry := *log
+			logs = append(logs, &entry)
+		}
+	}
+	m.Memory.RUnlock()
+	q.sort(logs)
+	if len(logs) > q.Limit+1 {
+		logs = logs[:q.Limit+1]
+	}
+	return q.page(logs), nil
+}
+
+// RewriteTag replaces the stored username, its index and the file path
+// without bumping the version.
+func (m *MemoryDB) RewriteTag(ctx context.Context, tag *Tag) error {
+	m.Memory.Lock()
+	defer m.Memory.Unlock()
+	existing, ok := m.Tags[tag.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	existing.Username, existing.UsernameIndex, existing.FilePath = tag.Username, tag.UsernameIndex, tag.FilePath
+	return nil
+}
+
+// RewriteAccessLogs replaces the ip, user agent, forwarding headers,
+// fields and location of existing logs.
+func (m *MemoryDB) RewriteAccessLogs(ctx context.Context, logs []*AccessLog) error {
+	m.Memory.Lock()
+	defer m.Memory.Unlock()
+	byID := make(map[int64]*AccessLog, len(logs))
+	for _, log := range logs {
+		byID[log.ID] = log
+	}
+	for _, stored := range m.AccessLogs {
+		if log, ok := byID[stored.ID]; ok {
+			stored.IP, stored.UserAgent, stored.Fields = log.IP, log.UserAgent, log.Fields
+			stored.ForwardedFor, stored.Forwarded, stored.Geo = log.ForwardedFor, log.Forwarded, log.Geo
+		}
+	}
+	return nil
+}
+
+func (m *MemoryDB) DeleteAccessLogs(ctx context.Context, q AccessLogQuery) (int64, error) {
+	if err := q.deletable(); err != nil {
+		return 0, err
+	}
+	q.scope(ctx)
+	m.Memory.Lock()
+	defer m.Memory.Unlock()
+	kept := m.AccessLogs[:0]
+	for _, log := range m.AccessLogs {
+		if !q.matches(log, nil) {
+			kept = append(kept, log)
+		}
+	}
+	n := len(m.AccessLogs) - len(kept)
+	m.AccessLogs = kept
+	return int64(n), nil
+}
+
+func (m *MemoryDB) GetRetentionPolicies(ctx context.Context) ([]*RetentionPolicy, error) {
+	m.Memory.RLock()
+	defer m.Memory.RUnlock()
+	var policies []*RetentionPolicy
+	for _, policy := range m.Policies {
+		if !inTenant(ctx, policy.TenantID) {
+			continue
+		}
+		p := *policy
+		policies = append(policies, &p)
+	}
+	sort.Slice(policies, func(i, j int) bool {
+		if policies[i].AfterDays != policies[j].AfterDays {
+			return policies[i].AfterDays < policies[j].AfterDays
+		}
+		return policies[i].ID < policies[j].ID
+	})
+	return policies, nil
+}
+
+func (m *MemoryDB) SaveRetentionPolicy(ctx context.Context, policy *RetentionPolicy) error {
+	m.Memory.Lock()
+	defer m.Memory.Unlock()
+	stored := *policy
+	if policy.ID == 0 {
+		policy.TenantID = tenantFor(ctx, policy.TenantID)
+		stored.TenantID = policy.TenantID
+		m.lastID++
+		policy.ID, stored.ID = m.lastID, m.lastID
+		m.Policies = append(m.Policies, &stored)
+		return nil
+	}
+	for i, existing := range m.Policies {
+		if existing.ID == policy.ID && inTenant(ctx, existing.TenantID) {
+			stored.Created, stored.TenantID = existing.Created, existing.TenantID
+			m.Policies[i] = &stored
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (m *MemoryDB) DeleteRetentionPolicy(ctx context.Context, id int64) error {
+	m.Memory.Lock()
+	defer m.Memory.Unlock()
+	for i, existing := range m.Policies {
+		if existing.ID == id && inTenant(ctx, existing.TenantID) {
+			m.Policies = append(m.Policies[:i], m.Policies[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (m *MemoryDB) GetCampaigns(ctx context.Context) ([]*Campaign, error) {
+	m.Memory.RLock()
+	defer m.Memory.RUnlock()
+	var campaigns []*Campaign
+	for _, c := range m.Campaigns {
+		if !inTenant(ctx, c.TenantID) {
+			continue
+		}
+		stored := *c
+		campaigns = append(campaigns, &stored)
+	}
+	return campaigns, nil
+}
+
+func (m *MemoryDB) GetCampaign(ctx context.Context, id int64) (*Campaign, error) {
+	m.Memory.RLock()
+	defer m.Memory.RUnlock()
+	for _, c := range m.Campaigns {
+		if c.ID == id && inTenant(ctx, c.TenantID) {
+			stored := *c
+			return &stored, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (m *MemoryDB) SaveCampaign(ctx context.Context, c *Campaign) error {
+	m.Memory.Lock()
+	defer m.Memory.Unlock()
+	stored := *c
+	if c.ID == 0 {
+		c.TenantID = tenantFor(ctx, c.TenantID)
+		stored.TenantID = c.TenantID
+		m.lastID++
+		c.ID, stored.ID = m.lastID, m.lastID
+		m.Campaigns = append(m.Campaigns, &stored)
+		return nil
+	}
+	for i, existing := range m.Campaigns {
+		if existing.ID == c.ID && inTenant(ctx, existing.TenantID) {
+			stored.Created, stored.TenantID = existing.Created, existing.TenantID
+			m.Campaigns[i] = &stored
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+// DeleteCampaign removes a campaign, its tags stay but lose the link.
+func (m *MemoryDB) DeleteCampaign(ctx context.Context, id int64) error {
+	m.Memory.Lock()
+	defer m.Memory.Unlock()
+	for i, existing := range m.Campaigns {
+		if existing.ID == id && inTenant(ctx, existing.TenantID) {
+			m.Campaigns = append(m.Campaigns[:i], m.Campaigns[i+1:]...)
+			for _, tag := range m.Tags {
+				if tag.CampaignID == id {
+					tag.CampaignID = 0
+				}
+			}
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (m *MemoryDB) GetTagsByCampaign(ctx context.Context, id int64) ([]*Tag, error) {
+	m.Memory.RLock()
+	defer m.Memory.RUnlock()
+	var tags []*Tag
+	for _, tag := range m.Tags {
+		if tag.CampaignID == id && inTenant(ctx, tag.TenantID) {
+			tags = append(tags, storedTag(tag))
+		}
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		return tags[i].Created < tags[j].Created
+	})
+	return tags, nil
+}
+
+func (m *MemoryDB) GetTenants(ctx context.Context) ([]*Tenant, error) {
+	m.Memory.RLock()
+	defer m.Memory.RUnlock()
+	var tenants []*Tenant
+	for _, t := range m.Tenants {
+		stored := *t
+		tenants = append(tenants, &stored)
+	}
+	sort.Slice(tenants, func(i, j int) bool {
+		return tenants[i].ID < tenants[j].ID
+	})
+	return tenants, nil
+}
+
+func (m *MemoryDB) AddTenant(ctx context.Context, t *Tenant) error {
+	m.Memory.Lock()
+	defer m.Memory.Unlock()
+	for _, existing := range m.Tenants {
+		if existing.ID == t.ID {
+			return fmt.Errorf("%w: tenant %s exists", ErrConflict, t.ID)
+		}
+	}
+	stored := *t
+	m.Tenants = append(m.Tenants, &stored)
+	return nil
+}
+
+func (m *MemoryDB) AddAPIKey(ctx context.Context, k *APIKey) error {
+	m.Memory.Lock()
+	defer m.Memory.Unlock()
+	m.lastID++
+	k.ID = m.lastID
+	stored := *k
+	m.APIKeys = append(m.APIKeys, &stored)
+	return nil
+}
+
+func (m *MemoryDB) GetAPIKey(ctx context.Context, hash string) (*APIKey, error) {
+	m.Memory.RLock()
+	defer m.Memory.RUnlock()
+	for _, k := range m.APIKeys {
+		if k.Hash == hash {
+			stored := *k
+			return &stored, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (m *MemoryDB) GetAPIKeys(ctx context.Context) ([]*APIKey, error) {
+	m.Memory.RLock()
+	defer m.Memory.RUnlock()
+	var keys []*APIKey
+	for _, k := range m.APIKeys {
+		if inTenant(ctx, k.TenantID) {
+			stored := *k
+			keys = append(keys, &stored)
+		}
+	}
+	return keys, nil
+}
+
+func (m *MemoryDB) DeleteAPIKey(ctx context.Context, id int64) error {
+	m.Memory.Lock()
+	defer m.Memory.Unlock()
+	for i, k := range m.APIKeys {
+		if k.ID == id && inTenant(ctx, k.TenantID) {
+			m.APIKeys = append(m.APIKeys[:i], m.APIKeys[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
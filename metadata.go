@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var classificationSeverity = flag.String("classification-severity", "confidential=high,secret=critical", "severity of in-window hits per tag classification, as class=severity pairs, unlisted classes are normal")
+
+// Classification levels, from least to most sensitive. A tag without one
+// is unclassified.
+const (
+	ClassPublic       = "public"
+	ClassInternal     = "internal"
+	ClassConfidential = "confidential"
+	ClassSecret       = "secret"
+)
+
+var classifications = []string{ClassPublic, ClassInternal, ClassConfidential, ClassSecret}
+
+const (
+	maxTagLabels     = 32
+	maxLabelValueLen = 256
+	maxTagNotesLen   = 4096
+)
+
+// label keys can't hold ':' so key:value filters stay unambiguous
+var labelKeyPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_./-]{0,62}$`)
+
+// TagMetadata is what people attach to a tag to find it again, stored as
+// one JSON document next to the tag.
+type TagMetadata struct {
+	Classification string            `json:"classification,omitempty"`
+	Labels         map[string]string `json:"labels,omitempty"`
+	Notes          string            `json:"notes,omitempty"`
+}
+
+func validClassification(class string) bool {
+	for _, c := range classifications {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *TagMetadata) validate() error {
+	m.Classification = strings.ToLower(strings.TrimSpace(m.Classification))
+	if m.Classification != "" && !validClassification(m.Classification) {
+		return fmt.Errorf("%w: classification must be one of %s", ErrInvalidQuery, strings.Join(classifications, ", "))
+	}
+	if len(m.Labels) > maxTagLabels {
+		return fmt.Errorf("%w: at most %d labels", ErrInvalidQuery, maxTagLabels)
+	}
+	for k, v := range m.Labels {
+		if !labelKeyPattern.MatchString(k) {
+			return fmt.Errorf("%w: bad label key %q", ErrInvalidQuery, k)
+		}
+		if len(v) > maxLabelValueLen {
+			return fmt.Errorf("%w: label %s is longer than %d bytes", ErrInvalidQuery, k, maxLabelValueLen)
+		}
+	}
+	if len(m.Notes) > maxTagNotesLen {
+		return fmt.Errorf("%w: notes are longer than %d bytes", ErrInvalidQuery, maxTagNotesLen)
+	}
+	return nil
+}
+
+func (m TagMetadata) clone() TagMetadata {
+	if m.Labels != nil {
+		labels := make(map[string]string, len(m.Labels))
+		for k, v := range m.Labels {
+			labels[k] = v
+		}
+		m.Labels = labels
+	}
+	return m
+}
+
+// merge applies the fields of update that are set. Labels are merged key
+// by key, an empty value removes the label.
+func (m *TagMetadata) merge(update TagMetadata) {
+	if update.Classification != "" {
+		m.Classification = update.Classification
+	}
+	if update.Notes != "" {
+		m.Notes = update.Notes
+	}
+	for k, v := range update.Labels {
+		if v == "" {
+			delete(m.Labels, k)
+			continue
+		}
+		if m.Labels == nil {
+			m.Labels = map[string]string{}
+		}
+		m.Labels[k] = v
+	}
+}
+
+// encode is the stored form, always a JSON object.
+func (m TagMetadata) encode() string {
+	raw, _ := json.Marshal(m)
+	return string(raw)
+}
+
+func decodeTagMetadata(raw []byte) (TagMetadata, error) {
+	var m TagMetadata
+	if len(raw) == 0 {
+		return m, nil
+	}
+	err := json.Unmarshal(raw, &m)
+	return m, err
+}
+
+// TagFilter selects tags by their metadata. Every label has to match.
+type TagFilter struct {
+	Classification string
+	Labels         map[string]string
+}
+
+func (f TagFilter) empty() bool {
+	return f.Classification == "" && len(f.Labels) == 0
+}
+
+func (f TagFilter) matches(tag *Tag) bool {
+	if tag == nil {
+		return false
+	}
+	if f.Classification != "" && tag.Classification != f.Classification {
+		return false
+	}
+	for k, v := range f.Labels {
+		if tag.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// containment is f as a document for the jsonb @> operator.
+func (f TagFilter) containment() string {
+	return TagMetadata{Classification: f.Classification, Labels: f.Labels}.encode()
+}
+
+// parseTagFilter reads ?classification= and any number of
+// ?label=key:value.
+func parseTagFilter(params url.Values) (TagFilter, error) {
+	f := TagFilter{Classification: strings.ToLower(params.Get("classification"))}
+	if f.Classification != "" && !validClassification(f.Classification) {
+		return f, fmt.Errorf("%w: classification must be one of %s", ErrInvalidQuery, strings.Join(classifications, ", "))
+	}
+	for _, label := range params["label"] {
+		k, v, ok := strings.Cut(label, ":")
+		if !ok || !labelKeyPattern.MatchString(k) {
+			return f, fmt.Errorf("%w: label filter must be key:value, got %q", ErrInvalidQuery, label)
+		}
+		if f.Labels == nil {
+			f.Labels = map[string]string{}
+		}
+		f.Labels[k] = v
+	}
+	return f, nil
+}
+
+// parseClassificationSeverity reads the -classification-severity flag.
+func parseClassificationSeverity(s string) (map[string]string, error) {
+	out := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		class, severity, ok := strings.Cut(pair, "=")
+		if !ok || !validClassification(class) {
+			return nil, fmt.Errorf("bad classification severity %q, want class=severity", pair)
+		}
+		switch severity {
+		case SeverityNormal, SeverityHigh, SeverityCritical:
+		default:
+			return nil, fmt.Errorf("bad severity %q for %s, want %s, %s or %s", severity, class, SeverityNormal, SeverityHigh, SeverityCritical)
+		}
+		out[class] = severity
+	}
+	return out, nil
+}
+
+// hitSeverity is the severity of an in-window hit on tag.
+func (a *Application) hitSeverity(tag *Tag) string {
+	if severity, ok := a.ClassificationSeverity[tag.Classification]; ok {
+		return severity
+	}
+	return SeverityNormal
+}
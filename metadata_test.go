@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestTagMetadataValidate(t *testing.T) {
+	tooMany := map[string]string{}
+	for i := 0; i <= maxTagLabels; i++ {
+		tooMany[string(rune('a'+i%26))+strings.Repeat("x", i)] = "v"
+	}
+	for _, tc := range []struct {
+		name string
+		m    TagMetadata
+		ok   bool
+	}{
+		{"empty", TagMetadata{}, true},
+		{"classification", TagMetadata{Classification: " Secret "}, true},
+		{"unknown classification", TagMetadata{Classification: "top"}, false},
+		{"labels", TagMetadata{Labels: map[string]string{"team": "red", "env/prod": "1"}}, true},
+		{"colon in key", TagMetadata{Labels: map[string]string{"a:b": "c"}}, false},
+		{"empty key", TagMetadata{Labels: map[string]string{"": "c"}}, false},
+		{"long value", TagMetadata{Labels: map[string]string{"k": strings.Repeat("v", maxLabelValueLen+1)}}, false},
+		{"too many labels", TagMetadata{Labels: tooMany}, false},
+		{"long notes", TagMetadata{Notes: strings.Repeat("n", maxTagNotesLen+1)}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.m.validate()
+			if tc.ok != (err == nil) || (err != nil && !errors.Is(err, ErrInvalidQuery)) {
+				t.Errorf("got %v", err)
+			}
+		})
+	}
+	m := TagMetadata{Classification: " Secret "}
+	m.validate()
+	if m.Classification != ClassSecret {
+		t.Errorf("classification not normalized: %q", m.Classification)
+	}
+}
+
+func TestTagMetadataMerge(t *testing.T) {
+	m := TagMetadata{Classification: ClassInternal, Labels: map[string]string{"team": "red", "env": "prod"}, Notes: "n"}
+	m.merge(TagMetadata{Classification: ClassSecret, Labels: map[string]string{"team": "", "owner": "bob"}})
+	if m.Classification != ClassSecret || m.Notes != "n" {
+		t.Errorf("got %+v", m)
+	}
+	want := map[string]string{"env": "prod", "owner": "bob"}
+	if len(m.Labels) != len(want) || m.Labels["env"] != "prod" || m.Labels["owner"] != "bob" {
+		t.Errorf("labels %v, want %v", m.Labels, want)
+	}
+}
+
+func TestParseTagFilter(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		ok    bool
+		want  TagFilter
+	}{
+		{"", true, TagFilter{}},
+		{"classification=SECRET", true, TagFilter{Classification: ClassSecret}},
+		{"classification=top", false, TagFilter{}},
+		{"label=team:red&label=env:a:b", true, TagFilter{Labels: map[string]string{"team": "red", "env": "a:b"}}},
+		{"label=team", false, TagFilter{}},
+		{"label=bad%20key:v", false, TagFilter{}},
+	} {
+		params, _ := url.ParseQuery(tc.query)
+		f, err := parseTagFilter(params)
+		if tc.ok != (err == nil) || (err != nil && !errors.Is(err, ErrInvalidQuery)) {
+			t.Errorf("%q: got %v", tc.query, err)
+			continue
+		}
+		if !tc.ok {
+			continue
+		}
+		if f.Classification != tc.want.Classification || len(f.Labels) != len(tc.want.Labels) {
+			t.Errorf("%q: got %+v", tc.query, f)
+		}
+		for k, v := range tc.want.Labels {
+			if f.Labels[k] != v {
+				t.Errorf("%q: label %s = %q, want %q", tc.query, k, f.Labels[k], v)
+			}
+		}
+	}
+}
+
+func TestParseClassificationSeverity(t *testing.T) {
+	for _, tc := range []struct {
+		raw  string
+		ok   bool
+		want map[string]string
+	}{
+		{"", true, map[string]string{}},
+		{"confidential=high, secret=critical", true, map[string]string{ClassConfidential: SeverityHigh, ClassSecret: SeverityCritical}},
+		{"secret", false, nil},
+		{"top=high", false, nil},
+		{"secret=low", false, nil},
+	} {
+		got, err := parseClassificationSeverity(tc.raw)
+		if tc.ok != (err == nil) {
+			t.Errorf("%q: got %v", tc.raw, err)
+			continue
+		}
+		if len(got) != len(tc.want) {
+			t.Errorf("%q: got %v, want %v", tc.raw, got, tc.want)
+		}
+		for k, v := range tc.want {
+			if got[k] != v {
+				t.Errorf("%q: %s = %q, want %q", tc.raw, k, got[k], v)
+			}
+		}
+	}
+}
+
+// TestMetadataFilters sets metadata through /tag and finds tags and hits
+// by it.
+func TestMetadataFilters(t *testing.T) {
+	app := newTestApp(t)
+	addTestTag(t, app, map[string]any{"id": testTagID, "hash": "h", "classification": "secret", "labels": map[string]string{"team": "red"}})
+	addTestTag(t, app, map[string]any{"id": testTagID2, "hash": "h", "classification": "internal", "labels": map[string]string{"team": "blue"}})
+	if w := serve(app, jsonRequest(t, http.MethodPost, "/tag", map[string]any{"id": testTagID2, "hash": "h", "classification": "top"})); w.Code != http.StatusBadRequest {
+		t.Errorf("bad classification: got %d", w.Code)
+	}
+	ctx := context.Background()
+	for _, id := range []string{testTagID, testTagID2} {
+		if err := app.DB.AddAccessLog(ctx, &AccessLog{IP: "203.0.113.7", Timestamp: 100, TagID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		path string
+		code int
+		want int
+	}{
+		{"/tags?classification=secret", http.StatusOK, 1},
+		{"/tags?label=team:blue", http.StatusOK, 1},
+		{"/tags?label=team:green", http.StatusOK, 0},
+		{"/tags?label=team", http.StatusBadRequest, 0},
+		{"/access?classification=internal", http.StatusOK, 1},
+		{"/access?label=team:red&classification=secret", http.StatusOK, 1},
+		{"/access?label=team:red&classification=internal", http.StatusOK, 0},
+	} {
+		t.Run(tc.path, func(t *testing.T) {
+			w := serve(app, httptest.NewRequest(http.MethodGet, tc.path, nil))
+			if w.Code != tc.code {
+				t.Fatalf("got %d %s, want %d", w.Code, w.Body, tc.code)
+			}
+			if tc.code != http.StatusOK {
+				return
+			}
+			var n int
+			if strings.HasPrefix(tc.path, "/tags") {
+				var tags []*Tag
+				if err := json.NewDecoder(w.Body).Decode(&tags); err != nil {
+					t.Fatal(err)
+				}
+				n = len(tags)
+			} else {
+				var page AccessLogPage
+				if err := json.NewDecoder(w.Body).Decode(&page); err != nil {
+					t.Fatal(err)
+				}
+				n = len(page.Logs)
+			}
+			if n != tc.want {
+				t.Errorf("got %d, want %d", n, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+//go:embed migrations
+var migrationFiles embed.FS
+
+// Migration is one numbered schema change, read from
+// migrations/<backend>/NNNN_name.up.sql and the matching .down.sql.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+type MigrationStatus struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name"`
+	AppliedAt *time.Time `json:"applied_at,omitempty"`
+}
+
+// Migrator is implemented by the Database backends that keep a versioned
+// schema.
+type Migrator interface {
+	MigrateUp(target int) error
+	MigrateDown(steps int) error
+	MigrationStatus() ([]MigrationStatus, error)
+}
+
+func loadMigrations(dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		name := entry.Name()
+		var direction string
+		switch {
+		case strings.HasSuffix(name, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(name, ".down.sql"):
+			direction = "down"
+		default:
+			continue
+		}
+		base := strings.TrimSuffix(name, "."+direction+".sql")
+		num, label, ok := strings.Cut(base, "_")
+		if !ok {
+			return nil, fmt.Errorf("bad migration file name %s", name)
+		}
+		version, err := strconv.Atoi(num)
+		if err != nil {
+			return nil, fmt.Errorf("bad migration version in %s: %v", name, err)
+		}
+		data, err := fs.ReadFile(migrationFiles, path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: label}
+			byVersion[version] = m
+		}
+		if direction == "up" {
+			m.Up = string(data)
+		} else {
+			m.Down = string(data)
+		}
+	}
+	var migrations []Migration
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %04d_%s has no up file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// migrationLockKey is the advisory lock held while migrating so two instances
+// starting together don't race each other.
+const migrationLockKey = 7_262_001
+
+func (p *PostgresDB) withMigrationLock(fn func(conn *pgx.Conn) error) error {
+	ctx := context.Background()
+	conn, err := p.Pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	if _, err := conn.Exec(ctx, `SELECT pg_advisory_lock($1)`, migrationLockKey); err != nil {
+		return fmt.Errorf("failed to take migration lock: %v", err)
+	}
+	defer conn.Exec(ctx, `SELECT pg_advisory_unlock($1)`, migrationLockKey)
+	if _, err := conn.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INT PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)
+	`); err != nil {
+		return err
+	}
+	return fn(conn.Conn())
+}
+
+// migrationSession is a backend's view of schema_migrations while the
+// migration lock is held.
+type migrationSession interface {
+	applied() (map[int]time.Time, error)
+	run(m Migration, up bool) error
+}
+
+// migrateUp applies every pending migration up to and including target, or
+// all of them when target is 0.
+func migrateUp(migrations []Migration, s migrationSession, target int) error {
+	applied, err := s.applied()
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if target > 0 && m.Version > target {
+			break
+		}
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		fmt.Printf("applying migration %04d_%s\n", m.Version, m.Name)
+		if err := s.run(m, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateDown rolls back the most recent steps applied migrations.
+func migrateDown(migrations []Migration, s migrationSession, steps int) error {
+	applied, err := s.applied()
+	if err != nil {
+		return err
+	}
+	for i := len(migrations) - 1; i >= 0 && steps > 0; i-- {
+		m := migrations[i]
+		if _, ok := applied[m.Version]; !ok {
+			continue
+		}
+		if m.Down == "" {
+			return fmt.Errorf("migration %04d_%s has no down file", m.Version, m.Name)
+		}
+		fmt.Printf("reverting migration %04d_%s\n", m.Version, m.Name)
+		if err := s.run(m, false); err != nil {
+			return err
+		}
+		steps--
+	}
+	return nil
+}
+
+func migrationStatus(migrations []Migration, s migrationSession) ([]MigrationStatus, error) {
+	applied, err := s.applied()
+	if err != nil {
+		return nil, err
+	}
+	var status []MigrationStatus
+	for _, m := range migrations {
+		ms := MigrationStatus{Version: m.Version, Name: m.Name}
+		if at, ok := applied[m.Version]; ok {
+			ms.AppliedAt = &at
+		}
+		status = append(status, ms)
+	}
+	return status, nil
+}
+
+type pgMigrationSession struct {
+	conn *pgx.Conn
+}
+
+func (s pgMigrationSession) applied() (map[int]time.Time, error) {
+	rows, err := s.conn.Query(context.Background(), `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		applied[version] = at
+	}
+	return applied, rows.Err()
+}
+
+func (s pgMigrationSession) run(m Migration, up bool) error {
+	ctx := context.Background()
+	tx, err := s.conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	if up {
+		if _, err := tx.Exec(ctx, m.Up); err != nil {
+			return fmt.Errorf("migration %04d_%s up failed: %v", m.Version, m.Name, err)
+		}
+		if _, err := tx.Exec(ctx, `INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, m.Version, m.Name); err != nil {
+			return err
+		}
+	} else {
+		if _, err := tx.Exec(ctx, m.Down); err != nil {
+			return fmt.Errorf("migration %04d_%s down failed: %v", m.Version, m.Name, err)
+		}
+		if _, err := tx.Exec(ctx, `DELETE FROM schema_migrations WHERE version = $1`, m.Version); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+func (p *PostgresDB) MigrateUp(target int) error {
+	migrations, err := loadMigrations("migrations/postgres")
+	if err != nil {
+		return err
+	}
+	return p.withMigrationLock(func(conn *pgx.Conn) error {
+		return migrateUp(migrations, pgMigrationSession{conn}, target)
+	})
+}
+
+func (p *PostgresDB) MigrateDown(steps int) error {
+	migrations, err := loadMigrations("migrations/postgres")
+	if err != nil {
+		return err
+	}
+	return p.withMigrationLock(func(conn *pgx.Conn) error {
+		return migrateDown(migrations, pgMigrationSession{conn}, steps)
+	})
+}
+
+func (p *PostgresDB) MigrationStatus() ([]MigrationStatus, error) {
+	migrations, err := loadMigrations("migrations/postgres")
+	if err != nil {
+		return nil, err
+	}
+	var status []MigrationStatus
+	err = p.withMigrationLock(func(conn *pgx.Conn) error {
+		status, err = migrationStatus(migrations, pgMigrationSession{conn})
+		return err
+	})
+	return status, err
+}
+
+// pendingMigrations counts migrations that have not been applied yet.
+func pendingMigrations(m Migrator) (int, error) {
+	status, err := m.MigrationStatus()
+	if err != nil {
+		return 0, err
+	}
+	pending := 0
+	for _, s := range status {
+		if s.AppliedAt == nil {
+			pending++
+		}
+	}
+	return pending, nil
+}
+
+// runMigrateCommand implements `thelp migrate up [version]`,
+// `thelp migrate down [steps]` and `thelp migrate status`.
+func runMigrateCommand(db Database, args []string) error {
+	m, ok := db.(Migrator)
+	if !ok {
+		return fmt.Errorf("%T does not support migrations", db)
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("usage: thelp migrate up [version] | down [steps] | status")
+	}
+	n := 0
+	if len(args) > 1 {
+		var err error
+		n, err = strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("bad migration count %q: %v", args[1], err)
+		}
+	}
+	switch args[0] {
+	case "up":
+		return m.MigrateUp(n)
+	case "down":
+		if n == 0 {
+			n = 1
+		}
+		return m.MigrateDown(n)
+	case "status":
+		status, err := m.MigrationStatus()
+		if err != nil {
+			return err
+		}
+		for _, s := range status {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%s\t%s\n", s.Version, s.Name, applied)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown migrate command %q", args[0])
+	}
+}
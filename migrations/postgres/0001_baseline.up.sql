@@ -0,0 +1,13 @@
+-- baseline: the schema createTables used to build. IF NOT EXISTS keeps this a
+-- no-op on deployments that predate migrations.
+CREATE TABLE IF NOT EXISTS tags (
+	id UUID PRIMARY KEY,
+	username TEXT,
+	file_path TEXT,
+	client_id TEXT,
+	hash TEXT,
+	url TEXT,
+	created INT,
+	history JSONB,
+	access JSONB
+);
@@ -0,0 +1,15 @@
+-- one parent table for every hit, range partitioned by month on the unix
+-- timestamp. partitions are created ahead of time by the server, the default
+-- partition only catches rows for months nobody created yet.
+CREATE TABLE IF NOT EXISTS access_logs (
+	id BIGSERIAL,
+	ip TEXT,
+	user_agent TEXT,
+	timestamp INT NOT NULL,
+	tag_id TEXT,
+	PRIMARY KEY (id, timestamp)
+) PARTITION BY RANGE (timestamp);
+
+CREATE INDEX IF NOT EXISTS access_logs_tag_id_timestamp_idx ON access_logs (tag_id, timestamp);
+
+CREATE TABLE IF NOT EXISTS access_logs_default PARTITION OF access_logs DEFAULT;
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS access_logs_timestamp_id_idx;
+DROP FUNCTION IF EXISTS access_log_inet(TEXT);
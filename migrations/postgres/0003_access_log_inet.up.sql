@@ -0,0 +1,18 @@
+-- ip is free text and older rows carry a port or a whole X-Forwarded-For
+-- chain, so CIDR filters go through this instead of a plain ::inet cast.
+CREATE OR REPLACE FUNCTION access_log_inet(raw TEXT) RETURNS INET AS $$
+DECLARE
+	host TEXT := btrim(split_part(raw, ',', 1));
+BEGIN
+	IF host ~ '^\[.*\]:[0-9]+$' THEN
+		host := substring(host FROM '^\[(.*)\]:[0-9]+$');
+	ELSIF host ~ '^[0-9.]+:[0-9]+$' THEN
+		host := split_part(host, ':', 1);
+	END IF;
+	RETURN host::inet;
+EXCEPTION WHEN others THEN
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql IMMUTABLE;
+
+CREATE INDEX IF NOT EXISTS access_logs_timestamp_id_idx ON access_logs (timestamp, id);
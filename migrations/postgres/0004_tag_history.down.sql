@@ -0,0 +1,12 @@
+ALTER TABLE tags ADD COLUMN IF NOT EXISTS history JSONB;
+
+UPDATE tags t
+SET history = h.items
+FROM (
+	SELECT tag_id, jsonb_agg(jsonb_build_object('client_id', client_id, 'hash', hash, 'created', created) ORDER BY id) AS items
+	FROM tag_history
+	GROUP BY tag_id
+) h
+WHERE h.tag_id = t.id;
+
+DROP TABLE IF EXISTS tag_history;
@@ -0,0 +1,22 @@
+-- every re-tag event gets its own row instead of living in a capped JSONB
+-- array that is rewritten on every update. no foreign key on purpose, the
+-- audit trail outlives the tag.
+CREATE TABLE IF NOT EXISTS tag_history (
+	id BIGSERIAL PRIMARY KEY,
+	tag_id UUID NOT NULL,
+	client_id TEXT,
+	hash TEXT,
+	created INT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS tag_history_tag_id_idx ON tag_history (tag_id, id);
+
+INSERT INTO tag_history (tag_id, client_id, hash, created)
+SELECT t.id, e.item->>'client_id', e.item->>'hash', COALESCE((e.item->>'created')::int, 0)
+FROM tags t
+CROSS JOIN LATERAL jsonb_array_elements(
+	CASE WHEN jsonb_typeof(t.history) = 'array' THEN t.history ELSE '[]'::jsonb END
+) WITH ORDINALITY AS e(item, n)
+ORDER BY t.id, e.n;
+
+ALTER TABLE tags DROP COLUMN IF EXISTS history;
@@ -0,0 +1,2 @@
+-- bumped on every update so writers can detect they lost a race
+ALTER TABLE tags ADD COLUMN IF NOT EXISTS version INT NOT NULL DEFAULT 1;
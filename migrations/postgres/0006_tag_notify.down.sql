@@ -0,0 +1,2 @@
+DROP TRIGGER IF EXISTS tags_notify ON tags;
+DROP FUNCTION IF EXISTS notify_tag_change();
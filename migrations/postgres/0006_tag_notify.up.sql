@@ -0,0 +1,26 @@
+-- every change to tags is broadcast on the thelp_tags channel so other
+-- instances can drop their cached copy. origin is the writer's
+-- application_name, which lets an instance skip its own events.
+CREATE OR REPLACE FUNCTION notify_tag_change() RETURNS trigger AS $$
+DECLARE
+	rec tags%ROWTYPE;
+BEGIN
+	IF TG_OP = 'DELETE' THEN
+		rec := OLD;
+	ELSE
+		rec := NEW;
+	END IF;
+	PERFORM pg_notify('thelp_tags', json_build_object(
+		'op', lower(TG_OP),
+		'id', rec.id,
+		'version', rec.version,
+		'origin', current_setting('application_name', true)
+	)::text);
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS tags_notify ON tags;
+CREATE TRIGGER tags_notify
+	AFTER INSERT OR UPDATE OR DELETE ON tags
+	FOR EACH ROW EXECUTE FUNCTION notify_tag_change();
@@ -0,0 +1,14 @@
+-- what happens to access records once they reach a certain age. tag_id is
+-- NULL for the global policies, a tag with policies of its own is exempt
+-- from those. applied_until is the cutoff the last run got through.
+CREATE TABLE IF NOT EXISTS retention_policies (
+	id BIGSERIAL PRIMARY KEY,
+	tag_id TEXT,
+	action TEXT NOT NULL,
+	after_days INT NOT NULL,
+	drop_user_agent BOOLEAN NOT NULL DEFAULT FALSE,
+	applied_until INT NOT NULL DEFAULT 0,
+	created INT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS retention_policies_tag_id_idx ON retention_policies (tag_id);
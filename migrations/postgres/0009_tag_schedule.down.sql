@@ -0,0 +1,5 @@
+ALTER TABLE access_logs DROP COLUMN IF EXISTS severity;
+DROP INDEX IF EXISTS tags_expires_at_idx;
+ALTER TABLE tags DROP COLUMN IF EXISTS expired_at;
+ALTER TABLE tags DROP COLUMN IF EXISTS expires_at;
+ALTER TABLE tags DROP COLUMN IF EXISTS arm_at;
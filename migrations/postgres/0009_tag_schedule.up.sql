@@ -0,0 +1,8 @@
+-- a tag only raises full-severity hits between arm_at and expires_at, 0
+-- means no bound. expired_at is set by the sweeper once a tag has lapsed.
+ALTER TABLE tags ADD COLUMN IF NOT EXISTS arm_at INT NOT NULL DEFAULT 0;
+ALTER TABLE tags ADD COLUMN IF NOT EXISTS expires_at INT NOT NULL DEFAULT 0;
+ALTER TABLE tags ADD COLUMN IF NOT EXISTS expired_at INT NOT NULL DEFAULT 0;
+CREATE INDEX IF NOT EXISTS tags_expires_at_idx ON tags (expires_at) WHERE expires_at <> 0 AND expired_at = 0;
+
+ALTER TABLE access_logs ADD COLUMN IF NOT EXISTS severity TEXT NOT NULL DEFAULT 'normal';
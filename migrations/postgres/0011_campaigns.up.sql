@@ -0,0 +1,15 @@
+-- a campaign groups the tags seeded for one deception, e.g. a fake data
+-- room. the defaults apply to tags created in it that don't set their own.
+CREATE TABLE IF NOT EXISTS campaigns (
+	id BIGSERIAL PRIMARY KEY,
+	name TEXT NOT NULL,
+	owner TEXT NOT NULL DEFAULT '',
+	description TEXT NOT NULL DEFAULT '',
+	default_state TEXT NOT NULL DEFAULT '',
+	default_arm_at INT NOT NULL DEFAULT 0,
+	default_expires_at INT NOT NULL DEFAULT 0,
+	created INT NOT NULL
+);
+
+ALTER TABLE tags ADD COLUMN IF NOT EXISTS campaign_id BIGINT REFERENCES campaigns (id) ON DELETE SET NULL;
+CREATE INDEX IF NOT EXISTS tags_campaign_id_idx ON tags (campaign_id) WHERE campaign_id IS NOT NULL;
@@ -0,0 +1,28 @@
+-- every tag, access log, campaign and retention policy belongs to a
+-- tenant. what existed before goes to the default tenant.
+CREATE TABLE IF NOT EXISTS tenants (
+	id TEXT PRIMARY KEY,
+	name TEXT NOT NULL DEFAULT '',
+	created INT NOT NULL
+);
+INSERT INTO tenants (id, name, created)
+VALUES ('default', 'default', extract(epoch FROM now())::int)
+ON CONFLICT (id) DO NOTHING;
+
+-- only a sha256 of each key is kept
+CREATE TABLE IF NOT EXISTS api_keys (
+	id BIGSERIAL PRIMARY KEY,
+	tenant_id TEXT NOT NULL REFERENCES tenants (id) ON DELETE CASCADE,
+	key_hash TEXT NOT NULL UNIQUE,
+	label TEXT NOT NULL DEFAULT '',
+	created INT NOT NULL
+);
+
+ALTER TABLE tags ADD COLUMN IF NOT EXISTS tenant_id TEXT NOT NULL DEFAULT 'default';
+CREATE INDEX IF NOT EXISTS tags_tenant_id_idx ON tags (tenant_id, created);
+
+ALTER TABLE access_logs ADD COLUMN IF NOT EXISTS tenant_id TEXT NOT NULL DEFAULT 'default';
+CREATE INDEX IF NOT EXISTS access_logs_tenant_id_idx ON access_logs (tenant_id, timestamp, id);
+
+ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS tenant_id TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE retention_policies ADD COLUMN IF NOT EXISTS tenant_id TEXT NOT NULL DEFAULT 'default';
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS tags_metadata_idx;
+ALTER TABLE tags DROP COLUMN IF EXISTS metadata;
@@ -0,0 +1,4 @@
+-- classification, labels and notes live in one document per tag. the GIN
+-- index serves the @> lookups tag listing and access queries filter with.
+ALTER TABLE tags ADD COLUMN IF NOT EXISTS metadata JSONB NOT NULL DEFAULT '{}';
+CREATE INDEX IF NOT EXISTS tags_metadata_idx ON tags USING GIN (metadata jsonb_path_ops);
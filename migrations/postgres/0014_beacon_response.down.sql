@@ -0,0 +1,2 @@
+ALTER TABLE tags DROP COLUMN IF EXISTS decoy;
+ALTER TABLE tags DROP COLUMN IF EXISTS response;
@@ -0,0 +1,4 @@
+-- what the beacon answers a tag's hits with. empty goes by the request,
+-- decoy names a file in the decoy directory for response 'decoy'.
+ALTER TABLE tags ADD COLUMN IF NOT EXISTS response TEXT NOT NULL DEFAULT '';
+ALTER TABLE tags ADD COLUMN IF NOT EXISTS decoy TEXT NOT NULL DEFAULT '';
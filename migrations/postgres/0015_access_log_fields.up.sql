@@ -0,0 +1,3 @@
+-- document fields a PDF form submission carried, the file path and the
+-- like. NULL for every other hit.
+ALTER TABLE access_logs ADD COLUMN IF NOT EXISTS fields JSONB;
@@ -0,0 +1,6 @@
+ALTER TABLE access_logs DROP COLUMN IF EXISTS geo_org;
+ALTER TABLE access_logs DROP COLUMN IF EXISTS geo_asn;
+ALTER TABLE access_logs DROP COLUMN IF EXISTS geo_longitude;
+ALTER TABLE access_logs DROP COLUMN IF EXISTS geo_latitude;
+ALTER TABLE access_logs DROP COLUMN IF EXISTS geo_city;
+ALTER TABLE access_logs DROP COLUMN IF EXISTS geo_country;
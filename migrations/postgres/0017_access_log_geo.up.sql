@@ -0,0 +1,8 @@
+-- where a hit came from according to the local GeoIP databases, NULL when
+-- it wasn't enriched. geo_country is set for every enriched hit.
+ALTER TABLE access_logs ADD COLUMN IF NOT EXISTS geo_country TEXT;
+ALTER TABLE access_logs ADD COLUMN IF NOT EXISTS geo_city TEXT;
+ALTER TABLE access_logs ADD COLUMN IF NOT EXISTS geo_latitude DOUBLE PRECISION;
+ALTER TABLE access_logs ADD COLUMN IF NOT EXISTS geo_longitude DOUBLE PRECISION;
+ALTER TABLE access_logs ADD COLUMN IF NOT EXISTS geo_asn BIGINT;
+ALTER TABLE access_logs ADD COLUMN IF NOT EXISTS geo_org TEXT;
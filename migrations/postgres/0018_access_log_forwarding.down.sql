@@ -0,0 +1,2 @@
+ALTER TABLE access_logs DROP COLUMN IF EXISTS forwarded;
+ALTER TABLE access_logs DROP COLUMN IF EXISTS forwarded_for;
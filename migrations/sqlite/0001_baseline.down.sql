@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS access_logs;
+DROP TABLE IF EXISTS tags;
@@ -0,0 +1,22 @@
+CREATE TABLE IF NOT EXISTS tags (
+	id TEXT PRIMARY KEY,
+	username TEXT,
+	file_path TEXT,
+	client_id TEXT,
+	hash TEXT,
+	url TEXT,
+	created INTEGER,
+	history TEXT,
+	access TEXT
+);
+
+CREATE TABLE IF NOT EXISTS access_logs (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	ip TEXT,
+	user_agent TEXT,
+	timestamp INTEGER NOT NULL,
+	tag_id TEXT
+);
+
+CREATE INDEX IF NOT EXISTS access_logs_tag_id_timestamp_idx ON access_logs (tag_id, timestamp);
+CREATE INDEX IF NOT EXISTS access_logs_timestamp_id_idx ON access_logs (timestamp, id);
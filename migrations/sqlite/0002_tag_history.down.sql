@@ -0,0 +1,8 @@
+ALTER TABLE tags ADD COLUMN history TEXT;
+
+UPDATE tags SET history = (
+	SELECT json_group_array(json_object('client_id', client_id, 'hash', hash, 'created', created))
+	FROM (SELECT client_id, hash, created FROM tag_history h WHERE h.tag_id = tags.id ORDER BY h.id)
+);
+
+DROP TABLE tag_history;
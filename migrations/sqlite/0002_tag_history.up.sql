@@ -0,0 +1,22 @@
+-- every re-tag event gets its own row instead of living in a capped JSON
+-- array on the tag
+CREATE TABLE IF NOT EXISTS tag_history (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	tag_id TEXT NOT NULL,
+	client_id TEXT,
+	hash TEXT,
+	created INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS tag_history_tag_id_idx ON tag_history (tag_id, id);
+
+INSERT INTO tag_history (tag_id, client_id, hash, created)
+SELECT t.id,
+	json_extract(h.value, '$.client_id'),
+	json_extract(h.value, '$.hash'),
+	COALESCE(json_extract(h.value, '$.created'), 0)
+FROM tags t, json_each(t.history) h
+WHERE json_type(t.history) = 'array'
+ORDER BY t.id, h.key;
+
+ALTER TABLE tags DROP COLUMN history;
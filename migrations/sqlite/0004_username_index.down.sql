@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS tags_username_idx;
+DROP INDEX IF EXISTS tags_username_index_idx;
+ALTER TABLE tags DROP COLUMN username_index;
@@ -0,0 +1,5 @@
+-- keyed hash of the username, lets lookups by username keep working once
+-- EncryptedDB stores the username itself as ciphertext
+ALTER TABLE tags ADD COLUMN username_index TEXT;
+CREATE INDEX IF NOT EXISTS tags_username_index_idx ON tags (username_index);
+CREATE INDEX IF NOT EXISTS tags_username_idx ON tags (username);
@@ -0,0 +1,14 @@
+-- what happens to access records once they reach a certain age. tag_id is
+-- NULL for the global policies, a tag with policies of its own is exempt
+-- from those. applied_until is the cutoff the last run got through.
+CREATE TABLE IF NOT EXISTS retention_policies (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	tag_id TEXT,
+	action TEXT NOT NULL,
+	after_days INTEGER NOT NULL,
+	drop_user_agent INTEGER NOT NULL DEFAULT 0,
+	applied_until INTEGER NOT NULL DEFAULT 0,
+	created INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS retention_policies_tag_id_idx ON retention_policies (tag_id);
@@ -0,0 +1,5 @@
+ALTER TABLE access_logs DROP COLUMN severity;
+DROP INDEX IF EXISTS tags_expires_at_idx;
+ALTER TABLE tags DROP COLUMN expired_at;
+ALTER TABLE tags DROP COLUMN expires_at;
+ALTER TABLE tags DROP COLUMN arm_at;
@@ -0,0 +1,16 @@
+-- lifecycle state, see tagTransitions in lifecycle.go. tags that existed
+-- before this were live, so they start out armed.
+ALTER TABLE tags ADD COLUMN state TEXT NOT NULL DEFAULT 'armed';
+
+-- audit trail of state changes, kept after the tag is gone like tag_history
+CREATE TABLE IF NOT EXISTS tag_transitions (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	tag_id TEXT NOT NULL,
+	from_state TEXT NOT NULL,
+	to_state TEXT NOT NULL,
+	actor TEXT,
+	reason TEXT,
+	created INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS tag_transitions_tag_id_idx ON tag_transitions (tag_id, id);
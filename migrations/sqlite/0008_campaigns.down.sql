@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS tags_campaign_id_idx;
+ALTER TABLE tags DROP COLUMN campaign_id;
+DROP TABLE IF EXISTS campaigns;
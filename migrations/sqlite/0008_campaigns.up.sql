@@ -0,0 +1,17 @@
+-- a campaign groups the tags seeded for one deception, e.g. a fake data
+-- room. the defaults apply to tags created in it that don't set their own.
+CREATE TABLE IF NOT EXISTS campaigns (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL,
+	owner TEXT NOT NULL DEFAULT '',
+	description TEXT NOT NULL DEFAULT '',
+	default_state TEXT NOT NULL DEFAULT '',
+	default_arm_at INTEGER NOT NULL DEFAULT 0,
+	default_expires_at INTEGER NOT NULL DEFAULT 0,
+	created INTEGER NOT NULL
+);
+
+-- no REFERENCES here, sqlite can't drop a column that has one.
+-- DeleteCampaign unlinks the tags itself.
+ALTER TABLE tags ADD COLUMN campaign_id INTEGER;
+CREATE INDEX IF NOT EXISTS tags_campaign_id_idx ON tags (campaign_id) WHERE campaign_id IS NOT NULL;
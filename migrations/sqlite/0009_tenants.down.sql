@@ -0,0 +1,8 @@
+ALTER TABLE retention_policies DROP COLUMN tenant_id;
+ALTER TABLE campaigns DROP COLUMN tenant_id;
+DROP INDEX IF EXISTS access_logs_tenant_id_idx;
+ALTER TABLE access_logs DROP COLUMN tenant_id;
+DROP INDEX IF EXISTS tags_tenant_id_idx;
+ALTER TABLE tags DROP COLUMN tenant_id;
+DROP TABLE IF EXISTS api_keys;
+DROP TABLE IF EXISTS tenants;
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS tags_classification_idx;
+ALTER TABLE tags DROP COLUMN metadata;
@@ -0,0 +1,4 @@
+-- classification, labels and notes live in one JSON document per tag.
+-- classification is what gets filtered on most, so it gets an index.
+ALTER TABLE tags ADD COLUMN metadata TEXT NOT NULL DEFAULT '{}';
+CREATE INDEX IF NOT EXISTS tags_classification_idx ON tags (json_extract(metadata, '$.classification'));
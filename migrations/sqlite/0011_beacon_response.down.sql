@@ -0,0 +1,2 @@
+ALTER TABLE tags DROP COLUMN decoy;
+ALTER TABLE tags DROP COLUMN response;
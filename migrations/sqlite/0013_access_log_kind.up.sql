@@ -0,0 +1,3 @@
+-- what was behind a hit: human, preview, scanner, proxy or unknown. hits
+-- from before the classifier can't be told apart any more.
+ALTER TABLE access_logs ADD COLUMN kind TEXT NOT NULL DEFAULT 'unknown';
@@ -0,0 +1,6 @@
+ALTER TABLE access_logs DROP COLUMN geo_org;
+ALTER TABLE access_logs DROP COLUMN geo_asn;
+ALTER TABLE access_logs DROP COLUMN geo_longitude;
+ALTER TABLE access_logs DROP COLUMN geo_latitude;
+ALTER TABLE access_logs DROP COLUMN geo_city;
+ALTER TABLE access_logs DROP COLUMN geo_country;
@@ -0,0 +1,8 @@
+-- where a hit came from according to the local GeoIP databases, NULL when
+-- it wasn't enriched. geo_country is set for every enriched hit.
+ALTER TABLE access_logs ADD COLUMN geo_country TEXT;
+ALTER TABLE access_logs ADD COLUMN geo_city TEXT;
+ALTER TABLE access_logs ADD COLUMN geo_latitude REAL;
+ALTER TABLE access_logs ADD COLUMN geo_longitude REAL;
+ALTER TABLE access_logs ADD COLUMN geo_asn INTEGER;
+ALTER TABLE access_logs ADD COLUMN geo_org TEXT;
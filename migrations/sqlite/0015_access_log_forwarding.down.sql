@@ -0,0 +1,2 @@
+ALTER TABLE access_logs DROP COLUMN forwarded;
+ALTER TABLE access_logs DROP COLUMN forwarded_for;
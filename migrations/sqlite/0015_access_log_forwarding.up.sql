@@ -0,0 +1,4 @@
+-- the X-Forwarded-For and Forwarded headers of a hit as they came in. ip
+-- now holds only the client address worked out from them.
+ALTER TABLE access_logs ADD COLUMN forwarded_for TEXT NOT NULL DEFAULT '';
+ALTER TABLE access_logs ADD COLUMN forwarded TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+var legacyAccessLogTable = regexp.MustCompile(`^access_logs_([a-z]{3}_[0-9]{4})$`)
+
+// monthStart truncates t to the first instant of its month in UTC.
+func monthStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// accessLogBucketRange turns a bucket like jan_2025 into the unix range
+// [from, to) it covers.
+func accessLogBucketRange(bucket string) (int64, int64, error) {
+	t, err := time.Parse("Jan_2006", bucket)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid access log bucket %q: %v", bucket, err)
+	}
+	start := monthStart(t)
+	return start.Unix(), start.AddDate(0, 1, 0).Unix(), nil
+}
+
+func accessLogPartitionName(month time.Time) string {
+	return fmt.Sprintf("access_logs_%s", month.Format("2006_01"))
+}
+
+// partitionLockKey is the advisory lock held while a partition is created,
+// every instance runs the maintenance loop and they would otherwise trip
+// over each other's CREATE and ATTACH.
+const partitionLockKey = 7_262_002
+
+// ensureAccessLogPartition creates the partition holding month if it is
+// missing. Rows that already landed in the default partition for that range
+// are moved over before attaching, otherwise postgres refuses the attach.
+func (p *PostgresDB) ensureAccessLogPartition(ctx context.Context, month time.Time) error {
+	month = monthStart(month)
+	name := accessLogPartitionName(month)
+	exists, err := accessLogPartitionExists(ctx, p.Pool, name)
+	if err != nil || exists {
+		return err
+	}
+	from, to := month.Unix(), month.AddDate(0, 1, 0).Unix()
+	table := pgx.Identifier{name}.Sanitize()
+	tx, err := p.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, partitionLockKey); err != nil {
+		return err
+	}
+	// someone else may have created it while we waited for the lock
+	if exists, err := accessLogPartitionExists(ctx, tx, name); err != nil || exists {
+		return err
+	}
+	if _, err := tx.Exec(ctx, fmt.Sprintf(`CREATE TABLE %s (LIKE access_logs INCLUDING DEFAULTS INCLUDING CONSTRAINTS)`, table)); err != nil {
+		return fmt.Errorf("failed to create partition %s: %v", name, err)
+	}
+	if _, err := tx.Exec(ctx, fmt.Sprintf(`
+		WITH moved AS (
+			DELETE FROM access_logs_default
+			WHERE timestamp >= $1 AND timestamp < $2
+			RETURNING *
+		)
+		INSERT INTO %s SELECT * FROM moved`, table), from, to); err != nil {
+		return fmt.Errorf("failed to move default rows into %s: %v", name, err)
+	}
+	if _, err := tx.Exec(ctx, fmt.Sprintf(`ALTER TABLE access_logs ATTACH PARTITION %s FOR VALUES FROM (%d) TO (%d)`, table, from, to)); err != nil {
+		return fmt.Errorf("failed to attach partition %s: %v", name, err)
+	}
+	return tx.Commit(ctx)
+}
+
+func accessLogPartitionExists(ctx context.Context, q interface {
+	QueryRow(context.Context, string, ...any) pgx.Row
+}, name string) (bool, error) {
+	var exists bool
+	err := q.QueryRow(ctx, `SELECT to_regclass($1) IS NOT NULL`, name).Scan(&exists)
+	return exists, err
+}
+
+// EnsureAccessLogPartitions makes sure the partition for the month of from
+// and the ahead months after it exist.
+func (p *PostgresDB) EnsureAccessLogPartitions(from time.Time, ahead int) error {
+	ctx := context.Background()
+	month := monthStart(from)
+	for i := 0; i <= ahead; i++ {
+		if err := p.ensureAccessLogPartition(ctx, month.AddDate(0, i, 0)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MaintainAccessLogPartitions keeps ahead months of partitions created until
+// ctx is done.
+func (p *PostgresDB) MaintainAccessLogPartitions(ctx context.Context, every time.Duration, ahead int) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		if err := p.EnsureAccessLogPartitions(time.Now(), ahead); err != nil {
+			fmt.Println("error creating access log partitions", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ImportLegacyAccessLogs copies the old per-month access_logs_jan_2025 style
+// tables into the partitioned access_logs table. Each imported table is
+// renamed with an _imported suffix, or dropped when drop is set, so running
+// the import twice does not duplicate rows.
+func (p *PostgresDB) ImportLegacyAccessLogs(drop bool) error {
+	ctx := context.Background()
+	rows, err := p.Pool.Query(ctx, `
+		SELECT table_name
+		FROM information_schema.tables
+		WHERE table_schema = current_schema()
+		ORDER BY table_name
+	`)
+	if err != nil {
+		return err
+	}
+	var legacy []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		if legacyAccessLogTable.MatchString(name) {
+			legacy = append(legacy, name)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, name := range legacy {
+		bucket := legacyAccessLogTable.FindStringSubmatch(name)[1]
+		from, _, err := accessLogBucketRange(bucket)
+		if err != nil {
+			return err
+		}
+		if err := p.ensureAccessLogPartition(ctx, time.Unix(from, 0)); err != nil {
+			return err
+		}
+		n, err := p.importLegacyAccessLogTable(ctx, name, drop)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("imported %d rows from %s\n", n, name)
+	}
+	return nil
+}
+
+func (p *PostgresDB) importLegacyAccessLogTable(ctx context.Context, name string, drop bool) (int64, error) {
+	table := pgx.Identifier{name}.Sanitize()
+	tx, err := p.Pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+	tag, err := tx.Exec(ctx, fmt.Sprintf(`
+		INSERT INTO access_logs (ip, user_agent, timestamp, tag_id)
+		SELECT ip, user_agent, COALESCE(timestamp, 0), tag_id
+		FROM %s`, table))
+	if err != nil {
+		return 0, fmt.Errorf("failed to import %s: %v", name, err)
+	}
+	if drop {
+		_, err = tx.Exec(ctx, fmt.Sprintf(`DROP TABLE %s`, table))
+	} else {
+		_, err = tx.Exec(ctx, fmt.Sprintf(`ALTER TABLE %s RENAME TO %s`, table, pgx.Identifier{name + "_imported"}.Sanitize()))
+	}
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), tx.Commit(ctx)
+}
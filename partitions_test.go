@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAccessLogBucketRange(t *testing.T) {
+	for _, tc := range []struct {
+		bucket   string
+		from, to int64
+		wantErr  bool
+	}{
+		{"jan_2025", 1735689600, 1738368000, false},
+		{"dec_2024", 1733011200, 1735689600, false},
+		{"feb_2024", 1706745600, 1709251200, false},
+		{"2025_01", 0, 0, true},
+		{"", 0, 0, true},
+	} {
+		t.Run(tc.bucket, func(t *testing.T) {
+			from, to, err := accessLogBucketRange(tc.bucket)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("got err %v", err)
+			}
+			if from != tc.from || to != tc.to {
+				t.Errorf("got [%d, %d), want [%d, %d)", from, to, tc.from, tc.to)
+			}
+		})
+	}
+}
+
+func TestAccessLogPartitionName(t *testing.T) {
+	month := monthStart(time.Date(2025, 3, 31, 23, 59, 0, 0, time.FixedZone("x", -5*3600)))
+	if got := accessLogPartitionName(month); got != "access_logs_2025_04" {
+		t.Errorf("got %s", got)
+	}
+}
+
+// TestEnsureAccessLogPartitionConcurrent has every caller race for the
+// same month, the advisory lock should let exactly one create it.
+func TestEnsureAccessLogPartitionConcurrent(t *testing.T) {
+	dsn := os.Getenv("THELP_TEST_POSTGRES")
+	if dsn == "" {
+		t.Skip("THELP_TEST_POSTGRES not set")
+	}
+	db, err := NewPostgresDB(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Pool.Close()
+	if err := db.MigrateUp(0); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	month := time.Date(2091, 6, 1, 0, 0, 0, 0, time.UTC)
+	if _, err := db.Pool.Exec(ctx, `DROP TABLE IF EXISTS `+accessLogPartitionName(month)); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- db.ensureAccessLogPartition(ctx, month)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
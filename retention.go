@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	RetentionTruncate     = "truncate"
+	RetentionPseudonymize = "pseudonymize"
+	RetentionDelete       = "delete"
+)
+
+// pseudonymPrefix marks an IP already replaced by pseudonymizeIP.
+const pseudonymPrefix = "anon:"
+
+var (
+	retentionRuns      = expvar.NewInt("retention_runs")
+	retentionErrors    = expvar.NewInt("retention_errors")
+	retentionRewritten = expvar.NewInt("retention_logs_rewritten")
+	retentionDeleted   = expvar.NewInt("retention_logs_deleted")
+)
+
+// RetentionPolicy says what happens to access records once they are
+// AfterDays old. Truncate cuts IPs down to their /24 or /48, pseudonymize
+// swaps them for a keyed hash, both keep only the country and network of
+// the location, and delete removes the record. An empty TagID
+// makes the policy global; a tag with policies of its own is exempt from
+// the global ones.
+type RetentionPolicy struct {
+	ID            int64  `json:"id"`
+	TenantID      string `json:"tenant_id,omitempty"`
+	TagID         string `json:"tag_id,omitempty"`
+	Action        string `json:"action"`
+	AfterDays     int    `json:"after_days"`
+	DropUserAgent bool   `json:"drop_user_agent,omitempty"`
+	// AppliedUntil is the cutoff the last run got through, the next run
+	// starts from there. It goes back to 0 whenever the policy set changes.
+	AppliedUntil int `json:"applied_until"`
+	Created      int `json:"created"`
+}
+
+func (p *RetentionPolicy) validate() error {
+	switch p.Action {
+	case RetentionTruncate, RetentionPseudonymize, RetentionDelete:
+	default:
+		return fmt.Errorf("%w: action must be %s, %s or %s", ErrInvalidQuery, RetentionTruncate, RetentionPseudonymize, RetentionDelete)
+	}
+	if p.AfterDays < 0 {
+		return fmt.Errorf("%w: after_days can't be negative", ErrInvalidQuery)
+	}
+	return nil
+}
+
+// cutoff is the timestamp before which records fall under the policy.
+func (p *RetentionPolicy) cutoff(now time.Time) int {
+	return int(now.Add(-time.Duration(p.AfterDays) * 24 * time.Hour).Unix())
+}
+
+// LoadPseudonymKey reads the base64 HMAC key for pseudonymized IPs from path,
+// falling back to THELP_PSEUDONYM_KEY. It returns nil when neither is set.
+func LoadPseudonymKey(path string) ([]byte, error) {
+	encoded := os.Getenv("THELP_PSEUDONYM_KEY")
+	if path != "" {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		encoded = string(raw)
+	}
+	if encoded == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(key) < 32 {
+		return nil, fmt.Errorf("pseudonym key must be at least 32 bytes of base64")
+	}
+	return key, nil
+}
+
+// mapIPs applies fn to every address in a stored ip value, which can be a
+// whole X-Forwarded-For chain. Parts that don't parse are handed over as
+// an invalid Addr.
+func mapIPs(raw string, fn func(part string, addr netip.Addr) string) string {
+	if raw == "" {
+		return ""
+	}
+	parts := strings.Split(raw, ",")
+	for i, part := range parts {
+		part = strings.TrimSpace(part)
+		if strings.HasPrefix(part, pseudonymPrefix) {
+			parts[i] = part
+			continue
+		}
+		addr, _ := accessLogAddr(part)
+		parts[i] = fn(part, addr)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// truncateIP keeps the /24 of IPv4 and the /48 of IPv6 addresses.
+func truncateIP(raw string) string {
+	return mapIPs(raw, func(part string, addr netip.Addr) string {
+		if !addr.IsValid() {
+			return "redacted"
+		}
+		bits := 48
+		if addr.Is4() {
+			bits = 24
+		}
+		prefix, _ := addr.Prefix(bits)
+		return prefix.Addr().String()
+	})
+}
+
+// pseudonymizeIP replaces every address with a keyed hash, so hits from the
+// same address still group together without the address being kept.
+func pseudonymizeIP(key []byte, raw string) string {
+	return mapIPs(raw, func(part string, addr netip.Addr) string {
+		if addr.IsValid() {
+			part = addr.String()
+		}
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		return pseudonymPrefix + hex.EncodeToString(mac.Sum(nil))[:32]
+	})
+}
+
+// redact applies a truncate or pseudonymize policy to one record and
+// reports whether anything changed. The location looked up from the full
+// address goes down to country and network with it.
+func (p *RetentionPolicy) redact(key []byte, ip, userAgent *string, geo **GeoInfo) bool {
+	before, beforeUA := *ip, *userAgent
+	changed := false
+	switch p.Action {
+	case RetentionTruncate:
+		*ip = truncateIP(*ip)
+	case RetentionPseudonymize:
+		*ip = pseudonymizeIP(key, *ip)
+	default:
+		return false
+	}
+	if (*geo).precise() {
+		*geo, changed = (*geo).coarse(), true
+	}
+	if p.DropUserAgent {
+		*userAgent = ""
+	}
+	return changed || *ip != before || *userAgent != beforeUA
+}
+
+// redactForwarding applies the policy to the forwarding headers kept with a
+// log. X-Forwarded-For is a plain list and goes the way of the ip, Forwarded
+// can't be rewritten piece by piece and is dropped.
+func (p *RetentionPolicy) redactForwarding(key []byte, log *AccessLog) bool {
+	before, beforeForwarded := log.ForwardedFor, log.Forwarded
+	switch p.Action {
+	case RetentionTruncate:
+		log.ForwardedFor = truncateIP(log.ForwardedFor)
+	case RetentionPseudonymize:
+		log.ForwardedFor = pseudonymizeIP(key, log.ForwardedFor)
+	default:
+		return false
+	}
+	log.Forwarded = ""
+	return log.ForwardedFor != before || log.Forwarded != beforeForwarded
+}
+
+// RunRetention applies the retention policies every interval until ctx is
+// done.
+func (a *Application) RunRetention(ctx context.Context, every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		if err := a.ApplyRetention(ctx); err != nil && ctx.Err() == nil {
+			a.Logger.Error("retention run failed", zap.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ApplyRetention runs every policy once against access_logs and the Access
+// slices of cached tags. Shorter policies run first, so a record that is
+// both due for truncation and deletion ends up deleted. A policy only
+// covers the tenant it belongs to.
+func (a *Application) ApplyRetention(ctx context.Context) error {
+	retentionRuns.Add(1)
+	dbCtx, cancel := a.dbContext(ctx)
+	policies, err := a.DB.GetRetentionPolicies(dbCtx)
+	cancel()
+	if err != nil {
+		retentionErrors.Add(1)
+		return err
+	}
+	// tag policies only override the globals of the tenant that owns them
+	type tenantTag struct{ tenant, tag string }
+	overridden := map[string][]string{}
+	own := map[tenantTag][]*RetentionPolicy{}
+	global := map[string][]*RetentionPolicy{}
+	for _, policy := range policies {
+		if policy.TagID == "" {
+			global[policy.TenantID] = append(global[policy.TenantID], policy)
+			continue
+		}
+		key := tenantTag{policy.TenantID, policy.TagID}
+		if own[key] == nil {
+			overridden[policy.TenantID] = append(overridden[policy.TenantID], policy.TagID)
+		}
+		own[key] = append(own[key], policy)
+	}
+	now := time.Now()
+	for _, policy := range policies {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		q := AccessLogQuery{TagID: policy.TagID, Until: policy.cutoff(now)}
+		if policy.TagID == "" {
+			q.ExcludeTagIDs = overridden[policy.TenantID]
+		}
+		if err := a.applyRetentionPolicy(WithTenant(ctx, policy.TenantID), policy, q); err != nil {
+			retentionErrors.Add(1)
+			a.Logger.Error("retention policy failed", zap.Int64("policy", policy.ID), zap.String("action", policy.Action), zap.Error(err))
+		}
+	}
+	for _, tag := range a.Tags.Tags() {
+		applies := own[tenantTag{tag.TenantID, tag.ID}]
+		if applies == nil {
+			applies = global[tag.TenantID]
+		}
+		a.applyRetentionToTag(tag, applies, now)
+	}
+	return nil
+}
+
+func (a *Application) applyRetentionPolicy(ctx context.Context, policy *RetentionPolicy, q AccessLogQuery) error {
+	if policy.Action == RetentionDelete {
+		dbCtx, cancel := a.dbContext(ctx)
+		n, err := a.DB.DeleteAccessLogs(dbCtx, q)
+		cancel()
+		if err != nil {
+			return err
+		}
+		retentionDeleted.Add(n)
+		if n > 0 {
+			a.Logger.Info("retention deleted access logs", zap.Int64("policy", policy.ID), zap.Int64("count", n))
+		}
+		return nil
+	}
+	if policy.Action == RetentionPseudonymize && a.PseudonymKey == nil {
+		return fmt.Errorf("no pseudonym key configured")
+	}
+	rw, ok := a.DB.(FieldRewriter)
+	if !ok {
+		return fmt.Errorf("%T can't rewrite access logs in place", a.DB)
+	}
+	// everything before AppliedUntil was handled by an earlier run
+	q.Since = policy.AppliedUntil
+	q.Limit = maxAccessLogLimit
+	rewritten := 0
+	for {
+		dbCtx, cancel := a.dbContext(ctx)
+		page, err := a.DB.QueryAccessLogs(dbCtx, q)
+		cancel()
+		if err != nil {
+			return err
+		}
+		var batch []*AccessLog
+		for _, log := range page.Logs {
+			changed := policy.redact(a.PseudonymKey, &log.IP, &log.UserAgent, &log.Geo)
+			if policy.redactForwarding(a.PseudonymKey, log) || changed {
+				batch = append(batch, log)
+			}
+		}
+		if len(batch) > 0 {
+			dbCtx, cancel := a.dbContext(ctx)
+			err := rw.RewriteAccessLogs(dbCtx, batch)
+			cancel()
+			if err != nil {
+				return err
+			}
+			rewritten += len(batch)
+			retentionRewritten.Add(int64(len(batch)))
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		q.Cursor = page.NextCursor
+	}
+	if rewritten > 0 {
+		a.Logger.Info("retention rewrote access logs", zap.Int64("policy", policy.ID), zap.String("action", policy.Action), zap.Int("count", rewritten))
+	}
+	policy.AppliedUntil = q.Until
+	dbCtx, cancel := a.dbContext(ctx)
+	defer cancel()
+	return a.DB.SaveRetentionPolicy(dbCtx, policy)
+}
+
+// applyRetentionToTag redacts or drops the entries of tag.Access that the
+// policies cover.
+func (a *Application) applyRetentionToTag(tag *Tag, policies []*RetentionPolicy, now time.Time) {
+	if len(policies) == 0 {
+		return
+	}
+	tag.Memory.Lock()
+	defer tag.Memory.Unlock()
+	kept := tag.Access[:0]
+	for _, access := range tag.Access {
+		keep := true
+		for _, policy := range policies {
+			if access.Timestamp >= policy.cutoff(now) {
+				continue
+			}
+			if policy.Action == RetentionDelete {
+				keep = false
+				break
+			}
+			if policy.Action == RetentionPseudonymize && a.PseudonymKey == nil {
+				continue
+			}
+			policy.redact(a.PseudonymKey, &access.IP, &access.UserAgent, &access.Geo)
+		}
+		if keep {
+			kept = append(kept, access)
+		}
+	}
+	tag.Access = kept
+}
+
+// resetRetention makes the next run look at every record again. It is
+// needed whenever policies change, since the set of tags a global policy
+// covers changes with them.
+func (a *Application) resetRetention(ctx context.Context) error {
+	dbCtx, cancel := a.dbContext(ctx)
+	defer cancel()
+	policies, err := a.DB.GetRetentionPolicies(dbCtx)
+	if err != nil {
+		return err
+	}
+	for _, policy := range policies {
+		if policy.AppliedUntil == 0 {
+			continue
+		}
+		policy.AppliedUntil = 0
+		if err := a.DB.SaveRetentionPolicy(dbCtx, policy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EraseUser removes every tag belonging to username along with the tag
+// history, access logs and static file recorded for them. Hits for those
+// tags still waiting in the AccessWriter are dropped first so they can't
+// bring any of it back.
+func (a *Application) EraseUser(ctx context.Context, username string) (tags int, logs int64, err error) {
+	dbCtx, cancel := a.dbContext(ctx)
+	owned, err := a.DB.GetTagsByUsername(dbCtx, username)
+	cancel()
+	if err != nil {
+		return 0, 0, err
+	}
+	if a.AccessWriter != nil {
+		ids := make([]string, len(owned))
+		for i, tag := range owned {
+			ids[i] = tag.ID
+		}
+		a.AccessWriter.Drop(ids...)
+	}
+	for _, tag := range owned {
+		if err := removeStaticFile(tag.TenantID, tag.FilePath); err != nil {
+			a.Logger.Warn("could not remove erased tag file", zap.String("tag_id", tag.ID), zap.Error(err))
+		}
+		dbCtx, cancel := a.dbContext(ctx)
+		n, err := a.DB.DeleteAccessLogs(dbCtx, AccessLogQuery{TagID: tag.ID})
+		if err == nil {
+			err = a.DB.DeleteTagHistory(dbCtx, tag.ID)
+		}
+		cancel()
+		if err != nil {
+			return tags, logs, err
+		}
+		logs += n
+		if err := a.DeleteTag(ctx, tag.ID); err != nil {
+			return tags, logs, err
+		}
+		tags++
+	}
+	return tags, logs, nil
+}
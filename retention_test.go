@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// chdirTemp runs the rest of the test from an empty directory, for code
+// that works with ./static.
+func chdirTemp(t *testing.T) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func TestTruncateIP(t *testing.T) {
+	for raw, want := range map[string]string{
+		"203.0.113.77":               "203.0.113.0",
+		"2001:db8:1234:5678::1":      "2001:db8:1234::",
+		"203.0.113.77, 198.51.100.9": "203.0.113.0, 198.51.100.0",
+		"203.0.113.77:443":           "203.0.113.0",
+		"anon:0123456789abcdef":      "anon:0123456789abcdef",
+		"unknown":                    "redacted",
+		"":                           "",
+	} {
+		if got := truncateIP(raw); got != want {
+			t.Errorf("%q: got %q, want %q", raw, got, want)
+		}
+	}
+}
+
+func TestPseudonymizeIP(t *testing.T) {
+	key := []byte(strings.Repeat("k", 32))
+	a := pseudonymizeIP(key, "203.0.113.7")
+	if !strings.HasPrefix(a, pseudonymPrefix) || strings.Contains(a, "203.0.113") {
+		t.Fatalf("got %q", a)
+	}
+	if b := pseudonymizeIP(key, "203.0.113.7:8080"); b != a {
+		t.Errorf("port changed the pseudonym: %q vs %q", b, a)
+	}
+	if b := pseudonymizeIP([]byte(strings.Repeat("x", 32)), "203.0.113.7"); b == a {
+		t.Error("another key gave the same pseudonym")
+	}
+	if b := pseudonymizeIP(key, a); b != a {
+		t.Errorf("pseudonymized twice: %q", b)
+	}
+}
+
+func TestRetentionRedact(t *testing.T) {
+	key := []byte(strings.Repeat("k", 32))
+	for _, tc := range []struct {
+		name      string
+		policy    RetentionPolicy
+		ip, ua    string
+		wantIP    string
+		wantUA    string
+		changed   bool
+		forwarded bool
+	}{
+		{"truncate", RetentionPolicy{Action: RetentionTruncate}, "203.0.113.7", "curl", "203.0.113.0", "curl", true, true},
+		{"truncate twice", RetentionPolicy{Action: RetentionTruncate}, "203.0.113.0", "curl", "203.0.113.0", "curl", false, true},
+		{"drop user agent", RetentionPolicy{Action: RetentionTruncate, DropUserAgent: true}, "203.0.113.0", "curl", "203.0.113.0", "", true, true},
+		{"pseudonymize", RetentionPolicy{Action: RetentionPseudonymize}, "203.0.113.7", "curl", pseudonymizeIP(key, "203.0.113.7"), "curl", true, true},
+		{"delete leaves the record to the query", RetentionPolicy{Action: RetentionDelete}, "203.0.113.7", "curl", "203.0.113.7", "curl", false, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ip, ua := tc.ip, tc.ua
+			var geo *GeoInfo
+			if changed := tc.policy.redact(key, &ip, &ua, &geo); changed != tc.changed {
+				t.Errorf("changed %v, want %v", changed, tc.changed)
+			}
+			if ip != tc.wantIP || ua != tc.wantUA {
+				t.Errorf("got %q %q, want %q %q", ip, ua, tc.wantIP, tc.wantUA)
+			}
+			log := &AccessLog{ForwardedFor: "203.0.113.7", Forwarded: "for=203.0.113.7"}
+			tc.policy.redactForwarding(key, log)
+			if tc.forwarded && (log.ForwardedFor == "203.0.113.7" || log.Forwarded != "") {
+				t.Errorf("forwarding headers kept: %+v", log)
+			}
+		})
+	}
+}
+
+// TestRetentionRedactGeo checks the city and coordinates looked up from an
+// address go when the address is redacted, even if it was redacted before.
+func TestRetentionRedactGeo(t *testing.T) {
+	lat, long := 59.91, 10.75
+	for _, tc := range []struct {
+		name    string
+		policy  RetentionPolicy
+		ip      string
+		changed bool
+		coarse  bool
+	}{
+		{"truncate", RetentionPolicy{Action: RetentionTruncate}, "203.0.113.7", true, true},
+		{"already truncated", RetentionPolicy{Action: RetentionTruncate}, "203.0.113.0", true, true},
+		{"pseudonymize", RetentionPolicy{Action: RetentionPseudonymize}, "203.0.113.7", true, true},
+		{"delete", RetentionPolicy{Action: RetentionDelete}, "203.0.113.7", false, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			geo := &GeoInfo{Country: "NO", City: "Oslo", Latitude: &lat, Longitude: &long, ASN: 64500, Org: "Example"}
+			original := geo
+			ip, ua := tc.ip, ""
+			if changed := tc.policy.redact([]byte(strings.Repeat("k", 32)), &ip, &ua, &geo); changed != tc.changed {
+				t.Errorf("changed %v, want %v", changed, tc.changed)
+			}
+			if geo.precise() == tc.coarse {
+				t.Errorf("got %+v", geo)
+			}
+			if tc.coarse && (geo.Country != "NO" || geo.ASN != 64500 || geo.Org != "Example") {
+				t.Errorf("lost the country or network: %+v", geo)
+			}
+			if original.City != "Oslo" {
+				t.Error("redact changed a location it may share with the tag")
+			}
+		})
+	}
+}
+
+func TestLoadPseudonymKey(t *testing.T) {
+	t.Setenv("THELP_PSEUDONYM_KEY", "")
+	if key, err := LoadPseudonymKey(""); key != nil || err != nil {
+		t.Errorf("no key: got %v %v", key, err)
+	}
+	t.Setenv("THELP_PSEUDONYM_KEY", "c2hvcnQ=")
+	if _, err := LoadPseudonymKey(""); err == nil {
+		t.Error("short key accepted")
+	}
+}
+
+// TestApplyRetention has a global truncate policy and a tag of its own
+// that deletes, the tag's policy has to win for its records.
+func TestApplyRetention(t *testing.T) {
+	app := newTestApp(t)
+	ctx := context.Background()
+	old := int(time.Now().Add(-60 * 24 * time.Hour).Unix())
+	recent := int(time.Now().Unix())
+	lat := 59.91
+	for _, log := range []*AccessLog{
+		{IP: "203.0.113.7", UserAgent: "curl", Timestamp: old, TagID: testTagID, Geo: &GeoInfo{Country: "NO", City: "Oslo", Latitude: &lat, Longitude: &lat}},
+		{IP: "203.0.113.8", UserAgent: "curl", Timestamp: recent, TagID: testTagID},
+		{IP: "198.51.100.7", Timestamp: old, TagID: testTagID2},
+	} {
+		if err := app.DB.AddAccessLog(ctx, log); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, policy := range []*RetentionPolicy{
+		{Action: RetentionTruncate, AfterDays: 30, DropUserAgent: true},
+		{TagID: testTagID2, Action: RetentionDelete, AfterDays: 30},
+	} {
+		if err := app.DB.SaveRetentionPolicy(ctx, policy); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := app.ApplyRetention(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	page, err := app.DB.QueryAccessLogs(ctx, AccessLogQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, log := range page.Logs {
+		got[log.IP] = log.UserAgent
+		if log.Geo.precise() {
+			t.Errorf("%s kept its location: %+v", log.IP, log.Geo)
+		}
+	}
+	want := map[string]string{"203.0.113.0": "", "203.0.113.8": "curl"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for ip, ua := range want {
+		if got[ip] != ua {
+			t.Errorf("%s: user agent %q, want %q (all: %v)", ip, got[ip], ua, got)
+		}
+	}
+	policies, err := app.DB.GetRetentionPolicies(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, policy := range policies {
+		if policy.Action == RetentionTruncate && policy.AppliedUntil == 0 {
+			t.Error("truncate policy didn't record how far it got")
+		}
+	}
+}
+
+func TestApplyRetentionToTag(t *testing.T) {
+	app := newTestApp(t)
+	old := int(time.Now().Add(-60 * 24 * time.Hour).Unix())
+	tag := NewTag(testTagID, "c1", "h1", old)
+	tag.Access = []TagAccess{
+		{IP: "203.0.113.7", UserAgent: "curl", Timestamp: old, Geo: &GeoInfo{Country: "NO", City: "Oslo"}},
+		{IP: "203.0.113.8", UserAgent: "curl", Timestamp: int(time.Now().Unix())},
+	}
+	app.applyRetentionToTag(tag, []*RetentionPolicy{{Action: RetentionTruncate, AfterDays: 30}}, time.Now())
+	if tag.Access[0].IP != "203.0.113.0" || tag.Access[0].Geo.City != "" || tag.Access[1].IP != "203.0.113.8" {
+		t.Errorf("after truncate: %+v", tag.Access)
+	}
+	app.applyRetentionToTag(tag, []*RetentionPolicy{{Action: RetentionDelete, AfterDays: 30}}, time.Now())
+	if len(tag.Access) != 1 || tag.Access[0].IP != "203.0.113.8" {
+		t.Errorf("after delete: %+v", tag.Access)
+	}
+}
+
+// TestEraseUser erases a user with a hit still queued and checks neither
+// the hit nor the tag's file survive.
+func TestEraseUser(t *testing.T) {
+	chdirTemp(t)
+	app := newTestApp(t)
+	file := filepath.Join("static", "plan.pdf")
+	if err := os.MkdirAll("static", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, []byte("%PDF"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	addTestTag(t, app, map[string]any{"id": testTagID, "hash": "h", "username": "alice", "file_path": file})
+	addTestTag(t, app, map[string]any{"id": testTagID2, "hash": "h", "username": "bob"})
+	ctx := context.Background()
+	if err := app.DB.AddAccessLog(ctx, &AccessLog{IP: "203.0.113.7", Timestamp: 100, TagID: testTagID}); err != nil {
+		t.Fatal(err)
+	}
+	app.AccessWriter = NewAccessWriter(app.DB, 10, 10, time.Hour)
+	app.AccessWriter.Enqueue(&AccessLog{IP: "203.0.113.8", Timestamp: 101, TagID: testTagID})
+	app.AccessWriter.Enqueue(&AccessLog{IP: "198.51.100.1", Timestamp: 101, TagID: testTagID2})
+
+	w := serve(app, jsonRequest(t, http.MethodPost, "/erase-user", eraseUserRequest{Username: "alice"}))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d %s", w.Code, w.Body)
+	}
+	go app.AccessWriter.Run()
+	app.AccessWriter.Close()
+
+	if _, err := app.DB.GetTag(ctx, testTagID); err == nil {
+		t.Error("tag survived")
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("file survived: %v", err)
+	}
+	page, err := app.DB.QueryAccessLogs(ctx, AccessLogQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Logs) != 1 || page.Logs[0].TagID != testTagID2 {
+		t.Errorf("left %+v, want only bob's hit", page.Logs)
+	}
+}
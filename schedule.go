@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	SeverityNormal = "normal"
+	// SeverityLow marks hits on a tag that wasn't armed at the time, e.g.
+	// the author opening the document before it went out.
+	SeverityLow = "low"
+	// SeverityHigh and SeverityCritical are for hits on classified tags,
+	// see -classification-severity.
+	SeverityHigh     = "high"
+	SeverityCritical = "critical"
+)
+
+// what the beacon does with hits outside a tag's armed window
+const (
+	OutOfWindowLow    = "low"
+	OutOfWindowIgnore = "ignore"
+)
+
+func (l *AccessLog) severity() string {
+	if l.Severity == "" {
+		return SeverityNormal
+	}
+	return l.Severity
+}
+
+// armed reports whether hits on t at now fall inside its window.
+func (t *Tag) armed(now time.Time) bool {
+	ts := int(now.Unix())
+	if t.ArmAt != 0 && ts < t.ArmAt {
+		return false
+	}
+	if t.ExpiresAt != 0 && ts >= t.ExpiresAt {
+		return false
+	}
+	return true
+}
+
+func validateSchedule(armAt, expiresAt int) error {
+	if armAt < 0 || expiresAt < 0 {
+		return fmt.Errorf("%w: arm_at and expires_at must be unix seconds", ErrInvalidQuery)
+	}
+	if armAt != 0 && expiresAt != 0 && expiresAt <= armAt {
+		return fmt.Errorf("%w: expires_at must be after arm_at", ErrInvalidQuery)
+	}
+	return nil
+}
+
+// setSchedule replaces the window of t. A tag that gets a new expiry in the
+// future, or none at all, is no longer expired.
+func (t *Tag) setSchedule(armAt, expiresAt int, now time.Time) {
+	t.ArmAt, t.ExpiresAt = armAt, expiresAt
+	if expiresAt == 0 || expiresAt > int(now.Unix()) {
+		t.ExpiredAt = 0
+	}
+}
+
+// SetTagSchedule changes the armed window of an existing tag. version is
+// the one the caller last saw, 0 to skip the check.
+func (a *Application) SetTagSchedule(ctx context.Context, id string, armAt, expiresAt, version int) (*Tag, error) {
+	if err := validateSchedule(armAt, expiresAt); err != nil {
+		return nil, err
+	}
+	ctx, cancel := a.dbContext(ctx)
+	defer cancel()
+	a.Memory.Lock()
+	defer a.Memory.Unlock()
+	tag, err := a.DB.GetTag(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if version != 0 {
+		tag.Version = version
+	}
+	tag.setSchedule(armAt, expiresAt, time.Now())
+	if err := a.DB.UpdateTag(ctx, tag, TagChange{}); err != nil {
+		a.Tags.Remove(id)
+		return nil, err
+	}
+	if tag.URL == "" {
+		tag.URL = fmt.Sprintf("%s/%s", a.FQDN, tag.ID)
+	}
+	a.Tags.Set(tag)
+	return tag, nil
+}
+
+// RunExpirySweeper marks lapsed tags every interval until ctx is done.
+func (a *Application) RunExpirySweeper(ctx context.Context, every time.Duration, removeFiles bool) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		if err := a.SweepExpiredTags(ctx, removeFiles); err != nil && ctx.Err() == nil {
+			a.Logger.Error("expiry sweep failed", zap.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// SweepExpiredTags sets ExpiredAt on every tag past its expiry and, if
+// removeFiles is set, deletes its instrumented file from the static
+// directory of its tenant. A tag someone changed in the meantime is left
+// for the next sweep.
+func (a *Application) SweepExpiredTags(ctx context.Context, removeFiles bool) error {
+	now := time.Now()
+	dbCtx, cancel := a.dbContext(ctx)
+	expired, err := a.DB.GetExpiredTags(dbCtx, int(now.Unix()))
+	cancel()
+	if err != nil {
+		return err
+	}
+	for _, tag := range expired {
+		tag.ExpiredAt = int(now.Unix())
+		dbCtx, cancel := a.dbContext(ctx)
+		err := a.DB.UpdateTag(dbCtx, tag, TagChange{})
+		cancel()
+		a.Tags.Remove(tag.ID)
+		if errors.Is(err, ErrConflict) || errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		a.Logger.Info("tag expired", zap.String("tag_id", tag.ID), zap.Int("expires_at", tag.ExpiresAt))
+		if removeFiles {
+			if err := removeStaticFile(tag.TenantID, tag.FilePath); err != nil {
+				a.Logger.Warn("could not remove expired tag file", zap.String("tag_id", tag.ID), zap.Error(err))
+			}
+		}
+	}
+	return nil
+}
+
+// removeStaticFile deletes path, refusing anything outside the static
+// directory of tenant so a stored file_path can't be used to remove
+// arbitrary files. For the default tenant that excludes the other
+// tenants' directories under ./static/tenants.
+func removeStaticFile(tenant, path string) error {
+	if path == "" {
+		return nil
+	}
+	dir := tenantStaticDir(tenant)
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	target, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(target, root+string(filepath.Separator)) {
+		return fmt.Errorf("%s is outside %s", path, dir)
+	}
+	if tenant == DefaultTenant && strings.HasPrefix(target, filepath.Join(root, "tenants")+string(filepath.Separator)) {
+		return fmt.Errorf("%s belongs to another tenant", path)
+	}
+	if err := os.Remove(target); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
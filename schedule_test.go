@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTagArmed(t *testing.T) {
+	now := time.Unix(1000, 0)
+	for _, tc := range []struct {
+		name             string
+		armAt, expiresAt int
+		want             bool
+	}{
+		{"open", 0, 0, true},
+		{"armed", 900, 0, true},
+		{"arms at now", 1000, 0, true},
+		{"not armed yet", 1001, 0, false},
+		{"before expiry", 0, 1001, true},
+		{"expires at now", 0, 1000, false},
+		{"inside window", 900, 1100, true},
+		{"after window", 800, 900, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tag := &Tag{ArmAt: tc.armAt, ExpiresAt: tc.expiresAt}
+			if got := tag.armed(now); got != tc.want {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestValidateSchedule(t *testing.T) {
+	for _, tc := range []struct {
+		armAt, expiresAt int
+		ok               bool
+	}{
+		{0, 0, true},
+		{100, 0, true},
+		{0, 100, true},
+		{100, 200, true},
+		{200, 200, false},
+		{200, 100, false},
+		{-1, 0, false},
+		{0, -1, false},
+	} {
+		err := validateSchedule(tc.armAt, tc.expiresAt)
+		if tc.ok != (err == nil) || (err != nil && !errors.Is(err, ErrInvalidQuery)) {
+			t.Errorf("arm_at %d expires_at %d: got %v", tc.armAt, tc.expiresAt, err)
+		}
+	}
+}
+
+func TestSetSchedule(t *testing.T) {
+	now := time.Unix(1000, 0)
+	for _, tc := range []struct {
+		name      string
+		expiresAt int
+		expired   bool
+	}{
+		{"later expiry revives", 2000, false},
+		{"no expiry revives", 0, false},
+		{"past expiry stays expired", 500, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tag := &Tag{ExpiresAt: 900, ExpiredAt: 900}
+			tag.setSchedule(0, tc.expiresAt, now)
+			if (tag.ExpiredAt != 0) != tc.expired {
+				t.Errorf("expired_at %d", tag.ExpiredAt)
+			}
+		})
+	}
+}
+
+// TestBeaconOutsideWindow hits a tag that isn't armed yet under both
+// -out-of-window settings.
+func TestBeaconOutsideWindow(t *testing.T) {
+	for _, tc := range []struct {
+		outOfWindow string
+		want        int
+	}{
+		{OutOfWindowLow, 1},
+		{OutOfWindowIgnore, 0},
+	} {
+		t.Run(tc.outOfWindow, func(t *testing.T) {
+			app := newTestApp(t)
+			app.OutOfWindow = tc.outOfWindow
+			addTestTag(t, app, map[string]any{"id": testTagID, "hash": "h", "arm_at": time.Now().Add(time.Hour).Unix()})
+			r := httptest.NewRequest(http.MethodGet, "/"+testTagID, nil)
+			r.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64)")
+			if w := serve(app, r); w.Code != http.StatusOK {
+				t.Fatalf("beacon: %d %s", w.Code, w.Body)
+			}
+			page, err := app.DB.QueryAccessLogs(context.Background(), AccessLogQuery{TagID: testTagID})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(page.Logs) != tc.want {
+				t.Fatalf("got %d logs, want %d", len(page.Logs), tc.want)
+			}
+			if tc.want > 0 && page.Logs[0].Severity != SeverityLow {
+				t.Errorf("severity %q, want low", page.Logs[0].Severity)
+			}
+		})
+	}
+}
+
+func TestTagScheduleHandler(t *testing.T) {
+	app := newTestApp(t)
+	addTestTag(t, app, map[string]any{"id": testTagID, "hash": "h"})
+	for _, tc := range []struct {
+		name string
+		req  tagScheduleRequest
+		code int
+	}{
+		{"window", tagScheduleRequest{ID: testTagID, ArmAt: 100, ExpiresAt: 200}, http.StatusOK},
+		{"backwards", tagScheduleRequest{ID: testTagID, ArmAt: 200, ExpiresAt: 100}, http.StatusBadRequest},
+		{"stale version", tagScheduleRequest{ID: testTagID, Version: 1}, http.StatusConflict},
+		{"unknown tag", tagScheduleRequest{ID: testTagID2}, http.StatusNotFound},
+		{"no id", tagScheduleRequest{}, http.StatusBadRequest},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := serve(app, jsonRequest(t, http.MethodPost, "/tag-schedule", tc.req))
+			if w.Code != tc.code {
+				t.Errorf("got %d %s, want %d", w.Code, w.Body, tc.code)
+			}
+		})
+	}
+	if tag := getTestTag(t, app, testTagID); tag.ArmAt != 100 || tag.ExpiresAt != 200 {
+		t.Errorf("got window [%d, %d)", tag.ArmAt, tag.ExpiresAt)
+	}
+}
+
+// TestSweepExpiredTags expires a tag with a file of its own and one whose
+// file_path points into another tenant's directory, only the first file
+// may go.
+func TestSweepExpiredTags(t *testing.T) {
+	chdirTemp(t)
+	own := filepath.Join("static", "plan.pdf")
+	other := filepath.Join("static", "tenants", "acme", "plan.pdf")
+	for _, p := range []string{own, other} {
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte("%PDF"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	app := newTestApp(t)
+	past := time.Now().Add(-time.Hour).Unix()
+	addTestTag(t, app, map[string]any{"id": testTagID, "hash": "h", "file_path": own, "expires_at": past})
+	addTestTag(t, app, map[string]any{"id": testTagID2, "hash": "h", "file_path": other, "expires_at": past})
+	if err := app.SweepExpiredTags(context.Background(), true); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{testTagID, testTagID2} {
+		if tag := getTestTag(t, app, id); tag.ExpiredAt == 0 {
+			t.Errorf("%s wasn't marked expired", id)
+		}
+	}
+	if _, err := os.Stat(own); !os.IsNotExist(err) {
+		t.Errorf("expired tag's file survived: %v", err)
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("another tenant's file went: %v", err)
+	}
+}
+
+func TestRemoveStaticFile(t *testing.T) {
+	chdirTemp(t)
+	outside := filepath.Join(t.TempDir(), "plan.pdf")
+	for _, tc := range []struct {
+		tenant, path string
+		ok           bool
+	}{
+		{DefaultTenant, "static/plan.pdf", true},
+		{DefaultTenant, "static/../plan.pdf", false},
+		{DefaultTenant, outside, false},
+		{DefaultTenant, "static/tenants/acme/plan.pdf", false},
+		{"acme", "static/tenants/acme/plan.pdf", true},
+		{"acme", "static/plan.pdf", false},
+		{"acme", "static/tenants/other/plan.pdf", false},
+	} {
+		// every path here is under the test's own directories
+		if err := os.MkdirAll(filepath.Dir(tc.path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(tc.path, []byte("%PDF"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		err := removeStaticFile(tc.tenant, tc.path)
+		if tc.ok != (err == nil) {
+			t.Errorf("%s %q: got %v", tc.tenant, tc.path, err)
+		}
+		if _, err := os.Stat(tc.path); os.IsNotExist(err) != tc.ok {
+			t.Errorf("%s %q: removed %v, want %v", tc.tenant, tc.path, os.IsNotExist(err), tc.ok)
+		}
+	}
+	if err := removeStaticFile(DefaultTenant, ""); err != nil {
+		t.Errorf("empty path: %v", err)
+	}
+	if err := removeStaticFile(DefaultTenant, "static/missing.pdf"); err != nil {
+		t.Errorf("missing file: %v", err)
+	}
+}
@@ -5,6 +5,11 @@
 # python3 add.py "$@"
 # echo "Python script executed successfully."
 
+# Resolve the upload before changing directory, tenants upload into their
+# own directory under static/
+file="$( cd -- "$( dirname -- "$1" )" &> /dev/null && pwd )/$(basename "$1")"
+uuid="$2"
+
 # Change to the directory where the script is located
 SCRIPT_DIR="$( cd -- "$( dirname -- "${BASH_SOURCE[0]}" )" &> /dev/null && pwd )"
 cd "$SCRIPT_DIR"
@@ -12,9 +17,5 @@ cd "$SCRIPT_DIR"
 source .venv/bin/activate
 # python3 -m pikepdf --version
 
-# Extract the filename from the path
-filename=$(basename "$1")
-uuid="$2"
-
-python3 add.py "../static/$filename" "$uuid"
+python3 add.py "$file" "$uuid"
 echo "Python script executed successfully."
\ No newline at end of file
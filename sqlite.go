@@ -0,0 +1,995 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// SQLiteDB is a Database backed by a single SQLite file, for small installs
+// where running Postgres is not worth it.
+type SQLiteDB struct {
+	DB *sql.DB
+	// tx is set on the copy Snapshot hands out
+	tx *sql.Tx
+}
+
+func NewSQLiteDB(path string) (*SQLiteDB, error) {
+	dsn := fmt.Sprintf("file:%s?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)", path)
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// sqlite only allows one writer at a time, serialize in the pool rather
+	// than surfacing SQLITE_BUSY to callers
+	db.SetMaxOpenConns(1)
+	fmt.Println("SQLiteDB opened at", path)
+	return &SQLiteDB{DB: db}, nil
+}
+
+// importLegacyAccessLogs folds the per-month access_logs_jan_2025 tables
+// earlier versions created into access_logs.
+func (s *SQLiteDB) importLegacyAccessLogs() error {
+	rows, err := s.DB.Query(`SELECT name FROM sqlite_master WHERE type = 'table'`)
+	if err != nil {
+		return err
+	}
+	var legacy []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		if legacyAccessLogTable.MatchString(name) {
+			legacy = append(legacy, name)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, name := range legacy {
+		tx, err := s.DB.Begin()
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(fmt.Sprintf(`
+			INSERT INTO access_logs (ip, user_agent, timestamp, tag_id)
+			SELECT ip, user_agent, COALESCE(timestamp, 0), tag_id FROM %s ORDER BY id`, name))
+		if err == nil {
+			_, err = tx.Exec(fmt.Sprintf(`DROP TABLE %s`, name))
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to import %s: %v", name, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		fmt.Println("imported legacy access logs from", name)
+	}
+	return nil
+}
+
+// tags of the tenant, for tables that only know the tag
+const sqliteTenantTags = "tag_id IN (SELECT id FROM tags WHERE tenant_id = %s)"
+
+// sqliteTenantScope is pgTenantScope with ? placeholders.
+func sqliteTenantScope(ctx context.Context, cond string, args []any) (string, []any) {
+	tenant, ok := tenantFrom(ctx)
+	if !ok {
+		return "", args
+	}
+	return " AND " + fmt.Sprintf(cond, "?"), append(args, tenant)
+}
+
+func (s *SQLiteDB) InsertTag(ctx context.Context, tag *Tag, change TagChange) error {
+	tenant := tenantFor(ctx, tag.TenantID)
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, `
+		INSERT INTO tags (id, username, file_path, client_id, hash, created, version, username_index, arm_at, expires_at, expired_at, state, campaign_id, tenant_id, metadata, response, decoy)
+		VALUES (?, ?, ?, ?, ?, ?, 1, NULLIF(?, ''), ?, ?, ?, ?, NULLIF(?, 0), ?, ?, ?, ?)
+		ON CONFLICT (id) DO NOTHING
+	`, tag.ID, tag.Username, tag.FilePath, tag.ClientID, tag.Hash, tag.Created, tag.UsernameIndex, tag.ArmAt, tag.ExpiresAt, tag.ExpiredAt, tag.lifecycle(), tag.CampaignID, tenant,
+		tag.TagMetadata.encode(), tag.Response, tag.Decoy)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		// the pool has a single connection, give it back before looking
+		// up the version
+		tx.Rollback()
+		return &ConflictError{ID: tag.ID, Expected: 0, Actual: s.tagVersion(ctx, tag.ID)}
+	}
+	if err := sqliteRecordTagChange(ctx, tx, tag.ID, change); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	tag.Version, tag.TenantID = 1, tenant
+	return nil
+}
+
+// tagVersion is a best effort lookup used to fill in conflict errors. A
+// tag of another tenant reads as missing.
+func (s *SQLiteDB) tagVersion(ctx context.Context, id string) int {
+	var version int
+	scope, args := sqliteTenantScope(ctx, "tenant_id = %s", []any{id})
+	s.conn().QueryRowContext(ctx, `SELECT version FROM tags WHERE id = ?`+scope, args...).Scan(&version)
+	return version
+}
+
+func (s *SQLiteDB) queryTags(ctx context.Context, query string, args ...any) ([]*Tag, error) {
+	rows, err := s.conn().QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tags []*Tag
+	for rows.Next() {
+		tag, err := scanSQLiteTag(rows)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+type sqliteScanner interface {
+	Scan(dest ...any) error
+}
+
+const sqliteTagColumns = `id, username, file_path, client_id, hash, created, version, username_index, arm_at, expires_at, expired_at, state, COALESCE(campaign_id, 0), tenant_id, metadata, response, decoy`
+
+func scanSQLiteTag(row sqliteScanner) (*Tag, error) {
+	var tag Tag
+	var username, filePath, clientID, hash, usernameIndex sql.NullString
+	var created sql.NullInt64
+	var metadata []byte
+	if err := row.Scan(&tag.ID, &username, &filePath, &clientID, &hash, &created, &tag.Version, &usernameIndex,
+		&tag.ArmAt, &tag.ExpiresAt, &tag.ExpiredAt, &tag.State, &tag.CampaignID, &tag.TenantID, &metadata, &tag.Response, &tag.Decoy); err != nil {
+		return nil, err
+	}
+	var err error
+	if tag.TagMetadata, err = decodeTagMetadata(metadata); err != nil {
+		return nil, fmt.Errorf("tag %s has bad metadata: %v", tag.ID, err)
+	}
+	tag.Username = username.String
+	tag.UsernameIndex = usernameIndex.String
+	tag.FilePath = filePath.String
+	tag.ClientID = clientID.String
+	tag.Hash = hash.String
+	tag.Created = int(created.Int64)
+	return &tag, nil
+}
+
+func (s *SQLiteDB) GetTag(ctx context.Context, id string) (*Tag, error) {
+	scope, args := sqliteTenantScope(ctx, "tenant_id = %s", []any{id})
+	row := s.conn().QueryRowContext(ctx, `
+		SELECT `+sqliteTagColumns+`
+		FROM tags
+		WHERE id = ?`+scope, args...)
+	tag, err := scanSQLiteTag(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	tag.History, err = recentTagHistory(ctx, s, id)
+	if err != nil {
+		return nil, err
+	}
+	return tag, nil
+}
+
+func (s *SQLiteDB) GetTags(ctx context.Context) ([]*Tag, error) {
+	scope, args := sqliteTenantScope(ctx, "tenant_id = %s", nil)
+	return s.queryTags(ctx, `
+		SELECT `+sqliteTagColumns+`
+		FROM tags
+		WHERE true`+scope, args...)
+}
+
+// sqliteTagFilter turns f into a condition on the metadata column.
+func sqliteTagFilter(f TagFilter) (string, []any) {
+	conds := []string{"true"}
+	var args []any
+	if f.Classification != "" {
+		conds = append(conds, "json_extract(metadata, '$.classification') = ?")
+		args = append(args, f.Classification)
+	}
+	for k, v := range f.Labels {
+		conds = append(conds, "EXISTS (SELECT 1 FROM json_each(metadata, '$.labels') WHERE key = ? AND value = ?)")
+		args = append(args, k, v)
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+// FindTags returns the tags whose metadata matches f.
+func (s *SQLiteDB) FindTags(ctx context.Context, f TagFilter) ([]*Tag, error) {
+	cond, args := sqliteTagFilter(f)
+	scope, args := sqliteTenantScope(ctx, "tenant_id = %s", args)
+	return s.queryTags(ctx, `
+		SELECT `+sqliteTagColumns+`
+		FROM tags
+		WHERE `+cond+scope+`
+		ORDER BY created
+	`, args...)
+}
+
+// GetTagsByUsername matches either the plaintext username or its blind
+// index, see EncryptedDB.
+func (s *SQLiteDB) GetTagsByUsername(ctx context.Context, username string) ([]*Tag, error) {
+	scope, args := sqliteTenantScope(ctx, "tenant_id = %s", []any{username, username})
+	return s.queryTags(ctx, `
+		SELECT `+sqliteTagColumns+`
+		FROM tags
+		WHERE (username = ? OR username_index = ?)`+scope+`
+		ORDER BY created
+	`, args...)
+}
+
+// GetExpiredTags returns the tags whose expires_at has passed at now but
+// that the sweeper hasn't marked yet.
+func (s *SQLiteDB) GetExpiredTags(ctx context.Context, now int) ([]*Tag, error) {
+	scope, args := sqliteTenantScope(ctx, "tenant_id = %s", []any{now})
+	return s.queryTags(ctx, `
+		SELECT `+sqliteTagColumns+`
+		FROM tags
+		WHERE expires_at <> 0 AND expired_at = 0 AND expires_at <= ?`+scope, args...)
+}
+
+// RewriteTag replaces the stored username, its index and the file path
+// without bumping the version. It is meant for key rotation, not edits.
+func (s *SQLiteDB) RewriteTag(ctx context.Context, tag *Tag) error {
+	res, err := s.conn().ExecContext(ctx, `
+		UPDATE tags SET username = ?, username_index = NULLIF(?, ''), file_path = ?
+		WHERE id = ?
+	`, tag.Username, tag.UsernameIndex, tag.FilePath, tag.ID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// RewriteAccessLogs replaces the ip, user agent, forwarding headers,
+// fields and location of existing logs.
+func (s *SQLiteDB) RewriteAccessLogs(ctx context.Context, logs []*AccessLog) error {
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, `UPDATE access_logs SET ip = ?, user_agent = ?, fields = ?, forwarded_for = ?, forwarded = ?, `+
+		strings.Join(geoColumns, " = ?, ")+` = ? WHERE id = ?`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, log := range logs {
+		args := append([]any{log.IP, log.UserAgent, encodeLogFields(log.Fields), log.ForwardedFor, log.Forwarded}, log.Geo.values()...)
+		if _, err := stmt.ExecContext(ctx, append(args, log.ID)...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteDB) UpdateTag(ctx context.Context, tag *Tag, change TagChange) error {
+	scope, args := sqliteTenantScope(ctx, "tenant_id = %s", []any{tag.ClientID, tag.Hash, tag.Created, tag.Username, tag.FilePath, tag.UsernameIndex,
+		tag.ArmAt, tag.ExpiresAt, tag.ExpiredAt, tag.lifecycle(), tag.CampaignID, tag.TagMetadata.encode(), tag.Response, tag.Decoy, tag.ID, tag.Version})
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, `
+		UPDATE tags
+		SET client_id = ?, hash = ?, created = ?, username = ?, file_path = ?, version = version + 1,
+			username_index = NULLIF(?, ''), arm_at = ?, expires_at = ?, expired_at = ?, state = ?,
+			campaign_id = NULLIF(?, 0), metadata = ?, response = ?, decoy = ?
+		WHERE id = ? AND version = ?`+scope, args...)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		tx.Rollback()
+		actual := s.tagVersion(ctx, tag.ID)
+		if actual == 0 {
+			return ErrNotFound
+		}
+		return &ConflictError{ID: tag.ID, Expected: tag.Version, Actual: actual}
+	}
+	if err := sqliteRecordTagChange(ctx, tx, tag.ID, change); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	tag.Version++
+	return nil
+}
+
+// sqliteQuerier is the part of *sql.DB and *sql.Tx SQLiteDB queries
+// through.
+type sqliteQuerier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// conn is what queries go through, the pool or a Snapshot transaction.
+func (s *SQLiteDB) conn() sqliteQuerier {
+	if s.tx != nil {
+		return s.tx
+	}
+	return s.DB
+}
+
+// begin starts a write transaction. A Snapshot already holds the only
+// connection, waiting for another would never end.
+func (s *SQLiteDB) begin(ctx context.Context) (*sql.Tx, error) {
+	if s.tx != nil {
+		return nil, errors.New("sqlite: write inside a read-only snapshot")
+	}
+	return s.DB.BeginTx(ctx, nil)
+}
+
+// Snapshot runs fn against a copy of s reading from one transaction. With
+// WAL that is a consistent view even while another process writes. The
+// transaction holds the only connection, fn must not write.
+func (s *SQLiteDB) Snapshot(ctx context.Context, fn func(Database) error) error {
+	tx, err := s.DB.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	return fn(&SQLiteDB{DB: s.DB, tx: tx})
+}
+
+func (s *SQLiteDB) AddTagHistory(ctx context.Context, tagID string, item TagHistoryItem) error {
+	return sqliteAddTagHistory(ctx, s.conn(), tagID, item)
+}
+
+func sqliteAddTagHistory(ctx context.Context, q sqliteQuerier, tagID string, item TagHistoryItem) error {
+	_, err := q.ExecContext(ctx, `
+		INSERT INTO tag_history (tag_id, client_id, hash, created)
+		VALUES (?, ?, ?, ?)
+	`, tagID, item.ClientID, item.Hash, item.Created)
+	return err
+}
+
+// sqliteRecordTagChange writes what goes with a tag write in its
+// transaction.
+func sqliteRecordTagChange(ctx context.Context, tx *sql.Tx, tagID string, change TagChange) error {
+	if change.History != nil {
+		if err := sqliteAddTagHistory(ctx, tx, tagID, *change.History); err != nil {
+			return err
+		}
+	}
+	if change.Transition != nil {
+		t := *change.Transition
+		t.TagID = tagID
+		return sqliteAddTagTransition(ctx, tx, t)
+	}
+	return nil
+}
+
+func (s *SQLiteDB) GetTagHistory(ctx context.Context, q TagHistoryQuery) (*TagHistoryPage, error) {
+	cursor, err := q.normalize()
+	if err != nil {
+		return nil, err
+	}
+	order, cmp := "ASC", ">"
+	if q.Descending {
+		order, cmp = "DESC", "<"
+	}
+	args := []any{q.TagID}
+	query := `SELECT id, client_id, hash, created FROM tag_history WHERE tag_id = ?`
+	if cursor != 0 {
+		query += fmt.Sprintf(" AND id %s ?", cmp)
+		args = append(args, cursor)
+	}
+	scope, args := sqliteTenantScope(ctx, sqliteTenantTags, args)
+	query += scope + fmt.Sprintf(" ORDER BY id %s LIMIT ?", order)
+	args = append(args, q.Limit+1)
+	rows, err := s.conn().QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []TagHistoryItem
+	for rows.Next() {
+		var item TagHistoryItem
+		var clientID, hash sql.NullString
+		if err := rows.Scan(&item.ID, &clientID, &hash, &item.Created); err != nil {
+			return nil, err
+		}
+		item.ClientID, item.Hash = clientID.String, hash.String
+		items = append(items, item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return q.page(items), nil
+}
+
+func (s *SQLiteDB) AddTagTransition(ctx context.Context, t TagTransition) error {
+	return sqliteAddTagTransition(ctx, s.conn(), t)
+}
+
+func sqliteAddTagTransition(ctx context.Context, q sqliteQuerier, t TagTransition) error {
+	_, err := q.ExecContext(ctx, `
+		INSERT INTO tag_transitions (tag_id, from_state, to_state, actor, reason, created)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, t.TagID, t.From, t.To, t.Actor, t.Reason, t.Created)
+	return err
+}
+
+func (s *SQLiteDB) GetTagTransitions(ctx context.Context, tagID string) ([]TagTransition, error) {
+	scope, args := sqliteTenantScope(ctx, sqliteTenantTags, []any{tagID})
+	rows, err := s.conn().QueryContext(ctx, `
+		SELECT id, tag_id, from_state, to_state, COALESCE(actor, ''), COALESCE(reason, ''), created
+		FROM tag_transitions
+		WHERE tag_id = ?`+scope+`
+		ORDER BY id
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	transitions := []TagTransition{}
+	for rows.Next() {
+		var t TagTransition
+		if err := rows.Scan(&t.ID, &t.TagID, &t.From, &t.To, &t.Actor, &t.Reason, &t.Created); err != nil {
+			return nil, err
+		}
+		transitions = append(transitions, t)
+	}
+	return transitions, rows.Err()
+}
+
+// DeleteTagHistory drops the audit trail of a tag, its history and state
+// transitions. DeleteTag leaves it alone on purpose, this is for erasure
+// requests.
+func (s *SQLiteDB) DeleteTagHistory(ctx context.Context, tagID string) error {
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	scope, args := sqliteTenantScope(ctx, sqliteTenantTags, []any{tagID})
+	if _, err := tx.ExecContext(ctx, `DELETE FROM tag_history WHERE tag_id = ?`+scope, args...); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM tag_transitions WHERE tag_id = ?`+scope, args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteDB) DeleteTag(ctx context.Context, id string) error {
+	scope, args := sqliteTenantScope(ctx, "tenant_id = %s", []any{id})
+	_, err := s.conn().ExecContext(ctx, `
+		DELETE FROM tags
+		WHERE id = ?`+scope, args...)
+	return err
+}
+
+func (s *SQLiteDB) AddAccessLog(ctx context.Context, log *AccessLog) error {
+	_, err := s.conn().ExecContext(ctx, `
+		INSERT INTO access_logs (ip, user_agent, timestamp, tag_id, severity, tenant_id, fields, kind, forwarded_for, forwarded, `+geoColumnList+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, sqliteAccessLogValues(ctx, log)...)
+	if err != nil {
+		return fmt.Errorf("failed to insert log: %v", err)
+	}
+	return nil
+}
+
+// sqliteAccessLogValues are the values of an access_logs insert.
+func sqliteAccessLogValues(ctx context.Context, log *AccessLog) []any {
+	values := []any{log.IP, log.UserAgent, log.Timestamp, log.TagID, log.severity(), tenantFor(ctx, log.TenantID), encodeLogFields(log.Fields), log.kind(), log.ForwardedFor, log.Forwarded}
+	return append(values, log.Geo.values()...)
+}
+
+func (s *SQLiteDB) AddAccessLogs(ctx context.Context, logs []*AccessLog) error {
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, `
+		INSERT INTO access_logs (ip, user_agent, timestamp, tag_id, severity, tenant_id, fields, kind, forwarded_for, forwarded, `+geoColumnList+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, log := range logs {
+		if _, err := stmt.ExecContext(ctx, sqliteAccessLogValues(ctx, log)...); err != nil {
+			return fmt.Errorf("failed to insert log: %v", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// sqliteAccessLogFilters turns the tag and time filters of q into SQL and
+// its arguments.
+func sqliteAccessLogFilters(q AccessLogQuery) ([]string, []any) {
+	var where []string
+	var args []any
+	if q.TenantID != "" {
+		where = append(where, "tenant_id = ?")
+		args = append(args, q.TenantID)
+	}
+	if q.TagID != "" {
+		where = append(where, "tag_id = ?")
+		args = append(args, q.TagID)
+	}
+	if len(q.ExcludeTagIDs) > 0 {
+		where = append(where, "(tag_id IS NULL OR tag_id NOT IN (?"+strings.Repeat(", ?", len(q.ExcludeTagIDs)-1)+"))")
+		for _, id := range q.ExcludeTagIDs {
+			args = append(args, id)
+		}
+	}
+	if !q.Tags.empty() {
+		cond, tagArgs := sqliteTagFilter(q.Tags)
+		where = append(where, "tag_id IN (SELECT id FROM tags WHERE "+cond+")")
+		args = append(args, tagArgs...)
+	}
+	if q.Severity != "" {
+		where = append(where, "severity = ?")
+		args = append(args, q.Severity)
+	}
+	if q.Kind != "" {
+		where = append(where, "kind = ?")
+		args = append(args, q.Kind)
+	}
+	if q.Since != 0 {
+		where = append(where, "timestamp >= ?")
+		args = append(args, q.Since)
+	}
+	if q.Until != 0 {
+		where = append(where, "timestamp < ?")
+		args = append(args, q.Until)
+	}
+	return where, args
+}
+
+// DeleteAccessLogs removes the logs matching the tag and time filters of q
+// and reports how many went.
+func (s *SQLiteDB) DeleteAccessLogs(ctx context.Context, q AccessLogQuery) (int64, error) {
+	if err := q.deletable(); err != nil {
+		return 0, err
+	}
+	q.scope(ctx)
+	where, args := sqliteAccessLogFilters(q)
+	res, err := s.conn().ExecContext(ctx, `DELETE FROM access_logs WHERE `+strings.Join(where, " AND "), args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *SQLiteDB) QueryAccessLogs(ctx context.Context, q AccessLogQuery) (*AccessLogPage, error) {
+	cursor, prefix, err := q.normalize()
+	if err != nil {
+		return nil, err
+	}
+	q.scope(ctx)
+	where, args := sqliteAccessLogFilters(q)
+	if q.UserAgent != "" {
+		where = append(where, "instr(lower(user_agent), lower(?)) > 0")
+		args = append(args, q.UserAgent)
+	}
+	if q.Country != "" {
+		where = append(where, "geo_country = ?")
+		args = append(args, q.Country)
+	}
+	if q.ASN != 0 {
+		where = append(where, "geo_asn = ?")
+		args = append(args, int64(q.ASN))
+	}
+	order, cmp := "ASC", ">"
+	if q.Descending {
+		order, cmp = "DESC", "<"
+	}
+	if cursor != nil {
+		where = append(where, fmt.Sprintf("(timestamp %s ? OR (timestamp = ? AND id %s ?))", cmp, cmp))
+		args = append(args, cursor.Timestamp, cursor.Timestamp, cursor.ID)
+	}
+	query := `SELECT id, ip, user_agent, timestamp, tag_id, severity, tenant_id, fields, kind, forwarded_for, forwarded, ` + geoColumnList + ` FROM access_logs`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += fmt.Sprintf(" ORDER BY timestamp %s, id %s", order, order)
+	// sqlite has no inet type, CIDR filtering happens while scanning so the
+	// limit can't be pushed down in that case
+	if prefix == nil {
+		query += " LIMIT ?"
+		args = append(args, q.Limit+1)
+	}
+
+	rows, err := s.conn().QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var logs []*AccessLog
+	for len(logs) <= q.Limit && rows.Next() {
+		var log AccessLog
+		var ip, userAgent, tagID sql.NullString
+		var fields []byte
+		var geo geoScan
+		dest := append([]any{&log.ID, &ip, &userAgent, &log.Timestamp, &tagID, &log.Severity, &log.TenantID, &fields, &log.Kind, &log.ForwardedFor, &log.Forwarded}, geo.dest()...)
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		log.IP, log.UserAgent, log.TagID = ip.String, userAgent.String, tagID.String
+		log.Fields = decodeLogFields(fields)
+		log.Geo = geo.info()
+		if !q.matches(&log, prefix) {
+			continue
+		}
+		logs = append(logs, &log)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return q.page(logs), nil
+}
+
+func (s *SQLiteDB) GetRetentionPolicies(ctx context.Context) ([]*RetentionPolicy, error) {
+	scope, args := sqliteTenantScope(ctx, "tenant_id = %s", nil)
+	rows, err := s.conn().QueryContext(ctx, `
+		SELECT id, tenant_id, COALESCE(tag_id, ''), action, after_days, drop_user_agent, applied_until, created
+		FROM retention_policies
+		WHERE true`+scope+`
+		ORDER BY after_days, id
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var policies []*RetentionPolicy
+	for rows.Next() {
+		var policy RetentionPolicy
+		if err := rows.Scan(&policy.ID, &policy.TenantID, &policy.TagID, &policy.Action, &policy.AfterDays, &policy.DropUserAgent, &policy.AppliedUntil, &policy.Created); err != nil {
+			return nil, err
+		}
+		policies = append(policies, &policy)
+	}
+	return policies, rows.Err()
+}
+
+// SaveRetentionPolicy inserts policy when it has no ID yet and overwrites
+// the stored one otherwise.
+func (s *SQLiteDB) SaveRetentionPolicy(ctx context.Context, policy *RetentionPolicy) error {
+	if policy.ID == 0 {
+		policy.TenantID = tenantFor(ctx, policy.TenantID)
+		res, err := s.conn().ExecContext(ctx, `
+			INSERT INTO retention_policies (tenant_id, tag_id, action, after_days, drop_user_agent, applied_until, created)
+			VALUES (?, NULLIF(?, ''), ?, ?, ?, ?, ?)
+		`, policy.TenantID, policy.TagID, policy.Action, policy.AfterDays, policy.DropUserAgent, policy.AppliedUntil, policy.Created)
+		if err != nil {
+			return err
+		}
+		policy.ID, err = res.LastInsertId()
+		return err
+	}
+	scope, args := sqliteTenantScope(ctx, "tenant_id = %s", []any{policy.TagID, policy.Action, policy.AfterDays, policy.DropUserAgent, policy.AppliedUntil, policy.ID})
+	res, err := s.conn().ExecContext(ctx, `
+		UPDATE retention_policies
+		SET tag_id = NULLIF(?, ''), action = ?, after_days = ?, drop_user_agent = ?, applied_until = ?
+		WHERE id = ?`+scope, args...)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *SQLiteDB) DeleteRetentionPolicy(ctx context.Context, id int64) error {
+	scope, args := sqliteTenantScope(ctx, "tenant_id = %s", []any{id})
+	res, err := s.conn().ExecContext(ctx, `DELETE FROM retention_policies WHERE id = ?`+scope, args...)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+type sqliteMigrationSession struct {
+	db *sql.DB
+}
+
+func (s sqliteMigrationSession) applied() (map[int]time.Time, error) {
+	if _, err := s.db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at INTEGER NOT NULL
+		)
+	`); err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query(`SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var at int64
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		applied[version] = time.Unix(at, 0)
+	}
+	return applied, rows.Err()
+}
+
+func (s sqliteMigrationSession) run(m Migration, up bool) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if up {
+		if _, err := tx.Exec(m.Up); err != nil {
+			return fmt.Errorf("migration %04d_%s up failed: %v", m.Version, m.Name, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`, m.Version, m.Name, time.Now().Unix()); err != nil {
+			return err
+		}
+	} else {
+		if _, err := tx.Exec(m.Down); err != nil {
+			return fmt.Errorf("migration %04d_%s down failed: %v", m.Version, m.Name, err)
+		}
+		if _, err := tx.Exec(`DELETE FROM schema_migrations WHERE version = ?`, m.Version); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteDB) MigrateUp(target int) error {
+	migrations, err := loadMigrations("migrations/sqlite")
+	if err != nil {
+		return err
+	}
+	if err := migrateUp(migrations, sqliteMigrationSession{s.DB}, target); err != nil {
+		return err
+	}
+	return s.importLegacyAccessLogs()
+}
+
+func (s *SQLiteDB) MigrateDown(steps int) error {
+	migrations, err := loadMigrations("migrations/sqlite")
+	if err != nil {
+		return err
+	}
+	return migrateDown(migrations, sqliteMigrationSession{s.DB}, steps)
+}
+
+func (s *SQLiteDB) MigrationStatus() ([]MigrationStatus, error) {
+	migrations, err := loadMigrations("migrations/sqlite")
+	if err != nil {
+		return nil, err
+	}
+	return migrationStatus(migrations, sqliteMigrationSession{s.DB})
+}
+
+const sqliteCampaignColumns = `id, tenant_id, name, owner, description, default_state, default_arm_at, default_expires_at, created`
+
+func scanSQLiteCampaign(row sqliteScanner) (*Campaign, error) {
+	var c Campaign
+	if err := row.Scan(&c.ID, &c.TenantID, &c.Name, &c.Owner, &c.Description, &c.DefaultState, &c.DefaultArmAt, &c.DefaultExpiresAt, &c.Created); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (s *SQLiteDB) GetCampaigns(ctx context.Context) ([]*Campaign, error) {
+	scope, args := sqliteTenantScope(ctx, "tenant_id = %s", nil)
+	rows, err := s.conn().QueryContext(ctx, `SELECT `+sqliteCampaignColumns+` FROM campaigns WHERE true`+scope+` ORDER BY id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var campaigns []*Campaign
+	for rows.Next() {
+		c, err := scanSQLiteCampaign(rows)
+		if err != nil {
+			return nil, err
+		}
+		campaigns = append(campaigns, c)
+	}
+	return campaigns, rows.Err()
+}
+
+func (s *SQLiteDB) GetCampaign(ctx context.Context, id int64) (*Campaign, error) {
+	scope, args := sqliteTenantScope(ctx, "tenant_id = %s", []any{id})
+	c, err := scanSQLiteCampaign(s.conn().QueryRowContext(ctx, `SELECT `+sqliteCampaignColumns+` FROM campaigns WHERE id = ?`+scope, args...))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return c, err
+}
+
+// SaveCampaign inserts c when it has no ID yet and overwrites the stored
+// one otherwise.
+func (s *SQLiteDB) SaveCampaign(ctx context.Context, c *Campaign) error {
+	if c.ID == 0 {
+		c.TenantID = tenantFor(ctx, c.TenantID)
+		res, err := s.conn().ExecContext(ctx, `
+			INSERT INTO campaigns (tenant_id, name, owner, description, default_state, default_arm_at, default_expires_at, created)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		`, c.TenantID, c.Name, c.Owner, c.Description, c.DefaultState, c.DefaultArmAt, c.DefaultExpiresAt, c.Created)
+		if err != nil {
+			return err
+		}
+		c.ID, err = res.LastInsertId()
+		return err
+	}
+	scope, args := sqliteTenantScope(ctx, "tenant_id = %s", []any{c.Name, c.Owner, c.Description, c.DefaultState, c.DefaultArmAt, c.DefaultExpiresAt, c.ID})
+	res, err := s.conn().ExecContext(ctx, `
+		UPDATE campaigns
+		SET name = ?, owner = ?, description = ?, default_state = ?, default_arm_at = ?, default_expires_at = ?
+		WHERE id = ?`+scope, args...)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DeleteCampaign removes a campaign, its tags stay but lose the link.
+// Postgres does the unlinking with ON DELETE SET NULL, here it is done by
+// hand, see 0008_campaigns.
+func (s *SQLiteDB) DeleteCampaign(ctx context.Context, id int64) error {
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	scope, args := sqliteTenantScope(ctx, "tenant_id = %s", []any{id})
+	res, err := tx.ExecContext(ctx, `DELETE FROM campaigns WHERE id = ?`+scope, args...)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE tags SET campaign_id = NULL WHERE campaign_id = ?`, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteDB) GetTagsByCampaign(ctx context.Context, id int64) ([]*Tag, error) {
+	scope, args := sqliteTenantScope(ctx, "tenant_id = %s", []any{id})
+	return s.queryTags(ctx, `
+		SELECT `+sqliteTagColumns+`
+		FROM tags
+		WHERE campaign_id = ?`+scope+`
+		ORDER BY created
+	`, args...)
+}
+
+func (s *SQLiteDB) GetTenants(ctx context.Context) ([]*Tenant, error) {
+	rows, err := s.conn().QueryContext(ctx, `SELECT id, name, created FROM tenants ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tenants []*Tenant
+	for rows.Next() {
+		var t Tenant
+		if err := rows.Scan(&t.ID, &t.Name, &t.Created); err != nil {
+			return nil, err
+		}
+		tenants = append(tenants, &t)
+	}
+	return tenants, rows.Err()
+}
+
+// AddTenant creates t, an existing ID is ErrConflict.
+func (s *SQLiteDB) AddTenant(ctx context.Context, t *Tenant) error {
+	res, err := s.conn().ExecContext(ctx, `
+		INSERT INTO tenants (id, name, created) VALUES (?, ?, ?)
+		ON CONFLICT (id) DO NOTHING
+	`, t.ID, t.Name, t.Created)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("%w: tenant %s exists", ErrConflict, t.ID)
+	}
+	return nil
+}
+
+func (s *SQLiteDB) AddAPIKey(ctx context.Context, k *APIKey) error {
+	res, err := s.conn().ExecContext(ctx, `
+		INSERT INTO api_keys (tenant_id, key_hash, label, created) VALUES (?, ?, ?, ?)
+	`, k.TenantID, k.Hash, k.Label, k.Created)
+	if err != nil {
+		return err
+	}
+	k.ID, err = res.LastInsertId()
+	return err
+}
+
+// GetAPIKey finds a key by its hash, whatever tenant ctx is scoped to.
+func (s *SQLiteDB) GetAPIKey(ctx context.Context, hash string) (*APIKey, error) {
+	var k APIKey
+	err := s.conn().QueryRowContext(ctx, `
+		SELECT id, tenant_id, key_hash, label, created FROM api_keys WHERE key_hash = ?
+	`, hash).Scan(&k.ID, &k.TenantID, &k.Hash, &k.Label, &k.Created)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+func (s *SQLiteDB) GetAPIKeys(ctx context.Context) ([]*APIKey, error) {
+	scope, args := sqliteTenantScope(ctx, "tenant_id = %s", nil)
+	rows, err := s.conn().QueryContext(ctx, `
+		SELECT id, tenant_id, key_hash, label, created FROM api_keys
+		WHERE true`+scope+`
+		ORDER BY id
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []*APIKey
+	for rows.Next() {
+		var k APIKey
+		if err := rows.Scan(&k.ID, &k.TenantID, &k.Hash, &k.Label, &k.Created); err != nil {
+			return nil, err
+		}
+		keys = append(keys, &k)
+	}
+	return keys, rows.Err()
+}
+
+func (s *SQLiteDB) DeleteAPIKey(ctx context.Context, id int64) error {
+	scope, args := sqliteTenantScope(ctx, "tenant_id = %s", []any{id})
+	res, err := s.conn().ExecContext(ctx, `DELETE FROM api_keys WHERE id = ?`+scope, args...)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+const (
+	contentTypeFDF  = "application/vnd.fdf"
+	contentTypeXFDF = "application/vnd.adobe.xfdf"
+)
+
+// limits on what a form submission can make us store
+const (
+	maxSubmitBody   = 64 << 10
+	maxSubmitFields = 32
+	maxSubmitValue  = 1024
+)
+
+// Keys of AccessLog.Fields. Form fields are kept as field.<name>.
+const (
+	SubmitFile        = "file"
+	SubmitID          = "id"
+	submitFieldPrefix = "field."
+)
+
+// pdfSubmitFormat tells a form submission from a PDF viewer apart from any
+// other POST, returning the format the viewer wants back. Acrobat sends FDF
+// or XFDF, and HTML submits from it still accept an FDF reply.
+func pdfSubmitFormat(r *http.Request) string {
+	if r.Method != http.MethodPost {
+		return ""
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case contentTypeFDF:
+		return BeaconFDF
+	case contentTypeXFDF:
+		return BeaconXFDF
+	}
+	accept := r.Header.Get("Accept")
+	switch {
+	case strings.Contains(accept, contentTypeXFDF):
+		return BeaconXFDF
+	case strings.Contains(accept, contentTypeFDF):
+		return BeaconFDF
+	}
+	ua := r.Header.Get("User-Agent")
+	if strings.Contains(ua, "Acrobat") || strings.Contains(ua, "Adobe") {
+		return BeaconFDF
+	}
+	return ""
+}
+
+// readSubmission reads the fields out of a POSTed FDF, XFDF or url encoded
+// form. Anything it can't make sense of gives no fields, the hit is
+// recorded either way.
+func readSubmission(r *http.Request) map[string]string {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxSubmitBody))
+	if err != nil || len(body) == 0 {
+		return nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	var fields map[string]string
+	switch {
+	case mediaType == contentTypeXFDF || bytes.HasPrefix(bytes.TrimSpace(body), []byte("<?xml")):
+		fields = parseXFDF(body)
+	case mediaType == contentTypeFDF || bytes.HasPrefix(body, []byte("%FDF")):
+		fields = parseFDF(body)
+	case mediaType == "application/x-www-form-urlencoded":
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			return nil
+		}
+		fields = map[string]string{}
+		for k, v := range values {
+			fields[submitFieldPrefix+k] = strings.Join(v, ",")
+		}
+	}
+	return capSubmission(fields)
+}
+
+// capSubmission limits what we keep of a submission and cleans it up for
+// storage. A NUL from an escape or an entity would make Postgres refuse
+// the whole COPY batch the hit lands in.
+func capSubmission(fields map[string]string) map[string]string {
+	if len(fields) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(fields))
+	for k, v := range fields {
+		if len(out) >= maxSubmitFields {
+			break
+		}
+		k = stripControl(k, false)
+		if k == "" {
+			continue
+		}
+		v = stripControl(v, true)
+		if len(v) > maxSubmitValue {
+			// don't cut a character in half
+			n := maxSubmitValue
+			for n > 0 && !utf8.RuneStart(v[n]) {
+				n--
+			}
+			v = v[:n]
+		}
+		out[k] = v
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
+
+// stripControl drops control characters and invalid UTF-8 from s, values
+// of multi-line fields keep their tabs and line breaks.
+func stripControl(s string, keepLines bool) string {
+	return strings.Map(func(r rune) rune {
+		if keepLines && (r == '\t' || r == '\n' || r == '\r') {
+			return r
+		}
+		if unicode.IsControl(r) || r == utf8.RuneError {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+type xfdfField struct {
+	Name   string      `xml:"name,attr"`
+	Values []string    `xml:"value"`
+	Fields []xfdfField `xml:"field"`
+}
+
+type xfdfDocument struct {
+	F struct {
+		Href string `xml:"href,attr"`
+	} `xml:"f"`
+	IDs struct {
+		Original string `xml:"original,attr"`
+	} `xml:"ids"`
+	Fields []xfdfField `xml:"fields>field"`
+}
+
+func parseXFDF(body []byte) map[string]string {
+	var doc xfdfDocument
+	if err := xml.Unmarshal(body, &doc); err != nil {
+		return nil
+	}
+	fields := map[string]string{}
+	if doc.F.Href != "" {
+		fields[SubmitFile] = doc.F.Href
+	}
+	if doc.IDs.Original != "" {
+		fields[SubmitID] = strings.ToLower(doc.IDs.Original)
+	}
+	// nested fields make up dotted names, like they do in the PDF
+	var walk func(prefix string, list []xfdfField)
+	walk = func(prefix string, list []xfdfField) {
+		for _, f := range list {
+			name := prefix + f.Name
+			if len(f.Values) > 0 {
+				fields[submitFieldPrefix+name] = strings.Join(f.Values, ",")
+			}
+			walk(name+".", f.Fields)
+		}
+	}
+	walk("", doc.Fields)
+	return fields
+}
+
+// fdfToken is a lexed piece of an FDF file. str is set for strings, other
+// tokens keep their text in raw.
+type fdfToken struct {
+	raw    string
+	str    string
+	isText bool
+}
+
+// parseFDF picks the file (/F or /UF), the document /ID and the /T /V pairs
+// of the fields out of an FDF. It doesn't try to understand the rest.
+func parseFDF(body []byte) map[string]string {
+	toks := lexFDF(body)
+	fields := map[string]string{}
+	var name string
+	for i := 0; i < len(toks); i++ {
+		next := func() (fdfToken, bool) {
+			if i+1 < len(toks) {
+				return toks[i+1], true
+			}
+			return fdfToken{}, false
+		}
+		switch toks[i].raw {
+		case "/F", "/UF":
+			// /F may also open a file spec dictionary, whose own /F and
+			// /UF come up next
+			if t, ok := next(); ok && t.isText && (toks[i].raw == "/UF" || fields[SubmitFile] == "") {
+				fields[SubmitFile] = t.str
+			}
+		case "/ID":
+			if i+2 < len(toks) && toks[i+1].raw == "[" && toks[i+2].isText {
+				fields[SubmitID] = hex.EncodeToString([]byte(toks[i+2].str))
+			}
+		case "/T":
+			if t, ok := next(); ok && t.isText {
+				name = t.str
+			}
+		case "/V":
+			t, ok := next()
+			if !ok || name == "" {
+				continue
+			}
+			switch {
+			case t.isText:
+				fields[submitFieldPrefix+name] = t.str
+			case strings.HasPrefix(t.raw, "/"):
+				fields[submitFieldPrefix+name] = t.raw[1:]
+			}
+			name = ""
+		}
+	}
+	return fields
+}
+
+func lexFDF(b []byte) []fdfToken {
+	var toks []fdfToken
+	for i := 0; i < len(b); {
+		c := b[i]
+		switch {
+		case c == '%':
+			for i < len(b) && b[i] != '\n' && b[i] != '\r' {
+				i++
+			}
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == 0:
+			i++
+		case c == '(':
+			s, n := lexLiteralString(b[i:])
+			toks = append(toks, fdfToken{str: pdfText(s), isText: true})
+			i += n
+		case c == '<' && i+1 < len(b) && b[i+1] == '<', c == '>' && i+1 < len(b) && b[i+1] == '>':
+			toks = append(toks, fdfToken{raw: string(b[i : i+2])})
+			i += 2
+		case c == '<':
+			end := bytes.IndexByte(b[i:], '>')
+			if end < 0 {
+				return toks
+			}
+			digits := strings.Map(func(r rune) rune {
+				if strings.ContainsRune("0123456789abcdefABCDEF", r) {
+					return r
+				}
+				return -1
+			}, string(b[i+1:i+end]))
+			if len(digits)%2 == 1 {
+				digits += "0"
+			}
+			raw, _ := hex.DecodeString(digits)
+			toks = append(toks, fdfToken{str: pdfText(raw), isText: true})
+			i += end + 1
+		case c == '[' || c == ']' || c == '{' || c == '}':
+			toks = append(toks, fdfToken{raw: string(c)})
+			i++
+		default:
+			start := i
+			i++
+			for i < len(b) && !strings.ContainsRune(" \t\r\n\f\x00()<>[]{}/%", rune(b[i])) {
+				i++
+			}
+			toks = append(toks, fdfToken{raw: string(b[start:i])})
+		}
+	}
+	return toks
+}
+
+// lexLiteralString reads a (...) string at the start of b, returning its
+// bytes and how much of b it used.
+func lexLiteralString(b []byte) ([]byte, int) {
+	var out []byte
+	depth := 0
+	for i := 0; i < len(b); i++ {
+		c := b[i]
+		switch {
+		case c == '(':
+			if depth > 0 {
+				out = append(out, c)
+			}
+			depth++
+		case c == ')':
+			depth--
+			if depth == 0 {
+				return out, i + 1
+			}
+			out = append(out, c)
+		case c == '\\' && i+1 < len(b):
+			i++
+			switch e := b[i]; e {
+			case 'n':
+				out = append(out, '\n')
+			case 'r':
+				out = append(out, '\r')
+			case 't':
+				out = append(out, '\t')
+			case 'b':
+				out = append(out, '\b')
+			case 'f':
+				out = append(out, '\f')
+			case '\r', '\n':
+				// line continuation
+				if e == '\r' && i+1 < len(b) && b[i+1] == '\n' {
+					i++
+				}
+			default:
+				if e >= '0' && e <= '7' {
+					v := 0
+					for n := 0; n < 3 && i < len(b) && b[i] >= '0' && b[i] <= '7'; n++ {
+						v = v*8 + int(b[i]-'0')
+						i++
+					}
+					i--
+					out = append(out, byte(v))
+				} else {
+					out = append(out, e)
+				}
+			}
+		default:
+			out = append(out, c)
+		}
+	}
+	return out, len(b)
+}
+
+// pdfText decodes a PDF text string, UTF-16BE with a BOM or otherwise
+// taken as is.
+func pdfText(b []byte) string {
+	if len(b) >= 2 && b[0] == 0xfe && b[1] == 0xff {
+		u := make([]uint16, 0, (len(b)-2)/2)
+		for i := 2; i+1 < len(b); i += 2 {
+			u = append(u, uint16(b[i])<<8|uint16(b[i+1]))
+		}
+		return string(utf16.Decode(u))
+	}
+	return string(b)
+}
+
+// encodeLogFields is the stored form of AccessLog.Fields, nil when there
+// are none so the column stays NULL for plain hits.
+func encodeLogFields(fields map[string]string) any {
+	if len(fields) == 0 {
+		return nil
+	}
+	raw, _ := json.Marshal(fields)
+	return string(raw)
+}
+
+func decodeLogFields(raw []byte) map[string]string {
+	if len(raw) == 0 {
+		return nil
+	}
+	var fields map[string]string
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil
+	}
+	return fields
+}
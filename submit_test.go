@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestPdfSubmitFormat(t *testing.T) {
+	for _, tc := range []struct {
+		name, method, ctype, accept, ua string
+		want                            string
+	}{
+		{"get", http.MethodGet, contentTypeFDF, "", "", ""},
+		{"fdf body", http.MethodPost, contentTypeFDF, "", "", BeaconFDF},
+		{"xfdf body", http.MethodPost, contentTypeXFDF + "; charset=utf-8", "", "", BeaconXFDF},
+		{"html submit accepting xfdf", http.MethodPost, "application/x-www-form-urlencoded", contentTypeXFDF, "", BeaconXFDF},
+		{"acrobat", http.MethodPost, "application/x-www-form-urlencoded", "", "Adobe Acrobat/23.0", BeaconFDF},
+		{"plain form", http.MethodPost, "application/x-www-form-urlencoded", "", "curl/8.0", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, "/", nil)
+			r.Header.Set("Content-Type", tc.ctype)
+			r.Header.Set("Accept", tc.accept)
+			r.Header.Set("User-Agent", tc.ua)
+			if got := pdfSubmitFormat(r); got != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseFDF(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		body string
+		want map[string]string
+	}{
+		{
+			"fields",
+			"%FDF-1.2\n1 0 obj\n<< /FDF << /F (plan.pdf) /ID [<0A0B> <0C>] /Fields [<< /T (name) /V (Alice) >> << /T (ok) /V /Yes >>] >> >>\nendobj\n%%EOF",
+			map[string]string{SubmitFile: "plan.pdf", SubmitID: "0a0b", "field.name": "Alice", "field.ok": "Yes"},
+		},
+		{
+			"file spec dictionary",
+			"<< /F << /F (old.pdf) /UF (plan \\(v2\\).pdf) >> >>",
+			map[string]string{SubmitFile: "plan (v2).pdf"},
+		},
+		{
+			"escapes",
+			"<< /T (note) /V (a\\tb\\101\\\nc (nested)) >>",
+			map[string]string{"field.note": "a\tbAc (nested)"},
+		},
+		{
+			"utf-16",
+			"<< /T <FEFF006E> /V (\xfe\xff\x00h\x00\xe9) >>",
+			map[string]string{"field.n": "hé"},
+		},
+		{
+			"value without name",
+			"<< /V (lost) >>",
+			map[string]string{},
+		},
+		{
+			"truncated",
+			"<< /T (name) /V <414",
+			map[string]string{},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := parseFDF([]byte(tc.body))
+			if len(got) != len(tc.want) {
+				t.Fatalf("got %q, want %q", got, tc.want)
+			}
+			for k, v := range tc.want {
+				if got[k] != v {
+					t.Errorf("%s: got %q, want %q", k, got[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestParseXFDF(t *testing.T) {
+	body := `<?xml version="1.0" encoding="UTF-8"?>
+<xfdf xmlns="http://ns.adobe.com/xfdf/">
+  <f href="plan.pdf"/>
+  <ids original="ABCD" modified="EF01"/>
+  <fields>
+    <field name="name"><value>Alice &amp; Bob</value></field>
+    <field name="address">
+      <field name="city"><value>Oslo</value></field>
+    </field>
+    <field name="pets"><value>cat</value><value>dog</value></field>
+  </fields>
+</xfdf>`
+	want := map[string]string{SubmitFile: "plan.pdf", SubmitID: "abcd", "field.name": "Alice & Bob", "field.address.city": "Oslo", "field.pets": "cat,dog"}
+	got := parseXFDF([]byte(body))
+	if len(got) != len(want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s: got %q, want %q", k, got[k], v)
+		}
+	}
+	if got := parseXFDF([]byte("<xfdf><fields>")); got != nil {
+		t.Errorf("broken xml: got %q", got)
+	}
+}
+
+func TestCapSubmission(t *testing.T) {
+	long := strings.Repeat("a", maxSubmitValue-1) + "é"
+	for _, tc := range []struct {
+		name   string
+		fields map[string]string
+		want   map[string]string
+	}{
+		{"nothing", nil, nil},
+		{"nul in value", map[string]string{"field.a": "x\x00y"}, map[string]string{"field.a": "xy"}},
+		{"lines kept", map[string]string{"field.a": "one\r\ntwo\tthree\x1b[0m"}, map[string]string{"field.a": "one\r\ntwo\tthree[0m"}},
+		{"control in key", map[string]string{"field.\x00a\n": "v"}, map[string]string{"field.a": "v"}},
+		{"only control key", map[string]string{"\x00": "v"}, nil},
+		{"invalid utf-8", map[string]string{"field.a": "a\xffb"}, map[string]string{"field.a": "ab"}},
+		{"cut on a rune", map[string]string{"field.a": long}, map[string]string{"field.a": long[:maxSubmitValue-1]}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := capSubmission(tc.fields)
+			if len(got) != len(tc.want) || (got == nil) != (tc.want == nil) {
+				t.Fatalf("got %q, want %q", got, tc.want)
+			}
+			for k, v := range tc.want {
+				if got[k] != v {
+					t.Errorf("%q: got %q, want %q", k, got[k], v)
+				}
+				if !utf8.ValidString(got[k]) {
+					t.Errorf("%q isn't valid utf-8", k)
+				}
+			}
+		})
+	}
+	many := map[string]string{}
+	for i := 0; i < 2*maxSubmitFields; i++ {
+		many[strings.Repeat("k", i+1)] = "v"
+	}
+	if got := capSubmission(many); len(got) != maxSubmitFields {
+		t.Errorf("kept %d fields, want %d", len(got), maxSubmitFields)
+	}
+}
+
+// TestBeaconSubmission posts forms the way viewers do and checks the
+// viewer gets a form back and the fields end up on the hit.
+func TestBeaconSubmission(t *testing.T) {
+	for _, tc := range []struct {
+		name, ctype, body string
+		ctypeBack         string
+		field             string
+	}{
+		{"fdf", contentTypeFDF, "%FDF-1.2\n<< /FDF << /Fields [<< /T (name) /V (Al\\000ice) >>] >> >>", contentTypeFDF, "Alice"},
+		{"xfdf", contentTypeXFDF, `<?xml version="1.0"?><xfdf><fields><field name="name"><value>Alice</value></field></fields></xfdf>`, contentTypeXFDF, "Alice"},
+		{"form", "application/x-www-form-urlencoded", "name=Al%00ice", "", "Alice"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			app := newTestApp(t)
+			addTestTag(t, app, map[string]any{"id": testTagID, "hash": "h"})
+			r := httptest.NewRequest(http.MethodPost, "/"+testTagID, strings.NewReader(tc.body))
+			r.Header.Set("Content-Type", tc.ctype)
+			w := serve(app, r)
+			if tc.ctypeBack == "" {
+				if w.Code != http.StatusNoContent {
+					t.Errorf("got %d, want 204", w.Code)
+				}
+			} else if w.Code != http.StatusOK || w.Header().Get("Content-Type") != tc.ctypeBack {
+				t.Errorf("got %d %q, want %q", w.Code, w.Header().Get("Content-Type"), tc.ctypeBack)
+			}
+			page, err := app.DB.QueryAccessLogs(context.Background(), AccessLogQuery{TagID: testTagID})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(page.Logs) != 1 || page.Logs[0].Fields["field.name"] != tc.field {
+				t.Errorf("got %+v", page.Logs)
+			}
+		})
+	}
+}
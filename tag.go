@@ -6,25 +6,46 @@ import (
 )
 
 type Tag struct {
-	Username string           `json:"username"`
-	FilePath string           `json:"file_path"`
-	ID       string           `json:"id"`
-	ClientID string           `json:"client_id"`
-	Hash     string           `json:"hash"`
-	URL      string           `json:"url"`
-	Created  int              `json:"created"`
-	History  []TagHistoryItem `json:"history"`
-	Access   []TagAccess      `json:"access"`
-	Memory   *sync.RWMutex    `json:"-"`
+	Username string `json:"username"`
+	// UsernameIndex is the blind index EncryptedDB keeps next to an
+	// encrypted username, it never leaves the storage layer.
+	UsernameIndex string `json:"-"`
+	FilePath      string `json:"file_path"`
+	ID            string `json:"id"`
+	ClientID      string `json:"client_id"`
+	Hash          string `json:"hash"`
+	URL           string `json:"url"`
+	Created       int    `json:"created"`
+	Version       int    `json:"version"`
+	// ArmAt and ExpiresAt bound when hits count, 0 leaves that side open.
+	// ExpiredAt is set once the expiry sweeper has retired the tag.
+	ArmAt     int    `json:"arm_at,omitempty"`
+	ExpiresAt int    `json:"expires_at,omitempty"`
+	ExpiredAt int    `json:"expired_at,omitempty"`
+	State     string `json:"state"`
+	// CampaignID links the tag to a Campaign, 0 for none.
+	CampaignID int64  `json:"campaign_id,omitempty"`
+	TenantID   string `json:"tenant_id,omitempty"`
+	// Response is what the beacon answers with, empty to go by the
+	// request. Decoy names the file sent for BeaconDecoy.
+	Response string `json:"response,omitempty"`
+	Decoy    string `json:"decoy,omitempty"`
+	// classification, labels and notes, flat in the JSON
+	TagMetadata
+	History []TagHistoryItem `json:"history"`
+	Access  []TagAccess      `json:"access"`
+	Memory  *sync.RWMutex    `json:"-"`
 }
 
 type TagAccess struct {
-	IP        string `json:"ip"`
-	UserAgent string `json:"user_agent"`
-	Timestamp int    `json:"timestamp"` // Unix timestamp
+	IP        string   `json:"ip"`
+	UserAgent string   `json:"user_agent"`
+	Timestamp int      `json:"timestamp"` // Unix timestamp
+	Geo       *GeoInfo `json:"geo,omitempty"`
 }
 
 type TagHistoryItem struct {
+	ID       int64  `json:"id,omitempty"`
 	ClientID string `json:"client_id"`
 	Hash     string `json:"hash"`
 	Created  int    `json:"created"`
@@ -45,9 +66,10 @@ func NewTag(id, clientID, hash string, created int) *Tag {
 func (t *Tag) AddHistory(clientID, hash string, created int) {
 	// t.Memory.Lock()
 	// defer t.Memory.Unlock()
-	if len(t.History) > 149 {
-		log.Printf("tag %s history is full, removing oldest item", t.ID)
-		t.History = t.History[1:]
+	// only the recent window lives on the tag, the full history is in the
+	// tag_history table
+	if len(t.History) >= tagHistoryWindow {
+		t.History = t.History[len(t.History)-tagHistoryWindow+1:]
 	}
 	t.History = append(t.History, TagHistoryItem{
 		ClientID: clientID,
@@ -56,9 +78,10 @@ func (t *Tag) AddHistory(clientID, hash string, created int) {
 	})
 }
 
-func (t *Tag) AddAccess(ip, userAgent string, timestamp int) {
-	// t.Memory.Lock()
-	// defer t.Memory.Unlock()
+func (t *Tag) AddAccess(ip, userAgent string, timestamp int, geo *GeoInfo) {
+	// the retention job rewrites Access while hits keep coming in
+	t.Memory.Lock()
+	defer t.Memory.Unlock()
 	if len(t.Access) > 149 {
 		log.Printf("tag %s access is full, removing oldest item", t.ID)
 		t.Access = t.Access[1:]
@@ -67,6 +90,7 @@ func (t *Tag) AddAccess(ip, userAgent string, timestamp int) {
 		IP:        ip,
 		UserAgent: userAgent,
 		Timestamp: timestamp,
+		Geo:       geo,
 	})
 }
 
@@ -75,3 +99,19 @@ func (t *Tag) GetHistory() []TagHistoryItem {
 	defer t.Memory.RUnlock()
 	return t.History
 }
+
+// clone returns a copy of t that can be modified without touching t, e.g.
+// before a write that may be rejected. Hits keep appending to a cached tag,
+// read it through a clone rather than directly.
+func (t *Tag) clone() *Tag {
+	if t.Memory != nil {
+		t.Memory.RLock()
+		defer t.Memory.RUnlock()
+	}
+	c := *t
+	c.Memory = &sync.RWMutex{}
+	c.TagMetadata = t.TagMetadata.clone()
+	c.History = append([]TagHistoryItem(nil), t.History...)
+	c.Access = append([]TagAccess(nil), t.Access...)
+	return &c
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"container/list"
+	"expvar"
+	"sync"
+	"time"
+)
+
+var (
+	tagCacheHits      = expvar.NewInt("tag_cache_hits")
+	tagCacheMisses    = expvar.NewInt("tag_cache_misses")
+	tagCacheEvictions = expvar.NewInt("tag_cache_evictions")
+	tagCacheSize      = expvar.NewInt("tag_cache_size")
+)
+
+// TagCache is a bounded LRU of tags in front of the database. Entries older
+// than TTL are treated as misses so changes made elsewhere are picked up
+// eventually. A TTL of 0 disables expiry.
+type TagCache struct {
+	Memory *sync.Mutex
+	Size   int
+	TTL    time.Duration
+	items  map[string]*list.Element
+	order  *list.List
+}
+
+type tagCacheEntry struct {
+	tag     *Tag
+	expires time.Time
+}
+
+func NewTagCache(size int, ttl time.Duration) *TagCache {
+	if size < 1 {
+		size = 1
+	}
+	return &TagCache{
+		Memory: &sync.Mutex{},
+		Size:   size,
+		TTL:    ttl,
+		items:  map[string]*list.Element{},
+		order:  list.New(),
+	}
+}
+
+func (c *TagCache) Get(id string) (*Tag, bool) {
+	c.Memory.Lock()
+	defer c.Memory.Unlock()
+	el, ok := c.items[id]
+	if !ok {
+		tagCacheMisses.Add(1)
+		return nil, false
+	}
+	entry := el.Value.(*tagCacheEntry)
+	if c.TTL > 0 && time.Now().After(entry.expires) {
+		c.remove(el)
+		tagCacheMisses.Add(1)
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	tagCacheHits.Add(1)
+	return entry.tag, true
+}
+
+// Set stores tag, replacing any cached entry with the same ID and evicting
+// the least recently used entries when over Size.
+func (c *TagCache) Set(tag *Tag) {
+	c.Memory.Lock()
+	defer c.Memory.Unlock()
+	// tags loaded from a store don't come with a lock of their own
+	if tag.Memory == nil {
+		tag.Memory = &sync.RWMutex{}
+	}
+	expires := time.Now().Add(c.TTL)
+	if el, ok := c.items[tag.ID]; ok {
+		el.Value = &tagCacheEntry{tag: tag, expires: expires}
+		c.order.MoveToFront(el)
+		return
+	}
+	c.items[tag.ID] = c.order.PushFront(&tagCacheEntry{tag: tag, expires: expires})
+	for c.order.Len() > c.Size {
+		c.remove(c.order.Back())
+		tagCacheEvictions.Add(1)
+	}
+	tagCacheSize.Set(int64(c.order.Len()))
+}
+
+func (c *TagCache) Remove(id string) {
+	c.Memory.Lock()
+	defer c.Memory.Unlock()
+	if el, ok := c.items[id]; ok {
+		c.remove(el)
+	}
+}
+
+// Purge drops every entry.
+func (c *TagCache) Purge() {
+	c.Memory.Lock()
+	defer c.Memory.Unlock()
+	c.items = map[string]*list.Element{}
+	c.order.Init()
+	tagCacheSize.Set(0)
+}
+
+// Tags returns the cached tags, including expired ones not reaped yet.
+func (c *TagCache) Tags() []*Tag {
+	c.Memory.Lock()
+	defer c.Memory.Unlock()
+	tags := make([]*Tag, 0, c.order.Len())
+	for el := c.order.Front(); el != nil; el = el.Next() {
+		tags = append(tags, el.Value.(*tagCacheEntry).tag)
+	}
+	return tags
+}
+
+func (c *TagCache) Len() int {
+	c.Memory.Lock()
+	defer c.Memory.Unlock()
+	return c.order.Len()
+}
+
+func (c *TagCache) remove(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.items, el.Value.(*tagCacheEntry).tag.ID)
+	tagCacheSize.Set(int64(c.order.Len()))
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTagCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := NewTagCache(2, 0)
+	c.Set(&Tag{ID: "a"})
+	c.Set(&Tag{ID: "b"})
+	// a is now the most recently used, b goes first
+	if _, ok := c.Get("a"); !ok {
+		t.Fatal("a missing")
+	}
+	c.Set(&Tag{ID: "c"})
+	if _, ok := c.Get("b"); ok {
+		t.Error("b survived eviction")
+	}
+	for _, id := range []string{"a", "c"} {
+		if _, ok := c.Get(id); !ok {
+			t.Errorf("%s was evicted", id)
+		}
+	}
+	if c.Len() != 2 {
+		t.Errorf("len %d, want 2", c.Len())
+	}
+}
+
+func TestTagCacheReplaces(t *testing.T) {
+	c := NewTagCache(2, 0)
+	c.Set(&Tag{ID: "a", Hash: "old"})
+	c.Set(&Tag{ID: "a", Hash: "new"})
+	tag, ok := c.Get("a")
+	if !ok || tag.Hash != "new" || c.Len() != 1 {
+		t.Errorf("got %v %v, len %d", tag, ok, c.Len())
+	}
+	if tag.Memory == nil {
+		t.Error("Set didn't give the tag a lock")
+	}
+	c.Remove("a")
+	if _, ok := c.Get("a"); ok {
+		t.Error("a still cached after Remove")
+	}
+}
+
+func TestTagCacheTTL(t *testing.T) {
+	c := NewTagCache(10, 20*time.Millisecond)
+	c.Set(&Tag{ID: "a"})
+	if _, ok := c.Get("a"); !ok {
+		t.Fatal("fresh entry missing")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, ok := c.Get("a"); ok {
+		t.Error("expired entry returned")
+	}
+	if c.Len() != 0 {
+		t.Errorf("expired entry kept, len %d", c.Len())
+	}
+}
+
+func TestTagCachePurge(t *testing.T) {
+	c := NewTagCache(10, 0)
+	c.Set(&Tag{ID: "a"})
+	c.Set(&Tag{ID: "b"})
+	c.Purge()
+	if c.Len() != 0 || len(c.Tags()) != 0 {
+		t.Errorf("purge left %d entries", c.Len())
+	}
+}
+
+// TestCachedTagReadsWhileHit reads a cached tag through the API while hits
+// append to it, run with -race.
+func TestCachedTagReadsWhileHit(t *testing.T) {
+	app := newTestApp(t)
+	addTestTag(t, app, map[string]any{"id": testTagID, "hash": "h"})
+	getTestTag(t, app, testTagID)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			serve(app, httptest.NewRequest(http.MethodGet, "/"+testTagID, nil))
+		}()
+		go func() {
+			defer wg.Done()
+			getTestTag(t, app, testTagID)
+		}()
+	}
+	wg.Wait()
+}
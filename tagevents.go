@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"time"
+)
+
+const tagEventChannel = "thelp_tags"
+
+var (
+	tagEventsReceived = expvar.NewInt("tag_events_received")
+	tagEventResyncs   = expvar.NewInt("tag_event_resyncs")
+)
+
+// TagEvent describes a change to a tag made by any instance sharing the
+// database.
+type TagEvent struct {
+	Op      string `json:"op"`
+	ID      string `json:"id"`
+	Version int    `json:"version"`
+	Origin  string `json:"origin"`
+}
+
+// TagEventSource is implemented by backends that can tell other instances
+// about tag changes. handle is called for each event, resync whenever events
+// may have been missed and cached state can no longer be trusted.
+type TagEventSource interface {
+	ListenTagEvents(ctx context.Context, handle func(TagEvent), resync func())
+}
+
+// ListenTagEvents LISTENs on the tag channel until ctx is done, reconnecting
+// with backoff when the connection drops. Notifications sent while we were
+// disconnected are lost, so every reconnect triggers a resync.
+func (p *PostgresDB) ListenTagEvents(ctx context.Context, handle func(TagEvent), resync func()) {
+	backoff := time.Second
+	connected := false
+	for ctx.Err() == nil {
+		err := p.listenTagEvents(ctx, handle, func() {
+			if connected {
+				tagEventResyncs.Add(1)
+				resync()
+			}
+			connected = true
+			backoff = time.Second
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		fmt.Println("tag event listener disconnected, retrying in", backoff, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+func (p *PostgresDB) listenTagEvents(ctx context.Context, handle func(TagEvent), onConnect func()) error {
+	conn, err := p.Pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Exec(ctx, "LISTEN "+tagEventChannel); err != nil {
+		conn.Release()
+		return err
+	}
+	// the session is left in LISTEN state, don't hand it back to the pool
+	pc := conn.Hijack()
+	defer pc.Close(context.Background())
+	onConnect()
+	for {
+		n, err := pc.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		var event TagEvent
+		if err := json.Unmarshal([]byte(n.Payload), &event); err != nil {
+			fmt.Println("bad tag event payload", n.Payload, err)
+			continue
+		}
+		tagEventsReceived.Add(1)
+		if event.Origin == p.Instance {
+			continue
+		}
+		handle(event)
+	}
+}
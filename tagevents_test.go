@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+// fakeListenServer speaks just enough of the Postgres protocol to accept
+// one connection, answer its LISTEN and then send notify.
+func fakeListenServer(t *testing.T, notify []TagEvent) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		be := pgproto3.NewBackend(conn, conn)
+		if _, err := be.ReceiveStartupMessage(); err != nil {
+			t.Errorf("startup: %v", err)
+			return
+		}
+		be.Send(&pgproto3.AuthenticationOk{})
+		be.Send(&pgproto3.BackendKeyData{ProcessID: 1, SecretKey: 1})
+		be.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+		if err := be.Flush(); err != nil {
+			return
+		}
+		msg, err := be.Receive()
+		if err != nil {
+			t.Errorf("receive: %v", err)
+			return
+		}
+		if q, ok := msg.(*pgproto3.Query); !ok || q.String != "LISTEN "+tagEventChannel {
+			t.Errorf("got %#v, want LISTEN", msg)
+			return
+		}
+		be.Send(&pgproto3.CommandComplete{CommandTag: []byte("LISTEN")})
+		be.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+		for _, event := range notify {
+			payload, _ := json.Marshal(event)
+			be.Send(&pgproto3.NotificationResponse{PID: 2, Channel: tagEventChannel, Payload: string(payload)})
+		}
+		be.Send(&pgproto3.NotificationResponse{PID: 2, Channel: tagEventChannel, Payload: "not json"})
+		if err := be.Flush(); err != nil {
+			return
+		}
+		// hold the session open until the client goes away
+		for {
+			if _, err := be.Receive(); err != nil {
+				return
+			}
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestListenTagEvents(t *testing.T) {
+	addr := fakeListenServer(t, []TagEvent{
+		{Op: "update", ID: testTagID, Version: 2, Origin: "thelp-self"},
+		{Op: "delete", ID: testTagID2, Origin: "thelp-other"},
+	})
+	db, err := NewPostgresDB(fmt.Sprintf("postgres://thelp@%s/thelp?sslmode=disable", addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Instance = "thelp-self"
+	defer db.Pool.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	events := make(chan TagEvent, 2)
+	connected := false
+	done := make(chan error, 1)
+	go func() {
+		done <- db.listenTagEvents(ctx, func(e TagEvent) { events <- e }, func() { connected = true })
+	}()
+
+	select {
+	case e := <-events:
+		// our own update is skipped, the other instance's delete isn't
+		if e.Op != "delete" || e.ID != testTagID2 {
+			t.Errorf("got %+v", e)
+		}
+	case err := <-done:
+		t.Fatalf("listener stopped: %v", err)
+	case <-ctx.Done():
+		t.Fatal("no event")
+	}
+	cancel()
+	if err := <-done; err == nil {
+		t.Error("listener returned nil after cancel")
+	}
+	if !connected {
+		t.Error("onConnect wasn't called")
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// DefaultTenant owns everything written before tenants existed.
+const DefaultTenant = "default"
+
+const apiKeyPrefix = "thelp_"
+
+var tenantIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+
+// Tenant is one team sharing the server. Tags, access logs, campaigns,
+// retention policies and uploaded files all belong to exactly one.
+type Tenant struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Created int    `json:"created"`
+}
+
+// APIKey maps a credential to its tenant. Only a hash of the key is
+// stored, the key itself is shown once when it is created.
+type APIKey struct {
+	ID       int64  `json:"id"`
+	TenantID string `json:"tenant_id"`
+	Label    string `json:"label,omitempty"`
+	Hash     string `json:"-"`
+	Created  int    `json:"created"`
+}
+
+type (
+	tenantKey struct{}
+	actorKey  struct{}
+)
+
+// WithTenant scopes every Database call made with ctx to tenant.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// tenantFrom returns the tenant ctx is scoped to. A context without one
+// sees every tenant, which is what beacon lookups and the background jobs
+// want; API requests always get one from requireTenant.
+func tenantFrom(ctx context.Context) (string, bool) {
+	tenant, ok := ctx.Value(tenantKey{}).(string)
+	return tenant, ok
+}
+
+// WithActor records who ctx acts for, which the audit trail of state
+// changes keeps.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// actorFrom returns who ctx acts for, empty for the background jobs.
+func actorFrom(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
+
+// keyActor names the holder of k in the audit trail, the key itself is
+// never stored so its ID and label have to do.
+func keyActor(k *APIKey) string {
+	if k.Label == "" {
+		return fmt.Sprintf("key:%d", k.ID)
+	}
+	return fmt.Sprintf("key:%d (%s)", k.ID, k.Label)
+}
+
+// tenantFor picks the tenant a new record goes to. A scoped ctx wins over
+// whatever the record says, so a caller can't write into another tenant.
+func tenantFor(ctx context.Context, own string) string {
+	if tenant, ok := tenantFrom(ctx); ok {
+		return tenant
+	}
+	if own != "" {
+		return own
+	}
+	return DefaultTenant
+}
+
+// inTenant reports whether a record of tenant is visible to ctx.
+func inTenant(ctx context.Context, tenant string) bool {
+	scoped, ok := tenantFrom(ctx)
+	return !ok || scoped == tenant
+}
+
+func validateTenantID(id string) error {
+	if !tenantIDPattern.MatchString(id) {
+		return fmt.Errorf("%w: tenant id must be 1-32 lowercase letters, digits or dashes", ErrInvalidQuery)
+	}
+	return nil
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func newAPIKey() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// tenantStaticDir is where the uploads of tenant live. The default tenant
+// keeps using ./static itself so existing files stay where they are.
+func tenantStaticDir(tenant string) string {
+	if tenant == DefaultTenant {
+		return "./static"
+	}
+	return filepath.Join("./static", "tenants", tenant)
+}
+
+// requireTenant resolves the API key of a request to its tenant and scopes
+// the request context to it, with the key as the actor. Requests without a
+// key get AnonymousTenant, or a 401 if that is empty.
+func (a *Application) requireTenant(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tenant, actor := a.AnonymousTenant, "anonymous"
+		key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if ok {
+			ctx, cancel := a.dbContext(r.Context())
+			apiKey, err := a.DB.GetAPIKey(ctx, hashAPIKey(strings.TrimSpace(key)))
+			cancel()
+			if errors.Is(err, ErrNotFound) {
+				http.Error(w, "invalid API key", http.StatusUnauthorized)
+				return
+			}
+			if err != nil {
+				a.dbError(w, r, err)
+				return
+			}
+			tenant, actor = apiKey.TenantID, keyActor(apiKey)
+		}
+		if tenant == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="thelp"`)
+			http.Error(w, "API key required", http.StatusUnauthorized)
+			return
+		}
+		a.Logger.Debug("request scoped to tenant", zap.String("path", r.URL.Path), zap.String("tenant", tenant))
+		next(w, r.WithContext(WithActor(WithTenant(r.Context(), tenant), actor)))
+	}
+}
+
+// StaticHandler serves GET /static/ from the caller's own upload directory.
+func (a *Application) StaticHandler(w http.ResponseWriter, r *http.Request) {
+	tenant, _ := tenantFrom(r.Context())
+	name := strings.TrimPrefix(r.URL.Path, "/static/")
+	// the default tenant's directory holds everyone else's
+	if tenant == DefaultTenant && (name == "tenants" || strings.HasPrefix(name, "tenants/")) {
+		http.NotFound(w, r)
+		return
+	}
+	http.StripPrefix("/static/", http.FileServer(http.Dir(tenantStaticDir(tenant)))).ServeHTTP(w, r)
+}
+
+// runTenantsCommand implements `thelp tenants add|list|key|keys|revoke`.
+func runTenantsCommand(db Database, args []string) error {
+	usage := fmt.Errorf("usage: thelp tenants add <id> [name] | list | key <tenant> [label] | keys [tenant] | revoke <key id>")
+	if len(args) == 0 {
+		return usage
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *dbTimeout)
+	defer cancel()
+	now := int(time.Now().Unix())
+	switch args[0] {
+	case "add":
+		if len(args) < 2 {
+			return usage
+		}
+		if err := validateTenantID(args[1]); err != nil {
+			return err
+		}
+		t := &Tenant{ID: args[1], Name: strings.Join(args[2:], " "), Created: now}
+		if err := db.AddTenant(ctx, t); err != nil {
+			return err
+		}
+		fmt.Println("added tenant", t.ID)
+	case "list":
+		tenants, err := db.GetTenants(ctx)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		for _, t := range tenants {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", t.ID, t.Name, time.Unix(int64(t.Created), 0).Format(time.RFC3339))
+		}
+		return tw.Flush()
+	case "key":
+		if len(args) < 2 {
+			return usage
+		}
+		tenants, err := db.GetTenants(ctx)
+		if err != nil {
+			return err
+		}
+		known := false
+		for _, t := range tenants {
+			known = known || t.ID == args[1]
+		}
+		if !known {
+			return fmt.Errorf("no tenant %s, add it first", args[1])
+		}
+		key, err := newAPIKey()
+		if err != nil {
+			return err
+		}
+		k := &APIKey{TenantID: args[1], Label: strings.Join(args[2:], " "), Hash: hashAPIKey(key), Created: now}
+		if err := db.AddAPIKey(ctx, k); err != nil {
+			return err
+		}
+		fmt.Printf("key %d for tenant %s, it is not shown again:\n%s\n", k.ID, k.TenantID, key)
+	case "keys":
+		if len(args) > 1 {
+			ctx = WithTenant(ctx, args[1])
+		}
+		keys, err := db.GetAPIKeys(ctx)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		for _, k := range keys {
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", k.ID, k.TenantID, k.Label, time.Unix(int64(k.Created), 0).Format(time.RFC3339))
+		}
+		return tw.Flush()
+	case "revoke":
+		if len(args) != 2 {
+			return usage
+		}
+		id, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return usage
+		}
+		if err := db.DeleteAPIKey(ctx, id); err != nil {
+			return err
+		}
+		fmt.Println("revoked key", id)
+	default:
+		return usage
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newTenantApp gives an app that requires a key, with "acme-key" for acme
+// and "beta-key" for beta.
+func newTenantApp(t *testing.T) *Application {
+	t.Helper()
+	app := newTestApp(t)
+	app.AnonymousTenant = ""
+	for tenant, key := range map[string]string{"acme": "acme-key", "beta": "beta-key"} {
+		if err := app.DB.AddAPIKey(context.Background(), &APIKey{TenantID: tenant, Hash: hashAPIKey(key)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return app
+}
+
+func withKey(r *http.Request, key string) *http.Request {
+	r.Header.Set("Authorization", "Bearer "+key)
+	return r
+}
+
+func TestKeyActor(t *testing.T) {
+	for _, tc := range []struct {
+		key  APIKey
+		want string
+	}{
+		{APIKey{ID: 3}, "key:3"},
+		{APIKey{ID: 3, Label: "ci"}, "key:3 (ci)"},
+	} {
+		if got := keyActor(&tc.key); got != tc.want {
+			t.Errorf("got %q, want %q", got, tc.want)
+		}
+	}
+}
+
+func TestRequireTenant(t *testing.T) {
+	for _, tc := range []struct {
+		name, anonymous, key string
+		code                 int
+	}{
+		{"no key by default", "", "", http.StatusUnauthorized},
+		{"unknown key", "", "nope", http.StatusUnauthorized},
+		{"key", "", "acme-key", http.StatusOK},
+		{"anonymous opted in", DefaultTenant, "", http.StatusOK},
+		{"unknown key with anonymous", DefaultTenant, "nope", http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			app := newTenantApp(t)
+			app.AnonymousTenant = tc.anonymous
+			r := httptest.NewRequest(http.MethodGet, "/tags", nil)
+			if tc.key != "" {
+				withKey(r, tc.key)
+			}
+			if w := serve(app, r); w.Code != tc.code {
+				t.Errorf("got %d %s, want %d", w.Code, w.Body, tc.code)
+			}
+		})
+	}
+}
+
+// TestTenantIsolation has beta go after a tag of acme through every route
+// that takes a tag id.
+func TestTenantIsolation(t *testing.T) {
+	app := newTenantApp(t)
+	w := serve(app, withKey(jsonRequest(t, http.MethodPost, "/tag", map[string]any{"id": testTagID, "hash": "h", "username": "alice"}), "acme-key"))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("add: %d %s", w.Code, w.Body)
+	}
+	for _, tc := range []struct {
+		name string
+		r    *http.Request
+		code int
+	}{
+		{"get", jsonRequest(t, http.MethodPost, "/get-tag", TagQuery{ID: testTagID}), http.StatusNotFound},
+		{"state", jsonRequest(t, http.MethodPost, "/tag-state", map[string]any{"id": testTagID, "state": TagDisarmed}), http.StatusNotFound},
+		{"schedule", jsonRequest(t, http.MethodPost, "/tag-schedule", tagScheduleRequest{ID: testTagID, ArmAt: 100}), http.StatusNotFound},
+		{"retention", jsonRequest(t, http.MethodPost, "/retention", RetentionPolicy{TagID: testTagID, Action: RetentionDelete}), http.StatusNotFound},
+		{"overwrite", jsonRequest(t, http.MethodPost, "/tag", map[string]any{"id": testTagID, "hash": "h2"}), http.StatusConflict},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if w := serve(app, withKey(tc.r, "beta-key")); w.Code != tc.code {
+				t.Errorf("got %d %s, want %d", w.Code, w.Body, tc.code)
+			}
+		})
+	}
+
+	for path, want := range map[string]int{"/tags": 0, "/tag-transitions?id=" + testTagID: 0} {
+		w := serve(app, withKey(httptest.NewRequest(http.MethodGet, path, nil), "beta-key"))
+		var got []json.RawMessage
+		if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+			t.Fatalf("%s: %d %v", path, w.Code, err)
+		}
+		if len(got) != want {
+			t.Errorf("%s: beta sees %d records", path, len(got))
+		}
+	}
+	serve(app, withKey(jsonRequest(t, http.MethodPost, "/delete-tag", TagQuery{ID: testTagID}), "beta-key"))
+	serve(app, withKey(jsonRequest(t, http.MethodPost, "/erase-user", eraseUserRequest{Username: "alice"}), "beta-key"))
+
+	w = serve(app, withKey(jsonRequest(t, http.MethodPost, "/get-tag", TagQuery{ID: testTagID}), "acme-key"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("acme lost its tag: %d %s", w.Code, w.Body)
+	}
+	tag := &Tag{}
+	if err := json.NewDecoder(w.Body).Decode(tag); err != nil {
+		t.Fatal(err)
+	}
+	if tag.Hash != "h" || tag.State != TagArmed || tag.ArmAt != 0 || tag.TenantID != "acme" {
+		t.Errorf("beta changed acme's tag: %+v", tag)
+	}
+}
+
+// TestApplyRetentionTenants stores a delete policy of beta's naming acme's
+// tag, as a policy saved before the handler checked tags would. acme's own
+// global policy still has to cover the tag and beta's must not touch it.
+func TestApplyRetentionTenants(t *testing.T) {
+	app := newTestApp(t)
+	old := int(time.Now().Add(-60 * 24 * time.Hour).Unix())
+	acme, beta := WithTenant(context.Background(), "acme"), WithTenant(context.Background(), "beta")
+	tag := NewTag(testTagID, "c1", "h1", old)
+	if err := app.DB.InsertTag(acme, tag, TagChange{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.DB.AddAccessLog(acme, &AccessLog{IP: "203.0.113.7", Timestamp: old, TagID: testTagID}); err != nil {
+		t.Fatal(err)
+	}
+	cached, err := app.GetTag(acme, testTagID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cached.Access = []TagAccess{{IP: "203.0.113.7", Timestamp: old}}
+	if err := app.DB.SaveRetentionPolicy(acme, &RetentionPolicy{Action: RetentionTruncate, AfterDays: 30}); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.DB.SaveRetentionPolicy(beta, &RetentionPolicy{TagID: testTagID, Action: RetentionDelete, AfterDays: 0}); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.ApplyRetention(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	page, err := app.DB.QueryAccessLogs(acme, AccessLogQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Logs) != 1 || page.Logs[0].IP != "203.0.113.0" {
+		t.Errorf("acme's logs: %+v", page.Logs)
+	}
+	if len(cached.Access) != 1 || cached.Access[0].IP != "203.0.113.0" {
+		t.Errorf("acme's cached hits: %+v", cached.Access)
+	}
+}
@@ -5,11 +5,14 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -39,16 +42,56 @@ func (a *Application) UploadFileHandler(w http.ResponseWriter, r *http.Request)
 
 	lastChunk := r.Header.Get("X-last-chunk")
 	uid := r.Header.Get("X-id")
-	tag := a.GetTag(uid)
-	if tag != nil {
-		if uid == "" {
-			uid = uuid.New().String()
+	if uid != "" {
+		existing, err := a.GetTag(r.Context(), uid)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			a.dbError(w, r, err)
+			return
 		}
-		tag = &Tag{
-			ID:      uid,
-			URL:     fmt.Sprintf("%s/%s", a.FQDN, uid),
-			History: []TagHistoryItem{},
-			Access:  []TagAccess{},
+		// a retired tag stays retired, don't instrument a new file for it
+		if existing != nil && existing.lifecycle() == TagRetired {
+			http.Error(w, fmt.Sprintf("tag %s is retired", uid), http.StatusConflict)
+			return
+		}
+	} else {
+		uid = uuid.New().String()
+	}
+	// X-state only matters for a new tag, draft keeps it quiet until it is
+	// armed through /tag-state
+	tag := &Tag{
+		ID:      uid,
+		URL:     fmt.Sprintf("%s/%s", a.FQDN, uid),
+		State:   r.Header.Get("X-state"),
+		History: []TagHistoryItem{},
+		Access:  []TagAccess{},
+	}
+	if err := validInitialState(tag.lifecycle()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// X-classification, X-label: key:value (repeatable) and X-notes end up
+	// in the tag's metadata
+	tag.Classification = r.Header.Get("X-classification")
+	tag.Notes = r.Header.Get("X-notes")
+	for _, label := range r.Header.Values("X-label") {
+		k, v, ok := strings.Cut(label, ":")
+		if !ok {
+			http.Error(w, "X-label must be key:value", http.StatusBadRequest)
+			return
+		}
+		if tag.Labels == nil {
+			tag.Labels = map[string]string{}
+		}
+		tag.Labels[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	if err := tag.TagMetadata.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if campaign := r.Header.Get("X-campaign"); campaign != "" {
+		if tag.CampaignID, err = strconv.ParseInt(campaign, 10, 64); err != nil {
+			http.Error(w, "invalid X-campaign", http.StatusBadRequest)
+			return
 		}
 	}
 
@@ -61,7 +104,16 @@ func (a *Application) UploadFileHandler(w http.ResponseWriter, r *http.Request)
 		UploadResponse.ID = uid
 		UploadResponse.Status = "complete"
 
-		err := a.WriteToDisk(fmt.Sprintf("./static/%s", filename), fileData.Bytes())
+		// files land in the uploader's tenant, /static/ only serves them
+		// back to the same tenant
+		tenant, _ := tenantFrom(r.Context())
+		dir := tenantStaticDir(tenant)
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			fmt.Println("Error creating static dir:", err)
+			http.Error(w, "Error writing file", http.StatusInternalServerError)
+			return
+		}
+		err := a.WriteToDisk(fmt.Sprintf("%s/%s", dir, filename), fileData.Bytes())
 		if err != nil {
 			fmt.Println("Error writing to disk:", err)
 			return // Or handle error appropriately
@@ -71,13 +123,13 @@ func (a *Application) UploadFileHandler(w http.ResponseWriter, r *http.Request)
 		modifiedFilenameWithoutExt := modifiedFilename[:len(modifiedFilename)-len(filepath.Ext(modifiedFilename))]
 		modifiedFilename = modifiedFilenameWithoutExt + "_new.pdf"
 
-		err = RunBashScript("./scripts/call_add_py.sh", fmt.Sprintf("./static/%s", filename), uid)
+		err = RunBashScript("./scripts/call_add_py.sh", fmt.Sprintf("%s/%s", dir, filename), uid)
 		if err != nil {
 			fmt.Println("Error running script:", err)
 			return // Or handle error appropriately
 		}
 
-		modifiedFilePath := fmt.Sprintf("./static/%s", modifiedFilename)
+		modifiedFilePath := fmt.Sprintf("%s/%s", dir, modifiedFilename)
 		modifiedFile, err := os.Open(modifiedFilePath)
 		if err != nil {
 			fmt.Println("Error opening modified file:", err)
@@ -92,8 +144,13 @@ func (a *Application) UploadFileHandler(w http.ResponseWriter, r *http.Request)
 		}
 		tag.Hash = hash
 		tag.Created = int(time.Now().Unix())
+		tag.FilePath = modifiedFilePath
 
-		a.AddTag(tag)
+		if err := a.AddTag(r.Context(), tag); err != nil {
+			fmt.Println("Error adding tag:", err)
+			a.dbError(w, r, err)
+			return
+		}
 
 		fmt.Println("Removed files:", filename, modifiedFilename)
 		fmt.Println("File written successfully:", filename)